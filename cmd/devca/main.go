@@ -0,0 +1,176 @@
+/* 开发用的本地 CA，给每个服务签发 mTLS 证书 */
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/*
+	go run cmd/devca/main.go -dir certs Registry LogService GradingService PortalService
+	- 第一次运行时生成 ca.crt、ca.key，之后复用，新加的服务可以单独补签
+	- 每个服务得到 <ServiceName>.crt、<ServiceName>.key，证书里的名字有服务名、localhost、127.0.0.1、::1
+	- 同一张证书既用来监听也用来访问别的服务
+	只用于本地开发，ca.key 不要提交
+*/
+func main() {
+	dir := flag.String("dir", "certs", "directory to write ca.crt and <ServiceName>.crt/.key into")
+	days := flag.Int("days", 365, "validity of the issued certificates in days")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: devca [-dir certs] [-days 365] ServiceName...")
+		os.Exit(2)
+	}
+	err := os.MkdirAll(*dir, 0700)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	caCert, caKey, err := loadOrCreateCA(*dir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	validFor := time.Duration(*days) * 24 * time.Hour
+	for _, name := range flag.Args() {
+		err := issue(*dir, name, caCert, caKey, validFor)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("issued %s\n", filepath.Join(*dir, name+".crt"))
+	}
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func loadOrCreateCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath, keyPath := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	if _, err := os.Stat(certPath); err == nil {
+		return loadCA(certPath, keyPath)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "distributed dev CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = writePEM(certPath, "CERTIFICATE", der, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = writePEM(keyPath, "EC PRIVATE KEY", keyDER, 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	fmt.Printf("created %s\n", certPath)
+	return cert, key, nil
+}
+
+func loadCA(certPath, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certDER, err := readPEM(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := readPEM(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyDER)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func issue(dir, name string, caCert *x509.Certificate, caKey *ecdsa.PrivateKey, validFor time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validFor),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		// 服务名用来确认对方是哪个服务，localhost 和回环地址用来通过主机名校验
+		DNSNames:    []string{name, "localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	err = writePEM(filepath.Join(dir, name+".crt"), "CERTIFICATE", der, 0644)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(filepath.Join(dir, name+".key"), "EC PRIVATE KEY", keyDER, 0600)
+}
+
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), perm)
+}
+
+func readPEM(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	return block.Bytes, nil
+}
@@ -6,13 +6,26 @@ import (
 	"distributed/log"
 	"distributed/registry"
 	"distributed/service"
+	"flag"
 	"fmt"
 	stlog "log"
 )
 
 func main() {
-	host, port := "localhost", "6000"
-	serviceAddress := fmt.Sprintf("http://%v:%v", host, port) // PostUrl
+	// 同一台机器上可以用不同端口启动多个 grading 实例，注册中心按实例 ID 区分它们
+	port := flag.String("port", "6000", "grading service port")
+	registry.RegistryFlags(flag.CommandLine)
+	flag.Parse()
+	// 注册中心的地址：-registry、REGISTRY_URLS 或者配置文件，见 registry/config.go
+	if err := registry.ConfigureRegistry(); err != nil {
+		stlog.Fatalln(err)
+	}
+	// 设置了 REGISTRY_TLS_DIR 就用里面的证书启用 mTLS
+	if err := registry.EnableTLSFromEnv(registry.GradingService); err != nil {
+		stlog.Fatalln(err)
+	}
+	host := "localhost"
+	serviceAddress := fmt.Sprintf("%v://%v:%v", registry.Scheme(), host, *port) // PostUrl
 	r := registry.Registration{
 		ServiceName:      registry.GradingService, // 这个 ServiceName 必须和 服务发现 的保持一致
 		ServiceURL:       serviceAddress,
@@ -23,7 +36,7 @@ func main() {
 	ctx, err := service.Start(
 		context.Background(), // Background returns a non-nil, empty Context. It is never canceled, has no values, and has no deadline.
 		host,
-		port,
+		*port,
 		/*
 			log.RegisterHandlers()被 Start() 视为 函数本身 作为 值 传入，而不是函数调用，所以不能加"()"
 				- 注意：其实不完全是函数本身，而是被复制为一个新的 函数变量，
@@ -45,11 +58,11 @@ func main() {
 		stlog.Fatalln(err) // Fatalln等价于{l.Println(v...); os.Exit(1)}
 	}
 
-	if logProvider, err := registry.GetProvider(registry.LogService); err == nil {
-		// 如果没发生错误，输出以下；然后设置 logger
+	// 日志服务可能比 grading 晚启动，出现时再设置 logger
+	registry.OnServiceAvailable(registry.LogService, func(logProvider string) {
 		fmt.Printf("Logging service found at: %s\n", logProvider)
 		log.SetClientLogger(logProvider, r.ServiceName)
-	}
+	})
 	/*
 		<-ctx.Done 阻塞
 		何时Done？
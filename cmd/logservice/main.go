@@ -5,20 +5,34 @@ import (
 	"distributed/log"
 	"distributed/registry"
 	"distributed/service"
+	"flag"
 	"fmt"
 	stlog "log"
+	"time"
 )
 
 func main() {
+	registry.RegistryFlags(flag.CommandLine)
+	flag.Parse()
+	// 注册中心的地址：-registry、REGISTRY_URLS 或者配置文件，见 registry/config.go
+	if err := registry.ConfigureRegistry(); err != nil {
+		stlog.Fatalln(err)
+	}
 	log.Run("./ditributed.log")
+	// 设置了 REGISTRY_TLS_DIR 就用里面的证书启用 mTLS
+	if err := registry.EnableTLSFromEnv(registry.LogService); err != nil {
+		stlog.Fatalln(err)
+	}
 	host, port := "localhost", "4000"
-	serviceAddress := fmt.Sprintf("http://%v:%v", host, port) // PostUrl
+	serviceAddress := fmt.Sprintf("%v://%v:%v", registry.Scheme(), host, port) // PostUrl
 	r := registry.Registration{
 		ServiceName:      registry.LogService, // 这个 ServiceName 必须和 服务发现 的保持一致
 		ServiceURL:       serviceAddress,
 		RequiredServices: make([]registry.ServiceName, 0),
 		ServiceUpdateUrl: serviceAddress + "/services",
 		HeartbeatURL: serviceAddress+"/heartbeat",
+		// 日志服务要写磁盘，响应可能比较慢，超时比默认的长一些
+		HealthCheck: &registry.HealthCheck{Timeout: 5 * time.Second, Interval: 5 * time.Second},
 	}
 	ctx, err := service.Start(
 		context.Background(), // Background returns a non-nil, empty Context. It is never canceled, has no values, and has no deadline.
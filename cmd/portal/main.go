@@ -6,17 +6,30 @@ import (
 	"distributed/portal"
 	"distributed/registry"
 	"distributed/service"
+	"errors"
+	"flag"
 	"fmt"
 	stlog "log"
+	"time"
 )
 
 func main() {
+	registry.RegistryFlags(flag.CommandLine)
+	flag.Parse()
+	// 注册中心的地址：-registry、REGISTRY_URLS 或者配置文件，见 registry/config.go
+	if err := registry.ConfigureRegistry(); err != nil {
+		stlog.Fatal(err)
+	}
 	err := portal.ImportTemplates()
 	if err != nil {
 		stlog.Fatal(err) // Fatal is equivalent to Print() followed by a call to os.Exit(1)
 	}
+	// 设置了 REGISTRY_TLS_DIR 就用里面的证书启用 mTLS
+	if err := registry.EnableTLSFromEnv(registry.PortalService); err != nil {
+		stlog.Fatal(err)
+	}
 	host, port := "localhost", "5000"
-	serviceAddress := fmt.Sprintf("http://%s:%s", host, port)
+	serviceAddress := fmt.Sprintf("%s://%s:%s", registry.Scheme(), host, port)
 
 	r := registry.Registration{
 		ServiceName: registry.PortalService,
@@ -28,6 +41,8 @@ func main() {
 		ServiceUpdateUrl: serviceAddress + "/services",
 		HeartbeatURL:     serviceAddress + "/heartbeat",
 	}
+	// 成绩存在 grading 实例的内存里，按学生 ID 做一致性哈希，同一个学生总是落到同一个实例
+	registry.SetBalancer(registry.GradingService, registry.NewConsistentHash(0))
 
 	ctx, err := service.Start(
 		context.Background(),
@@ -35,14 +50,17 @@ func main() {
 		port,
 		r,
 		portal.RegisterHandlers,
+		service.WaitForRequired(10*time.Second), // 没有 grading 页面打不开，等它一会儿
 	)
-	if err != nil {
+	if errors.Is(err, service.ErrNotReady) {
+		stlog.Println(err) // 已经注册了，依赖的服务出现后页面就能用
+	} else if err != nil {
 		stlog.Fatal(err)
 	}
 
-	if logProvider, err := registry.GetProvider(registry.LogService); err != nil {
+	registry.OnServiceAvailable(registry.LogService, func(logProvider string) {
 		log.SetClientLogger(logProvider, r.ServiceName)
-	}
+	})
 
 	<-ctx.Done()
 	fmt.Println("Shutting down portal.")
@@ -4,14 +4,90 @@ package main
 import (
 	"context"
 	"distributed/registry"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 )
 
+/*
+	单机：go run cmd/registryservice/main.go
+	集群：每个节点一个端口，-peers 填其他节点的地址；节点之间要互相认证，用 -tls，或者 -keys 的目录里放 Registry.key
+		go run cmd/registryservice/main.go -port 3000 -keys keys -peers http://localhost:3001,http://localhost:3002
+		go run cmd/registryservice/main.go -port 3001 -keys keys -peers http://localhost:3000,http://localhost:3002
+		go run cmd/registryservice/main.go -port 3002 -keys keys -peers http://localhost:3000,http://localhost:3001
+	mTLS：先用 go run cmd/devca/main.go -dir certs Registry LogService GradingService PortalService 生成证书
+		go run cmd/registryservice/main.go -tls certs
+		REGISTRY_TLS_DIR=certs go run cmd/logservice/main.go
+	DNS：go run cmd/registryservice/main.go -dns 127.0.0.1:8600
+		dig @127.0.0.1 -p 8600 _gradingservice._tcp.service.local SRV
+*/
 func main() {
+	host := flag.String("host", registry.ServiceHost, "host other registry nodes use to reach this node")
+	port := flag.String("port", registry.ServicePort, "port to listen on")
+	peers := flag.String("peers", "", "comma separated addresses of the other registry nodes, empty to run a single node")
+	keysDir := flag.String("keys", "", "directory of <ServiceName>.key files; when set, registrations must be signed with the service's key")
+	tlsDir := flag.String("tls", "", "directory with ca.crt and Registry.crt/Registry.key; when set, serve https and require client certificates")
+	dnsAddr := flag.String("dns", "", "UDP address for the embedded DNS server, e.g. 127.0.0.1:8600; empty disables it")
+	dnsDomain := flag.String("dns-domain", "service.local", "domain the embedded DNS server answers for")
+	auditEvents := flag.Int("audit-events", 0, "maximum number of audit events kept in memory, 0 for the default (10000)")
+	auditAge := flag.Duration("audit-age", 0, "drop audit events older than this, 0 for the default (24h)")
+	dataDir := flag.String("data", "", "directory for persisted registry state, defaults to ./registry-data/<port>; \"-\" disables persistence")
+	flag.Parse()
+	switch *dataDir {
+	case "":
+		*dataDir = "./registry-data/" + *port
+	case "-":
+		*dataDir = ""
+	}
+
+	if *tlsDir != "" {
+		err := registry.EnableTLS(registry.RegistryService, *tlsDir) // 集群节点之间、转发给 leader 也走 mTLS
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if *keysDir != "" {
+		err := registry.EnableAuth(*keysDir) // 注册、注销、续约都要认证，推送的 patch 会签名
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if *peers != "" {
+		// 集群模式：注册表由 Raft 日志复制和重建
+		self := fmt.Sprintf("%s://%s:%s", registry.Scheme(), *host, *port)
+		err := registry.EnableCluster(self, strings.Split(*peers, ","), *dataDir)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		http.Handle("/raft/", registry.RaftService{})
+	} else if *dataDir != "" {
+		err := registry.EnableStorage(*dataDir) // 重启时从 WAL + 快照恢复注册信息
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if *dnsAddr != "" {
+		err := registry.ServeDNS(*dnsAddr, *dnsDomain) // 给不能用 registry.GetProvider 的程序查服务地址
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	registry.SetAuditRetention(*auditEvents, *auditAge) // GET /services/events 能查到多久以前的
+
 	registry.SetupRegistryService()
 	http.Handle("/services", registry.RegistrationService{})
+	http.Handle("/services/", registry.RegistrationService{}) // /services/watch、/services/{name}...
+	http.Handle("/leases/", registry.LeaseService{})          // 租约模式的服务在这里续约
+	http.Handle("/kv/", registry.KVService{})                 // key/value 配置存储
+	http.Handle("/sessions", registry.SessionService{})
+	http.Handle("/sessions/", registry.SessionService{})   // 锁和选主用的会话
+	http.Handle("/dashboard", registry.DashboardService{}) // 网页控制台
 
 	ctx, cancel := context.WithCancel(context.Background()) // WithCancel()第二个return 是一个函数：func() { c.cancel(true, Canceled) }
 	defer cancel()
@@ -22,10 +98,15 @@ func main() {
 		- ListenAndServe()方法里 调用了net.Listen，
 			- Listen函数有一部分注解：一个未指定的文字IP地址，侦听所有可用的，本地系统的单播和任意播IP地址。
 	*/
-	srv.Addr = ":" + registry.ServicePort
+	srv.Addr = ":" + *port
 
 	go func() {
-		log.Println(srv.ListenAndServe()) // 启动出错打印
+		if tlsConfig := registry.ServerTLSConfig(); tlsConfig != nil {
+			srv.TLSConfig = tlsConfig
+			log.Println(srv.ListenAndServeTLS("", ""))
+		} else {
+			log.Println(srv.ListenAndServe()) // 启动出错打印
+		}
 		cancel()
 	}()
 
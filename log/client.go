@@ -7,6 +7,7 @@ import (
 	stlog "log"
 	"net/http"
 	"strings"
+	"time"
 )
 
 type clientLogger struct {
@@ -22,10 +23,11 @@ func SetClientLogger(ServiceUrl string, clientService registry.ServiceName) {
 func (cl clientLogger) Write(data []byte) (int, error) {
 	trimmedData := strings.TrimSpace(string(data)) // 我使用 TrimSpace 提前将前导、尾随空白字符，包括空行去掉
 	b := bytes.NewBuffer([]byte(trimmedData))      // 如果data中有多余的空行，那么构造的bytes.Buffer对象会保留这些空行;这可能导致在后续处理中出现额外的空行
-	res, err := http.Post(cl.url+"log", "text/plain", b)
+	res, err := registry.ClientFor(registry.LogService, 5*time.Second).Post(cl.url+"/log", "text/plain", b)
 	if err != nil {
 		return 0, err
 	}
+	res.Body.Close()
 	if res.StatusCode != http.StatusOK {
 		return 0, fmt.Errorf("failed to send log message. service responded with %d - %s", res.StatusCode, res.Status)
 	}
@@ -72,8 +72,9 @@ func (studentsHandler) renderStudents(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
+	defer registry.ReleaseProvider(registry.GradingService, serviceURL)
 
-	res, err := http.Get(serviceURL + "/students")
+	res, err := registry.ClientFor(registry.GradingService, 0).Get(serviceURL + "/students")
 	if err != nil {
 		return
 	}
@@ -98,12 +99,14 @@ func (studentsHandler) renderStudent(w http.ResponseWriter, r *http.Request, id
 		}
 	}()
 
-	serviceURL, err := registry.GetProvider(registry.GradingService)
+	// 同一个学生总是找同一个 grading 实例，成绩存在实例的内存里
+	serviceURL, err := registry.GetProviderFor(registry.GradingService, id)
 	if err != nil {
 		return
 	}
+	defer registry.ReleaseProvider(registry.GradingService, serviceURL)
 
-	res, err := http.Get(fmt.Sprintf("%v/students/%v", serviceURL, id))
+	res, err := registry.ClientFor(registry.GradingService, 0).Get(fmt.Sprintf("%v/students/%v", serviceURL, id))
 	if err != nil {
 		return
 	}
@@ -144,12 +147,13 @@ func (studentsHandler) renderGrades(w http.ResponseWriter, r *http.Request, id s
 		log.Println("Failed to convert grade to JSON: ", g, err)
 	}
 
-	serviceURL, err := registry.GetProvider(registry.GradingService)
+	serviceURL, err := registry.GetProviderFor(registry.GradingService, id)
 	if err != nil {
 		log.Println("Failed to retrieve instance of Grading Service", err)
 		return
 	}
-	res, err := http.Post(fmt.Sprintf("%v/students/%v/grades", serviceURL, id), "application/json", bytes.NewBuffer(data))
+	defer registry.ReleaseProvider(registry.GradingService, serviceURL)
+	res, err := registry.ClientFor(registry.GradingService, 0).Post(fmt.Sprintf("%v/students/%v/grades", serviceURL, id), "application/json", bytes.NewBuffer(data))
 	if err != nil {
 		log.Println("Failed to save grade to Grading Service", err)
 		return
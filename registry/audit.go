@@ -0,0 +1,220 @@
+/*
+	注册中心的审计记录：谁在什么时候从哪里注册、注销，实例因为什么被移除，健康状态怎么变的，
+	变化通知给了哪些依赖方、送到了没有
+		GET /services/events                      最新的 100 条，新的在前
+		GET /services/events?before=N&limit=50    继续往前翻，N 是上一页返回的 Next
+		GET /services/events?after=N              N 之后的记录，旧的在前，适合增量拉取
+	都可以带 service=GradingService、type=registered 过滤
+	记录只保存在内存里，条数超过 maxEvents 或者超过 maxAge 的会被淘汰（见 SetAuditRetention）
+	这些事情都发生在 leader 上，集群模式下查询转发给 leader，leader 切换后之前的记录留在旧 leader 上
+*/
+package registry
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 审计记录的类型
+const (
+	auditRegistered   = "registered"   // 注册成功
+	auditRejected     = "rejected"     // 注册、注销或者修改维护状态被拒绝
+	auditDeregistered = "deregistered" // 服务自己或者管理员注销
+	auditRemoved      = "removed"      // critical 太久被健康检查移除
+	auditExpired      = "expired"      // 租约过期
+	auditStatus       = "status"       // 健康状态变化
+	auditMaintenance  = "maintenance"  // 进入或退出维护
+	auditPatch        = "patch"        // 给一个依赖方的 patch 送到了，或者重试多次后放弃
+	auditKV           = "kv"           // KV 存储的写操作，Reason 是操作和 key
+	auditSession      = "session"      // 会话的创建和销毁，见 lock.go
+)
+
+const (
+	defaultAuditEvents = 10000
+	defaultAuditAge    = 24 * time.Hour
+	defaultAuditPage   = 100
+	maxAuditPage       = 1000
+)
+
+// 审计记录里的调用方，不是由请求触发的操作用它们
+const (
+	actorHealthCheck = "health-check"
+	actorLease       = "lease"
+	actorRegistry    = "registry"
+)
+
+type auditEvent struct {
+	ID         uint64
+	Time       time.Time
+	Type       string
+	Service    ServiceName `json:",omitempty"`
+	InstanceID string      `json:",omitempty"`
+	URL        string      `json:",omitempty"`
+	Actor      string      `json:",omitempty"` // 认证出的调用方，没有启用认证时为空；或者 actorHealthCheck 这些
+	RemoteAddr string      `json:",omitempty"`
+	Reason     string      `json:",omitempty"`
+	Status     string      `json:",omitempty"` // auditStatus、auditMaintenance 之后的状态
+	Revision   uint64      `json:",omitempty"`
+	Target     ServiceName `json:",omitempty"` // auditPatch 的接收方，Service/InstanceID/URL 是它的
+	Delivered  *bool       `json:",omitempty"` // auditPatch 有没有送到
+	Attempts   int         `json:",omitempty"` // auditPatch 一共发了几次
+	Error      string      `json:",omitempty"`
+}
+
+type auditPage struct {
+	Events []auditEvent
+	Next   uint64 // 下一页用的 before 或 after
+	More   bool
+}
+
+var audit = struct {
+	events    []auditEvent // 按 ID 递增
+	seq       uint64
+	maxEvents int
+	maxAge    time.Duration
+	mutex     *sync.Mutex
+}{
+	events:    make([]auditEvent, 0),
+	maxEvents: defaultAuditEvents,
+	maxAge:    defaultAuditAge,
+	mutex:     new(sync.Mutex),
+}
+
+// 最多保留 maxEvents 条、maxAge 以内的记录，小于等于 0 的保持原来的设置
+func SetAuditRetention(maxEvents int, maxAge time.Duration) {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	if maxEvents > 0 {
+		audit.maxEvents = maxEvents
+	}
+	if maxAge > 0 {
+		audit.maxAge = maxAge
+	}
+	trimAudit(time.Now())
+}
+
+func recordAudit(e auditEvent) {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	audit.seq++
+	e.ID = audit.seq
+	e.Time = time.Now()
+	audit.events = append(audit.events, e)
+	trimAudit(e.Time)
+}
+
+// 调用方需持有 audit.mutex
+func trimAudit(now time.Time) {
+	drop := 0
+	if len(audit.events) > audit.maxEvents {
+		drop = len(audit.events) - audit.maxEvents
+	}
+	for drop < len(audit.events) && now.Sub(audit.events[drop].Time) > audit.maxAge {
+		drop++
+	}
+	if drop > 0 {
+		audit.events = append([]auditEvent(nil), audit.events[drop:]...)
+	}
+}
+
+// 一个实例的审计记录，带上请求方的地址和认证出的身份
+func auditInstance(eventType string, reg Registration, req *http.Request, actor ServiceName) auditEvent {
+	e := auditEvent{
+		Type:       eventType,
+		Service:    reg.ServiceName,
+		InstanceID: reg.InstanceID,
+		URL:        reg.ServiceURL,
+		Actor:      string(actor),
+	}
+	if req != nil {
+		e.RemoteAddr = req.RemoteAddr
+		if client, ok := forwardedClient(req); ok { // follower 转发过来的，客户端自己带的 X-Forwarded-For 不可信
+			e.RemoteAddr = client
+		}
+	}
+	return e
+}
+
+func auditMatch(e auditEvent, service ServiceName, eventType string) bool {
+	return (service == "" || e.Service == service || e.Target == service) && (eventType == "" || e.Type == eventType)
+}
+
+// forward 时从 after 往后翻（旧的在前），否则从 before 往前翻（新的在前），before 为 0 表示从最新的开始
+func auditQuery(service ServiceName, eventType string, forward bool, after, before uint64, limit int) auditPage {
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	trimAudit(time.Now())
+	page := auditPage{Events: make([]auditEvent, 0)}
+	if forward {
+		for _, e := range audit.events {
+			if e.ID <= after || !auditMatch(e, service, eventType) {
+				continue
+			}
+			if len(page.Events) == limit {
+				page.More = true
+				break
+			}
+			page.Events = append(page.Events, e)
+			page.Next = e.ID
+		}
+		if len(page.Events) == 0 {
+			page.Next = after
+		}
+		return page
+	}
+	for i := len(audit.events) - 1; i >= 0; i-- {
+		e := audit.events[i]
+		if (before > 0 && e.ID >= before) || !auditMatch(e, service, eventType) {
+			continue
+		}
+		if len(page.Events) == limit {
+			page.More = true
+			break
+		}
+		page.Events = append(page.Events, e)
+		page.Next = e.ID
+	}
+	return page
+}
+
+func (s RegistrationService) serveEvents(w http.ResponseWriter, r *http.Request) {
+	if reg.forwardToLeader(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	parse := func(name string) (uint64, bool) {
+		value := query.Get(name)
+		if value == "" {
+			return 0, true
+		}
+		n, err := strconv.ParseUint(value, 10, 64)
+		return n, err == nil
+	}
+	after, ok1 := parse("after")
+	before, ok2 := parse("before")
+	limit, ok3 := parse("limit")
+	if !ok1 || !ok2 || !ok3 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if limit == 0 {
+		limit = defaultAuditPage
+	}
+	if limit > maxAuditPage {
+		limit = maxAuditPage
+	}
+	forward := query.Get("after") != "" // after=0 表示从最早的一条开始
+	page := auditQuery(ServiceName(query.Get("service")), query.Get("type"), forward, after, before, int(limit))
+	data, err := json.Marshal(page)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(data)
+}
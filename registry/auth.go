@@ -0,0 +1,473 @@
+/*
+	注册、注销、续约的认证，以及推送 patch 的签名
+	- 每个服务一个密钥，放在本地文件里：注册中心读一个目录下的 <ServiceName>.key，服务只读自己的那一个
+	  生成密钥：openssl rand -hex 32 > keys/GradingService.key
+	- 服务发请求时带上
+		Authorization: HMAC-SHA256 service=<ServiceName>,ts=<unix 秒>,nonce=<hex>,sig=<hex>
+	  sig = HMAC-SHA256(key, "request" + "\n" + METHOD + "\n" + PATH + "\n" + ts + "\n" + nonce + "\n" + hex(sha256(body)))
+	  PATH 带上查询参数（PATH?QUERY），改了查询参数的请求签名就对不上
+	  也可以直接带 Authorization: Bearer <密钥文件的内容>，适合 curl 之类的工具
+	- 注册中心推送 patch 时用接收方的密钥签名，放在 X-Registry-Signature: ts=<unix 秒>,nonce=<hex>,sig=<hex>，
+	  签名的内容以 "patch" 开头，serviceUpdateHandler 验证通过才处理；
+	  同一个密钥签的请求和 patch 不能互相冒充，比如发往注册中心的 POST /services 不能拿去当作推给服务的 patch
+	- ts 和当前时间相差超过 maxClockSkew 的拒绝；这段时间内见过的 nonce 也拒绝，截获的请求不能重放
+	- 集群里收到请求的节点先验证调用方的密钥和证书，再转发给 leader：X-Registry-Forwarded-For 带上原始的调用方地址，
+	  X-Registry-Forwarded-Caller 带上认证出的调用方，用注册中心自己的密钥（密钥目录里的 Registry.key）签名；
+	  leader 只在签名正确或者对方出示了注册中心的证书时才相信它们，注册中心的证书本身不能操作任何服务
+	- 集群节点之间的 Raft 消息也用 Registry.key 签名（签名的内容以 "raft" 开头），或者走 mTLS 用注册中心的证书
+	- 密钥目录里的 Admin.key 是管理员的密钥，可以注销任何实例、把任何实例设为维护状态，控制台用它
+	注册中心没有调用 EnableAuth 时不做认证，服务没有加载密钥时不签名也不验证
+*/
+package registry
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	authScheme      = "HMAC-SHA256"
+	signatureHeader = "X-Registry-Signature"
+	keyFileSuffix   = ".key"
+	maxClockSkew    = 5 * time.Minute
+)
+
+// 签名的用途，写在签名内容的最前面
+const (
+	purposeRequest = "request" // 服务发往注册中心的请求
+	purposePatch   = "patch"   // 注册中心推给服务的 patch
+	purposeForward = "forward" // follower 转发请求时带上的调用方地址
+	purposeRaft    = "raft"    // 注册中心节点之间的 Raft 消息
+)
+
+const (
+	forwardedHeader          = "X-Registry-Forwarded-For"
+	forwardedCallerHeader    = "X-Registry-Forwarded-Caller"
+	forwardedSignatureHeader = "X-Registry-Forwarded-Signature"
+)
+
+// 管理员，用它的密钥或证书可以操作任何服务
+const AdminService = ServiceName("Admin")
+
+var (
+	errUnauthorized = errors.New("unauthorized")
+	errForbidden    = errors.New("forbidden")
+)
+
+// 注册中心这边所有服务的密钥，为 nil 时不做认证
+var registryKeys = struct {
+	keys  map[ServiceName][]byte
+	mutex *sync.RWMutex
+}{
+	mutex: new(sync.RWMutex),
+}
+
+// 服务这边自己的密钥
+var serviceKeys = struct {
+	keys  map[ServiceName][]byte
+	mutex *sync.RWMutex
+}{
+	keys:  make(map[ServiceName][]byte),
+	mutex: new(sync.RWMutex),
+}
+
+// 读一个密钥文件，去掉首尾空白，空文件视为错误
+func readKeyFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := []byte(strings.TrimSpace(string(data)))
+	if len(key) == 0 {
+		return nil, fmt.Errorf("key file %s is empty", path)
+	}
+	return key, nil
+}
+
+// 注册中心启用认证：dir 下每个 <ServiceName>.key 是一个服务的密钥
+func EnableAuth(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+keyFileSuffix))
+	if err != nil {
+		return err
+	}
+	keys := make(map[ServiceName][]byte)
+	for _, file := range files {
+		key, err := readKeyFile(file)
+		if err != nil {
+			return err
+		}
+		keys[ServiceName(strings.TrimSuffix(filepath.Base(file), keyFileSuffix))] = key
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no %s files found in %s", keyFileSuffix, dir)
+	}
+	registryKeys.mutex.Lock()
+	registryKeys.keys = keys
+	registryKeys.mutex.Unlock()
+	return nil
+}
+
+// 服务加载自己的密钥，之后发给注册中心的请求都会签名，收到的 patch 都要验证签名
+func LoadServiceKey(name ServiceName, path string) error {
+	key, err := readKeyFile(path)
+	if err != nil {
+		return err
+	}
+	serviceKeys.mutex.Lock()
+	serviceKeys.keys[name] = key
+	serviceKeys.mutex.Unlock()
+	return nil
+}
+
+func serviceKey(name ServiceName) ([]byte, bool) {
+	serviceKeys.mutex.RLock()
+	defer serviceKeys.mutex.RUnlock()
+	key, ok := serviceKeys.keys[name]
+	return key, ok
+}
+
+func sign(key []byte, purpose, method, path string, ts int64, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d\n%s\n%s", purpose, method, path, ts, nonce, hex.EncodeToString(bodyHash[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 签名覆盖的路径和查询参数，?recurse 之类的参数不能在签名之后加上去
+func signedTarget(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	return u.Path + "?" + u.RawQuery
+}
+
+// 最近 maxClockSkew 内见过的 nonce -> 过期时间，签名验证通过后才记下
+var nonces = struct {
+	seen  map[string]time.Time
+	sweep time.Time // 下次清理过期 nonce 的时间
+	mutex *sync.Mutex
+}{
+	seen:  make(map[string]time.Time),
+	mutex: new(sync.Mutex),
+}
+
+// 第一次见到 nonce 时记下并返回 true，重放的返回 false
+func useNonce(nonce string) bool {
+	nonces.mutex.Lock()
+	defer nonces.mutex.Unlock()
+	now := time.Now()
+	if now.After(nonces.sweep) {
+		for n, expires := range nonces.seen {
+			if now.After(expires) {
+				delete(nonces.seen, n)
+			}
+		}
+		nonces.sweep = now.Add(maxClockSkew)
+	}
+	if expires, ok := nonces.seen[nonce]; ok && !now.After(expires) {
+		return false
+	}
+	nonces.seen[nonce] = now.Add(2 * maxClockSkew) // ts 可以比现在早或者晚 maxClockSkew
+	return true
+}
+
+// 解析 k1=v1,k2=v2
+func parseParams(s string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = kv[1]
+		}
+	}
+	return params
+}
+
+// 检查 ts、签名和 nonce，params 是 ts、nonce、sig
+func verify(key []byte, purpose, method, path string, params map[string]string, body []byte) bool {
+	return params["nonce"] != "" && validSignature(key, purpose, method, path, params, body) && useNonce(params["nonce"])
+}
+
+// 只检查 ts 和签名
+func validSignature(key []byte, purpose, method, path string, params map[string]string, body []byte) bool {
+	unix, err := strconv.ParseInt(params["ts"], 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew > maxClockSkew || skew < -maxClockSkew {
+		return false
+	}
+	expected := sign(key, purpose, method, path, unix, params["nonce"], body)
+	return hmac.Equal([]byte(expected), []byte(params["sig"]))
+}
+
+// 用 name 的密钥给发往注册中心的请求签名，没有密钥就不签
+func newSignedRequest(method, url string, name ServiceName, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if key, ok := serviceKey(name); ok {
+		ts, nonce := time.Now().Unix(), newID()
+		req.Header.Set("Authorization", fmt.Sprintf("%s service=%s,ts=%d,nonce=%s,sig=%s", authScheme, name, ts, nonce, sign(key, purposeRequest, method, signedTarget(req.URL), ts, nonce, body)))
+	}
+	return req, nil
+}
+
+// 认证出的调用方，follower 认证之后转发给 leader 的也是它
+type callerIdentity struct {
+	Service ServiceName // 密钥认证出的服务，没有启用认证时为空
+	Peer    ServiceName // mTLS 客户端证书上的名字，不是 TLS 连接时为空
+}
+
+func authEnabled() bool {
+	registryKeys.mutex.RLock()
+	defer registryKeys.mutex.RUnlock()
+	return registryKeys.keys != nil
+}
+
+/*
+	验证请求自己带的凭据，不管要操作哪个服务
+	- 没有启用认证：只有 mTLS 客户端证书上的名字
+	- 没有 Authorization、签名不对、过期、重放：errUnauthorized
+*/
+func identify(req *http.Request, body []byte) (callerIdentity, error) {
+	caller := callerIdentity{Peer: peerName(req)}
+	registryKeys.mutex.RLock()
+	keys := registryKeys.keys
+	registryKeys.mutex.RUnlock()
+	if keys == nil {
+		return caller, nil
+	}
+
+	auth := req.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(auth, "Bearer "):
+		token := []byte(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+		for name, key := range keys {
+			if subtle.ConstantTimeCompare(key, token) == 1 {
+				caller.Service = name
+				return caller, nil
+			}
+		}
+	case strings.HasPrefix(auth, authScheme+" "):
+		params := parseParams(strings.TrimPrefix(auth, authScheme+" "))
+		name := ServiceName(params["service"])
+		if key, ok := keys[name]; ok && verify(key, purposeRequest, req.Method, signedTarget(req.URL), params, body) {
+			caller.Service = name
+			return caller, nil
+		}
+	}
+	return callerIdentity{}, errUnauthorized
+}
+
+// 别的注册中心节点转发过来、带着它认证出的调用方的，用转发的调用方，否则验证请求自己的凭据
+func requestCaller(req *http.Request, body []byte) (callerIdentity, error) {
+	if caller, ok := forwardedCaller(req); ok {
+		return caller, nil
+	}
+	return identify(req, body)
+}
+
+/*
+	调用方能不能操作 name 这个服务，返回认证出的调用方（写审计记录用）
+	- mTLS 客户端证书和密钥认证出的服务都必须是 name 或者管理员，否则 errForbidden
+	- 没有启用认证时调用方是客户端证书上的名字，没有证书时为空
+*/
+func authorize(caller callerIdentity, name ServiceName) (ServiceName, error) {
+	err := checkPeer(caller.Peer, name)
+	if err != nil {
+		return "", err
+	}
+	if !authEnabled() {
+		return caller.Peer, nil
+	}
+	if caller.Service == "" {
+		return "", errUnauthorized
+	}
+	if caller.Service != name && caller.Service != AdminService {
+		return "", errForbidden
+	}
+	return caller.Service, nil
+}
+
+// 注册中心验证请求来自 name 这个服务（或者管理员）
+func authenticate(req *http.Request, body []byte, name ServiceName) (ServiceName, error) {
+	caller, err := requestCaller(req, body)
+	if err != nil {
+		return "", err
+	}
+	return authorize(caller, name)
+}
+
+// 不限定是哪个服务，注册中心认识的任何服务或者管理员都可以，KV 存储的写操作用
+func authenticateAny(req *http.Request, body []byte) (ServiceName, error) {
+	caller, err := requestCaller(req, body)
+	if err != nil {
+		return "", err
+	}
+	name := caller.Service
+	if !authEnabled() {
+		name = caller.Peer
+	}
+	return authorize(caller, name)
+}
+
+func writeAuthError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errForbidden) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w.Header().Set("WWW-Authenticate", authScheme)
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+// 注册中心节点之间共用的密钥，没有启用认证或者密钥目录里没有 Registry.key 时 ok 为 false
+func clusterKey() ([]byte, bool) {
+	registryKeys.mutex.RLock()
+	defer registryKeys.mutex.RUnlock()
+	key, ok := registryKeys.keys[RegistryService]
+	return key, ok
+}
+
+/*
+	follower 转发前带上原始的调用方地址，以及 caller 不为 nil 时它认证出的调用方，客户端自己带的同名头去掉
+	有 Registry.key 时用它签名，否则 leader 只能靠 mTLS 连接上注册中心的证书相信这些头
+*/
+func signForwarded(req *http.Request, caller *callerIdentity) {
+	client := req.RemoteAddr
+	if forwarded, ok := forwardedClient(req); ok { // 经过了不止一个节点
+		client = forwarded
+	}
+	req.Header.Del(forwardedCallerHeader)
+	req.Header.Del(forwardedSignatureHeader)
+	req.Header.Set(forwardedHeader, client)
+	if caller != nil {
+		req.Header.Set(forwardedCallerHeader, fmt.Sprintf("service=%s,peer=%s", caller.Service, caller.Peer))
+	}
+	if key, ok := clusterKey(); ok {
+		ts, nonce := time.Now().Unix(), newID()
+		req.Header.Set(forwardedSignatureHeader, fmt.Sprintf("ts=%d,nonce=%s,sig=%s", ts, nonce, sign(key, purposeForward, req.Method, signedTarget(req.URL), ts, nonce, forwardedPayload(req))))
+	}
+}
+
+// 转发头签名的内容：调用方地址和调用方
+func forwardedPayload(req *http.Request) []byte {
+	return []byte(req.Header.Get(forwardedHeader) + "\n" + req.Header.Get(forwardedCallerHeader))
+}
+
+// 连接的对方出示了注册中心的证书
+func fromRegistryPeer(req *http.Request) bool {
+	return req.TLS != nil && len(req.TLS.PeerCertificates) > 0 && certHasName(req.TLS.PeerCertificates[0], RegistryService)
+}
+
+// 请求是别的注册中心节点转发过来的才返回原始的调用方地址：对方出示了注册中心的证书，或者转发头带着 Registry.key 的签名
+func forwardedClient(req *http.Request) (string, bool) {
+	client := req.Header.Get(forwardedHeader)
+	if client == "" {
+		return "", false
+	}
+	if fromRegistryPeer(req) {
+		return client, true
+	}
+	key, ok := clusterKey()
+	if !ok || !validSignature(key, purposeForward, req.Method, signedTarget(req.URL), parseParams(req.Header.Get(forwardedSignatureHeader)), forwardedPayload(req)) {
+		return "", false
+	}
+	return client, true
+}
+
+// 转发过来的请求里 follower 认证出的调用方，和 forwardedClient 一样只相信注册中心节点；签名的 nonce 用过一次就不能再用
+func forwardedCaller(req *http.Request) (callerIdentity, bool) {
+	value := req.Header.Get(forwardedCallerHeader)
+	if value == "" || req.Header.Get(forwardedHeader) == "" {
+		return callerIdentity{}, false
+	}
+	if !fromRegistryPeer(req) {
+		key, ok := clusterKey()
+		if !ok || !verify(key, purposeForward, req.Method, signedTarget(req.URL), parseParams(req.Header.Get(forwardedSignatureHeader)), forwardedPayload(req)) {
+			return callerIdentity{}, false
+		}
+	}
+	params := parseParams(value)
+	return callerIdentity{Service: ServiceName(params["service"]), Peer: ServiceName(params["peer"])}, true
+}
+
+// 发给其他注册中心节点的 Raft 消息用 Registry.key 签名，没有这个密钥时不签，只靠 mTLS 的证书
+func signRaft(req *http.Request, body []byte) {
+	key, ok := clusterKey()
+	if !ok {
+		return
+	}
+	ts, nonce := time.Now().Unix(), newID()
+	req.Header.Set("Authorization", fmt.Sprintf("%s service=%s,ts=%d,nonce=%s,sig=%s", authScheme, RegistryService, ts, nonce, sign(key, purposeRaft, req.Method, signedTarget(req.URL), ts, nonce, body)))
+}
+
+// Raft 消息只接受集群里的节点发来的：对方出示了注册中心的证书，或者带着 Registry.key 的签名；两样都没有配置时一律拒绝
+func authenticateRaft(req *http.Request, body []byte) error {
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		if certHasName(req.TLS.PeerCertificates[0], RegistryService) {
+			return nil
+		}
+		return fmt.Errorf("%w: client certificate is not for %v", errForbidden, RegistryService)
+	}
+	key, ok := clusterKey()
+	auth := req.Header.Get("Authorization")
+	if !ok || !strings.HasPrefix(auth, authScheme+" ") {
+		return errUnauthorized
+	}
+	params := parseParams(strings.TrimPrefix(auth, authScheme+" "))
+	if ServiceName(params["service"]) != RegistryService || !verify(key, purposeRaft, req.Method, signedTarget(req.URL), params, body) {
+		return errUnauthorized
+	}
+	return nil
+}
+
+// 注册中心用接收方的密钥给 patch 签名，没有启用认证或者没有它的密钥就不签；每次发送（包括重试）都重新签
+func signPatch(req *http.Request, to ServiceName, body []byte) {
+	registryKeys.mutex.RLock()
+	key, ok := registryKeys.keys[to]
+	registryKeys.mutex.RUnlock()
+	if !ok {
+		return
+	}
+	ts, nonce := time.Now().Unix(), newID()
+	req.Header.Set(signatureHeader, fmt.Sprintf("ts=%d,nonce=%s,sig=%s", ts, nonce, sign(key, purposePatch, req.Method, signedTarget(req.URL), ts, nonce, body)))
+}
+
+// 服务验证 patch 来自注册中心，自己没有密钥时不验证
+func verifyPatch(req *http.Request, name ServiceName, body []byte) bool {
+	key, ok := serviceKey(name)
+	if !ok {
+		return true
+	}
+	return verify(key, purposePatch, req.Method, signedTarget(req.URL), parseParams(req.Header.Get(signatureHeader)), body)
+}
+
+// 环境变量 REGISTRY_KEY_DIR 下的 <ServiceName>.key，RegisterService 时如果还没加载密钥就用它，不存在时返回空
+func keyFileFromEnv(name ServiceName) string {
+	dir := os.Getenv("REGISTRY_KEY_DIR")
+	if dir == "" {
+		return ""
+	}
+	path := filepath.Join(dir, string(name)+keyFileSuffix)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
@@ -0,0 +1,213 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// 注册中心和服务两边都用 keys，测试结束后恢复
+func withKeys(t *testing.T, keys map[ServiceName][]byte) {
+	t.Helper()
+	registryKeys.mutex.Lock()
+	oldRegistry := registryKeys.keys
+	registryKeys.keys = keys
+	registryKeys.mutex.Unlock()
+	serviceKeys.mutex.Lock()
+	oldService := serviceKeys.keys
+	serviceKeys.keys = keys
+	serviceKeys.mutex.Unlock()
+	t.Cleanup(func() {
+		registryKeys.mutex.Lock()
+		registryKeys.keys = oldRegistry
+		registryKeys.mutex.Unlock()
+		serviceKeys.mutex.Lock()
+		serviceKeys.keys = oldService
+		serviceKeys.mutex.Unlock()
+	})
+}
+
+func TestAuthenticateSignedRequest(t *testing.T) {
+	withKeys(t, map[ServiceName][]byte{GradingService: []byte("grading"), LogService: []byte("log")})
+	body := []byte(`{"ServiceName":"GradingService"}`)
+	req, err := newSignedRequest(http.MethodPost, "http://registry/services", GradingService, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caller, err := authenticate(req, body, GradingService)
+	if err != nil || caller != GradingService {
+		t.Fatalf("authenticate = %v, %v; want GradingService", caller, err)
+	}
+	if _, err := authenticate(req, body, GradingService); !errors.Is(err, errUnauthorized) {
+		t.Fatalf("replayed request: err = %v, want errUnauthorized", err)
+	}
+
+	req, _ = newSignedRequest(http.MethodPost, "http://registry/services", GradingService, body)
+	if _, err := authenticate(req, []byte("tampered"), GradingService); !errors.Is(err, errUnauthorized) {
+		t.Fatalf("tampered body: err = %v, want errUnauthorized", err)
+	}
+	req, _ = newSignedRequest(http.MethodPost, "http://registry/services", GradingService, body)
+	if _, err := authenticate(req, body, LogService); !errors.Is(err, errForbidden) {
+		t.Fatalf("other service: err = %v, want errForbidden", err)
+	}
+}
+
+// 签名覆盖查询参数：签的是 DELETE /kv/foo，不能改成 ?recurse 删掉整个前缀
+func TestSignatureCoversQuery(t *testing.T) {
+	withKeys(t, map[ServiceName][]byte{GradingService: []byte("grading")})
+	req, err := newSignedRequest(http.MethodDelete, "http://registry/kv/foo", GradingService, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.URL.RawQuery = "recurse"
+	if _, err := authenticateAny(req, nil); !errors.Is(err, errUnauthorized) {
+		t.Fatalf("tampered query: err = %v, want errUnauthorized", err)
+	}
+
+	req, _ = newSignedRequest(http.MethodDelete, "http://registry/kv/foo?cas=3", GradingService, nil)
+	req.URL.RawQuery = "cas=4"
+	if _, err := authenticateAny(req, nil); !errors.Is(err, errUnauthorized) {
+		t.Fatalf("changed query: err = %v, want errUnauthorized", err)
+	}
+
+	req, _ = newSignedRequest(http.MethodDelete, "http://registry/kv/foo?recurse", GradingService, nil)
+	if caller, err := authenticateAny(req, nil); err != nil || caller != GradingService {
+		t.Fatalf("signed query: authenticateAny = %v, %v; want GradingService", caller, err)
+	}
+}
+
+// 同一个密钥签的 patch 和请求不能互相冒充
+func TestSignaturePurposes(t *testing.T) {
+	withKeys(t, map[ServiceName][]byte{GradingService: []byte("grading")})
+	body := []byte(`{"Revision":1}`)
+
+	patch := httptest.NewRequest(http.MethodPost, "http://grading/services", bytes.NewReader(body))
+	signPatch(patch, GradingService, body)
+	asRequest := httptest.NewRequest(http.MethodPost, "http://grading/services", bytes.NewReader(body))
+	asRequest.Header.Set("Authorization", authScheme+" service=GradingService,"+patch.Header.Get(signatureHeader))
+	if _, err := authenticate(asRequest, body, GradingService); !errors.Is(err, errUnauthorized) {
+		t.Fatalf("patch signature accepted as request: err = %v", err)
+	}
+
+	request, _ := newSignedRequest(http.MethodPost, "http://grading/services", GradingService, body)
+	asPatch := httptest.NewRequest(http.MethodPost, "http://grading/services", bytes.NewReader(body))
+	params := parseParams(request.Header.Get("Authorization")[len(authScheme)+1:])
+	asPatch.Header.Set(signatureHeader, "ts="+params["ts"]+",nonce="+params["nonce"]+",sig="+params["sig"])
+	if verifyPatch(asPatch, GradingService, body) {
+		t.Fatal("request signature accepted as patch")
+	}
+
+	if !verifyPatch(patch, GradingService, body) {
+		t.Fatal("valid patch rejected")
+	}
+	if verifyPatch(patch, GradingService, body) {
+		t.Fatal("replayed patch accepted")
+	}
+}
+
+func TestForwardedClient(t *testing.T) {
+	withKeys(t, map[ServiceName][]byte{RegistryService: []byte("cluster")})
+
+	spoofed := httptest.NewRequest(http.MethodPost, "http://leader/services", nil)
+	spoofed.Header.Set(forwardedHeader, "10.0.0.1:1234")
+	if client, ok := forwardedClient(spoofed); ok {
+		t.Fatalf("unsigned forwarded header trusted: %s", client)
+	}
+	spoofed.Header.Set("X-Forwarded-For", "10.0.0.1")
+	if e := auditInstance(auditRegistered, Registration{}, spoofed, ""); e.RemoteAddr != spoofed.RemoteAddr {
+		t.Fatalf("audit RemoteAddr = %s, want %s", e.RemoteAddr, spoofed.RemoteAddr)
+	}
+
+	forwarded := httptest.NewRequest(http.MethodPost, "http://leader/services", nil)
+	forwarded.RemoteAddr = "192.168.1.7:5555"
+	signForwarded(forwarded, nil) // follower 上
+	forwarded.RemoteAddr = "192.168.1.2:3001"
+	if e := auditInstance(auditRegistered, Registration{}, forwarded, ""); e.RemoteAddr != "192.168.1.7:5555" {
+		t.Fatalf("audit RemoteAddr = %s, want the original client", e.RemoteAddr)
+	}
+	forwarded.Header.Set(forwardedHeader, "10.0.0.1:1234") // 改了地址签名就对不上
+	if _, ok := forwardedClient(forwarded); ok {
+		t.Fatal("tampered forwarded header trusted")
+	}
+}
+
+// 别的服务不能用已经注册了的实例 ID 重新注册，把实例抢过去
+func TestRegisterForeignInstanceID(t *testing.T) {
+	withKeys(t, map[ServiceName][]byte{GradingService: []byte("grading"), LogService: []byte("log")})
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	updates := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer updates.Close()
+	reg.apply(walEntry{Op: opAdd, Registration: &Registration{
+		ServiceName: GradingService, InstanceID: "shared-1", ServiceURL: "http://grading-1", ServiceUpdateUrl: updates.URL,
+	}})
+	t.Cleanup(func() { reg.remove("shared-1") })
+
+	register := func(name ServiceName) int {
+		t.Helper()
+		body, _ := json.Marshal(Registration{
+			ServiceName: name, InstanceID: "shared-1", ServiceURL: "http://" + string(name), ServiceUpdateUrl: updates.URL,
+		})
+		req, err := newSignedRequest(http.MethodPost, "http://registry/services", name, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		RegistrationService{}.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := register(LogService); code != http.StatusConflict {
+		t.Fatalf("LogService took GradingService's instance ID: %d, want 409", code)
+	}
+	if instance, _ := reg.instance("shared-1"); instance.ServiceName != GradingService || instance.ServiceURL != "http://grading-1" {
+		t.Fatalf("instance changed after the rejected registration: %+v", instance)
+	}
+	if code := register(GradingService); code != http.StatusOK {
+		t.Fatalf("re-registration by the owner: %d, want 200", code)
+	}
+}
+
+// 用 Registry.key 签名的转发头：leader 用 follower 认证出的调用方，改过的、重放的不相信
+func TestForwardedCaller(t *testing.T) {
+	withKeys(t, map[ServiceName][]byte{RegistryService: []byte("cluster"), GradingService: []byte("grading"), LogService: []byte("log")})
+	body := []byte("http://grading-1")
+
+	// follower 上：先认证服务自己的签名，再转发
+	req, _ := newSignedRequest(http.MethodDelete, "http://follower/services", LogService, body)
+	caller, err := identify(req, body)
+	if err != nil || caller.Service != LogService {
+		t.Fatalf("identify = %+v, %v; want LogService", caller, err)
+	}
+	req.RemoteAddr = "192.168.1.7:5555"
+	signForwarded(req, &caller)
+
+	// leader 上：LogService 不能借 follower 注销 GradingService 的实例
+	if _, err := authenticate(req, body, GradingService); !errors.Is(err, errForbidden) {
+		t.Fatalf("LogService forwarded for GradingService: err = %v, want errForbidden", err)
+	}
+	if _, err := authenticate(req, body, LogService); !errors.Is(err, errUnauthorized) {
+		t.Fatalf("replayed forwarded request: err = %v, want errUnauthorized", err)
+	}
+
+	req, _ = newSignedRequest(http.MethodDelete, "http://follower/services", LogService, body)
+	req.RemoteAddr = "192.168.1.7:5555"
+	signForwarded(req, &callerIdentity{Service: LogService})
+	req.Header.Set(forwardedCallerHeader, "service=GradingService,peer=") // 改了调用方签名就对不上
+	if _, err := authenticate(req, body, GradingService); !errors.Is(err, errForbidden) {
+		t.Fatalf("tampered forwarded caller: err = %v, want errForbidden from the request's own signature", err)
+	}
+
+	req, _ = newSignedRequest(http.MethodDelete, "http://follower/services", GradingService, body)
+	caller, _ = identify(req, body)
+	req.RemoteAddr = "192.168.1.7:5555"
+	signForwarded(req, &caller)
+	if actor, err := authenticate(req, body, GradingService); err != nil || actor != GradingService {
+		t.Fatalf("GradingService forwarded: %v, %v; want GradingService", actor, err)
+	}
+}
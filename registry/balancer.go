@@ -0,0 +1,251 @@
+/*
+	客户端负载均衡
+	- 每个依赖的服务可以用 SetBalancer 单独指定策略，没指定的用轮询
+	- GetProvider(name) 不带 key，GetProviderFor(name, key) 带 key（比如学生 ID），一致性哈希按 key 选实例，不带 key 时轮询
+	- 用完实例后调用 ReleaseProvider(name, url)，least-outstanding 靠它统计正在处理的请求数，其他策略忽略
+*/
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var errNoProviders = errors.New("no providers available")
+
+type Balancer interface {
+	// 从 urls 中选一个实例，urls 不为空；key 可能为空
+	Pick(urls []string, key string) (string, error)
+	// 对 Pick 返回的实例的一次请求结束了
+	Done(url string)
+}
+
+// 轮询
+type RoundRobin struct {
+	next  uint64
+	mutex sync.Mutex
+}
+
+func NewRoundRobin() *RoundRobin {
+	return &RoundRobin{}
+}
+
+func (b *RoundRobin) Pick(urls []string, key string) (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	url := urls[b.next%uint64(len(urls))]
+	b.next++
+	return url, nil
+}
+
+func (b *RoundRobin) Done(url string) {}
+
+// 加权随机，没有配置权重的实例权重为 1，权重为 0 的实例不会被选中
+type WeightedRandom struct {
+	weights map[string]int // ServiceURL -> 权重
+	mutex   sync.RWMutex
+}
+
+func NewWeightedRandom(weights map[string]int) *WeightedRandom {
+	b := &WeightedRandom{weights: make(map[string]int)}
+	for url, weight := range weights {
+		b.weights[url] = weight
+	}
+	return b
+}
+
+// 运行中调整某个实例的权重
+func (b *WeightedRandom) SetWeight(url string, weight int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.weights[url] = weight
+}
+
+func (b *WeightedRandom) Pick(urls []string, key string) (string, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	total := 0
+	for _, url := range urls {
+		total += b.weight(url)
+	}
+	if total <= 0 {
+		return "", errNoProviders
+	}
+	n := rand.Intn(total)
+	for _, url := range urls {
+		n -= b.weight(url)
+		if n < 0 {
+			return url, nil
+		}
+	}
+	return urls[len(urls)-1], nil
+}
+
+func (b *WeightedRandom) weight(url string) int {
+	weight, ok := b.weights[url]
+	if !ok {
+		return 1
+	}
+	if weight < 0 {
+		return 0
+	}
+	return weight
+}
+
+func (b *WeightedRandom) Done(url string) {}
+
+// 选正在处理的请求最少的实例，一样少时随机选，避免都压到第一个上
+type LeastOutstanding struct {
+	outstanding map[string]int // ServiceURL -> 还没 Done 的请求数
+	mutex       sync.Mutex
+}
+
+func NewLeastOutstanding() *LeastOutstanding {
+	return &LeastOutstanding{outstanding: make(map[string]int)}
+}
+
+func (b *LeastOutstanding) Pick(urls []string, key string) (string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	least := make([]string, 0, len(urls))
+	for _, url := range urls {
+		if len(least) == 0 || b.outstanding[url] < b.outstanding[least[0]] {
+			least = append(least[:0], url)
+		} else if b.outstanding[url] == b.outstanding[least[0]] {
+			least = append(least, url)
+		}
+	}
+	url := least[rand.Intn(len(least))]
+	b.outstanding[url]++
+	return url, nil
+}
+
+func (b *LeastOutstanding) Done(url string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.outstanding[url] > 1 {
+		b.outstanding[url]--
+	} else {
+		delete(b.outstanding, url)
+	}
+}
+
+/*
+	一致性哈希：同一个 key 总是落到同一个实例上，实例增减时只有一小部分 key 会换实例
+	每个实例在环上放 replicas 个虚拟节点，让 key 分布得更均匀
+	key 为空（GetProvider）时没有亲和性可言，退回轮询，不然所有不带 key 的请求都会落到同一个实例上
+*/
+type ConsistentHash struct {
+	fallback RoundRobin
+	replicas int
+	members  string   // 当前环对应的实例列表，实例变化时重建
+	ring     []uint32 // 排好序的虚拟节点哈希
+	nodes    map[uint32]string
+	mutex    sync.Mutex
+}
+
+const defaultReplicas = 100
+
+func NewConsistentHash(replicas int) *ConsistentHash {
+	if replicas <= 0 {
+		replicas = defaultReplicas
+	}
+	return &ConsistentHash{replicas: replicas}
+}
+
+func (b *ConsistentHash) Pick(urls []string, key string) (string, error) {
+	if key == "" {
+		return b.fallback.Pick(urls, key)
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.build(urls)
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(b.ring), func(i int) bool { return b.ring[i] >= h })
+	if i == len(b.ring) {
+		i = 0
+	}
+	return b.nodes[b.ring[i]], nil
+}
+
+// 实例列表变了才重建环，调用方需持有 b.mutex
+func (b *ConsistentHash) build(urls []string) {
+	sorted := append([]string(nil), urls...)
+	sort.Strings(sorted)
+	members := strings.Join(sorted, "\n")
+	if members == b.members && b.ring != nil {
+		return
+	}
+	b.members = members
+	b.ring = make([]uint32, 0, len(sorted)*b.replicas)
+	b.nodes = make(map[uint32]string)
+	for _, url := range sorted {
+		for i := 0; i < b.replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + "#" + url))
+			if _, ok := b.nodes[h]; ok { // 哈希冲突，保留先放上去的
+				continue
+			}
+			b.nodes[h] = url
+			b.ring = append(b.ring, h)
+		}
+	}
+	sort.Slice(b.ring, func(i, j int) bool { return b.ring[i] < b.ring[j] })
+}
+
+func (b *ConsistentHash) Done(url string) {}
+
+// 每个服务用的负载均衡策略
+var balancers = struct {
+	byName map[ServiceName]Balancer
+	mutex  *sync.RWMutex
+}{
+	byName: make(map[ServiceName]Balancer),
+	mutex:  new(sync.RWMutex),
+}
+
+// 给某个依赖的服务指定负载均衡策略，一般在 service.Start 之前调用
+func SetBalancer(name ServiceName, b Balancer) {
+	balancers.mutex.Lock()
+	defer balancers.mutex.Unlock()
+	balancers.byName[name] = b
+}
+
+func balancerFor(name ServiceName) Balancer {
+	balancers.mutex.Lock()
+	defer balancers.mutex.Unlock()
+	b, ok := balancers.byName[name]
+	if !ok {
+		b = NewRoundRobin()
+		balancers.byName[name] = b
+	}
+	return b
+}
+
+func (prv *providers) pick(name ServiceName, key string) (string, error) {
+	urls := prv.get(name)
+	if len(urls) == 0 {
+		return "", fmt.Errorf("%w for service %v", errNoProviders, name)
+	}
+	warnIfStale(name)
+	return balancerFor(name).Pick(urls, key)
+}
+
+func GetProvider(name ServiceName) (string, error) {
+	return prov.pick(name, "")
+}
+
+// 带亲和性的选择，同一个 key 用一致性哈希时总是落到同一个实例
+func GetProviderFor(name ServiceName, key string) (string, error) {
+	return prov.pick(name, key)
+}
+
+// 对 GetProvider/GetProviderFor 拿到的实例的请求结束了
+func ReleaseProvider(name ServiceName, url string) {
+	balancerFor(name).Done(url)
+}
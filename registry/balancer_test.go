@@ -0,0 +1,143 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// 不带 key 的请求不能都压到同一个实例上
+func TestConsistentHashEmptyKey(t *testing.T) {
+	urls := []string{"http://a", "http://b", "http://c"}
+	b := NewConsistentHash(0)
+	counts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		url, err := b.Pick(urls, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[url]++
+	}
+	for _, url := range urls {
+		if counts[url] != 100 {
+			t.Fatalf("empty key picks = %v, want 100 each", counts)
+		}
+	}
+}
+
+func TestRoundRobinDistribution(t *testing.T) {
+	urls := []string{"http://a", "http://b", "http://c"}
+	b := NewRoundRobin()
+	for i := 0; i < 9; i++ {
+		url, _ := b.Pick(urls, "student-1")
+		if url != urls[i%3] {
+			t.Fatalf("pick %d = %s, want %s", i, url, urls[i%3])
+		}
+	}
+}
+
+// 按权重分配，权重为 0 的不选，全是 0 时没有可用的实例
+func TestWeightedRandomDistribution(t *testing.T) {
+	urls := []string{"http://a", "http://b", "http://c"}
+	b := NewWeightedRandom(map[string]int{"http://a": 3, "http://c": 0})
+	counts := make(map[string]int)
+	for i := 0; i < 40000; i++ {
+		url, err := b.Pick(urls, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[url]++
+	}
+	if counts["http://c"] != 0 {
+		t.Fatalf("weight 0 picked %d times", counts["http://c"])
+	}
+	if ratio := float64(counts["http://a"]) / float64(counts["http://b"]); ratio < 2.7 || ratio > 3.3 {
+		t.Fatalf("picks = %v, want about 3:1", counts)
+	}
+
+	b.SetWeight("http://a", 0)
+	b.SetWeight("http://b", -1)
+	if _, err := b.Pick(urls, ""); !errors.Is(err, errNoProviders) {
+		t.Fatalf("all weights 0: err = %v, want errNoProviders", err)
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	urls := []string{"http://a", "http://b", "http://c"}
+	b := NewLeastOutstanding()
+	picked := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		url, _ := b.Pick(urls, "")
+		picked[url] = true
+	}
+	if len(picked) != 3 {
+		t.Fatalf("3 picks with nothing outstanding went to %v, want every instance once", picked)
+	}
+	b.Done("http://b")
+	b.Done("http://b") // 多余的 Done 不能让计数变成负数
+	if url, _ := b.Pick(urls, ""); url != "http://b" {
+		t.Fatalf("pick = %s, want the instance with no outstanding requests", url)
+	}
+	if b.outstanding["http://a"] != 1 || b.outstanding["http://b"] != 1 || b.outstanding["http://c"] != 1 {
+		t.Fatalf("outstanding = %v, want 1 each", b.outstanding)
+	}
+}
+
+// 同一个 key 总是同一个实例，和实例列表的顺序无关；加一个实例只有一小部分 key 换实例，而且只换到新实例上
+func TestConsistentHashStability(t *testing.T) {
+	urls := []string{"http://a", "http://b", "http://c"}
+	b := NewConsistentHash(0)
+	before := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprint("student-", i)
+		url, err := b.Pick(urls, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before[key] = url
+		counts[url]++
+	}
+	for _, url := range urls {
+		if counts[url] < 600 {
+			t.Fatalf("keys per instance = %v, want roughly even", counts)
+		}
+	}
+
+	reversed := []string{"http://c", "http://b", "http://a"}
+	for key, url := range before {
+		if got, _ := b.Pick(reversed, key); got != url {
+			t.Fatalf("%s moved from %s to %s when only the order changed", key, url, got)
+		}
+	}
+
+	grown := append(urls, "http://d")
+	moved := 0
+	for key, url := range before {
+		got, _ := b.Pick(grown, key)
+		if got != url {
+			if got != "http://d" {
+				t.Fatalf("%s moved from %s to %s, not to the new instance", key, url, got)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > len(before)*2/5 {
+		t.Fatalf("%d of %d keys moved after adding one instance, want about a quarter", moved, len(before))
+	}
+
+	shrunk := []string{"http://a", "http://c"}
+	for key, url := range before {
+		if got, _ := b.Pick(shrunk, key); url != "http://b" && got != url {
+			t.Fatalf("%s moved from %s to %s after removing http://b", key, url, got)
+		}
+	}
+}
+
+// 没有可用的实例时，调用方能用 errors.Is 认出 errNoProviders
+func TestGetProviderNoProviders(t *testing.T) {
+	withProviders(t, GradingService)
+	if _, err := GetProvider(GradingService); !errors.Is(err, errNoProviders) {
+		t.Fatalf("no instances: err = %v, want errNoProviders", err)
+	}
+}
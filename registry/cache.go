@@ -0,0 +1,294 @@
+/*
+	依赖服务实例的本地缓存文件，注册中心连不上或者重启时还能找到依赖的服务
+	- SetProviderCache(path, ttl) 之后，prov 变化后写到 path（cacheSaveDelay 内的多次变化合并成一次写）；
+	  启动时先读出上次的实例，GetProvider 马上就能用
+	- 从缓存读出来的实例可能已经过时，注册中心第一次推送 patch（或者 watch 返回）时拉一次全量整体替换
+	- 每个实例单独判断 stale：从缓存读出来、注册中心还没确认过，并且缓存已经保存了超过 ttl；
+	  或者超过 ttl 没有收到注册中心的任何消息（patch、心跳检查、续约）。
+	  stale 的实例仍然会被选中，总比没有好；StaleProviders(name) 返回某个服务里 stale 的实例，
+	  ProvidersStale 表示有没有 stale 的实例，每个服务在日志里提示一次
+	- 启用了缓存时，注册中心连不上不会让 RegisterService 失败，在后台继续重试注册
+	文件格式
+		{"Saved": "2024-01-01T00:00:00Z", "Revision": 12, "Services": {"GradingService": [{"Name": ..., "ID": ..., "URL": ...}]}}
+	一般不用直接调用，见 config.go 的 -provider-cache
+*/
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheTTL         = 5 * time.Minute
+	cacheSaveDelay          = time.Second // 连着来的 patch 合并成一次写
+	registerRetryMaxBackoff = 30 * time.Second
+)
+
+var errRegistryUnreachable = errors.New("registry unreachable")
+
+type providerCacheFile struct {
+	Saved    time.Time
+	Revision uint64
+	Services map[ServiceName][]patchEntry
+}
+
+var providerCache = struct {
+	path    string // 为空表示没有启用
+	ttl     time.Duration
+	pending *time.Timer // 等着写文件的定时器，为 nil 表示没有要写的
+	mutex   *sync.Mutex
+}{
+	mutex: new(sync.Mutex),
+}
+
+// 启用缓存文件并读出上次保存的实例，文件不存在不算错误；ttl 小于等于 0 时用默认的 5 分钟
+func SetProviderCache(path string, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = defaultCacheTTL
+	}
+	providerCache.mutex.Lock()
+	providerCache.path, providerCache.ttl = path, ttl
+	providerCache.mutex.Unlock()
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var file providerCacheFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		log.Printf("ignoring invalid provider cache %s: %v", path, err)
+		return nil
+	}
+	added := make([]patchEntry, 0)
+	for _, entries := range file.Services {
+		added = append(added, entries...)
+	}
+	prov.mutex.Lock()
+	prov.update(patch{Added: added})
+	for _, e := range added { // update 会把它们当作注册中心确认过的，这里再标记回来
+		prov.cachedAt[entryKey(e)] = file.Saved
+	}
+	prov.cached = true
+	prov.synced = file.Saved
+	prov.mutex.Unlock()
+	notifyAvailable()
+	log.Printf("loaded %d providers from cache %s saved at %v", len(added), path, file.Saved.Format(time.RFC3339))
+	return nil
+}
+
+func providerCacheEnabled() bool {
+	providerCache.mutex.Lock()
+	defer providerCache.mutex.Unlock()
+	return providerCache.path != ""
+}
+
+// prov 变了，cacheSaveDelay 之后写文件，这期间再变也只写一次
+func scheduleProviderCacheSave() {
+	providerCache.mutex.Lock()
+	defer providerCache.mutex.Unlock()
+	if providerCache.path == "" || providerCache.pending != nil {
+		return
+	}
+	providerCache.pending = time.AfterFunc(cacheSaveDelay, saveProviderCache)
+}
+
+// 还有没写的变化就马上写，退出前调用
+func flushProviderCache() {
+	providerCache.mutex.Lock()
+	pending := providerCache.pending != nil && providerCache.pending.Stop()
+	providerCache.mutex.Unlock()
+	if pending {
+		saveProviderCache()
+	}
+}
+
+// 把 prov 现在的实例写到缓存文件，先写临时文件再改名，写到一半退出也不会留下坏文件
+func saveProviderCache() {
+	providerCache.mutex.Lock()
+	defer providerCache.mutex.Unlock()
+	providerCache.pending = nil
+	if providerCache.path == "" {
+		return
+	}
+	file := providerCacheFile{Saved: time.Now(), Services: make(map[ServiceName][]patchEntry)}
+	prov.mutex.RLock()
+	if !prov.synced.IsZero() { // 读出来的时候按最后一次收到注册中心消息的时间判断 stale
+		file.Saved = prov.synced
+	}
+	file.Revision = prov.revision
+	for name, entries := range prov.services {
+		file.Services[name] = append([]patchEntry(nil), entries...)
+	}
+	prov.mutex.RUnlock()
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(providerCache.path), filepath.Base(providerCache.path)+".*")
+	if err != nil {
+		log.Println("failed to save provider cache:", err)
+		return
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), providerCache.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Println("failed to save provider cache:", err)
+	}
+}
+
+// 收到了注册中心的消息，调用方需持有 prv.mutex
+func (prv *providers) touch() {
+	prv.synced = time.Now()
+	prv.staleLogged = nil
+}
+
+func (prv *providers) heard() {
+	prv.mutex.Lock()
+	prv.touch()
+	prv.mutex.Unlock()
+}
+
+// 缓存里认同一个实例用的 key
+func entryKey(e patchEntry) string {
+	return string(e.Name) + "/" + e.ID
+}
+
+// 没有启用缓存时 ok 为 false
+func cacheTTL() (time.Duration, bool) {
+	providerCache.mutex.Lock()
+	defer providerCache.mutex.Unlock()
+	return providerCache.ttl, providerCache.path != ""
+}
+
+// 调用方需持有 prv.mutex
+func (prv *providers) stale(e patchEntry, ttl time.Duration) bool {
+	if saved, ok := prv.cachedAt[entryKey(e)]; ok && time.Since(saved) > ttl {
+		return true
+	}
+	return !prv.synced.IsZero() && time.Since(prv.synced) > ttl
+}
+
+// name 这个服务里 stale 的实例的 URL：可能已经过时，但仍然会被选中；没有启用缓存时总是空的
+func StaleProviders(name ServiceName) []string {
+	ttl, enabled := cacheTTL()
+	urls := make([]string, 0)
+	if !enabled {
+		return urls
+	}
+	prov.mutex.RLock()
+	defer prov.mutex.RUnlock()
+	for _, e := range prov.services[name] {
+		if prov.stale(e, ttl) {
+			urls = append(urls, e.URL)
+		}
+	}
+	return urls
+}
+
+// 有没有 stale 的实例；没有启用缓存时总是 false
+func ProvidersStale() bool {
+	prov.mutex.RLock()
+	names := make([]ServiceName, 0, len(prov.services))
+	for name := range prov.services {
+		names = append(names, name)
+	}
+	prov.mutex.RUnlock()
+	for _, name := range names {
+		if len(StaleProviders(name)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// pick 时调用，每个服务 stale 之后只提示一次
+func warnIfStale(name ServiceName) {
+	stale := StaleProviders(name)
+	if len(stale) == 0 {
+		return
+	}
+	prov.mutex.Lock()
+	logged := prov.staleLogged[name]
+	if prov.staleLogged == nil {
+		prov.staleLogged = make(map[ServiceName]bool)
+	}
+	prov.staleLogged[name] = true
+	synced := prov.synced
+	prov.mutex.Unlock()
+	if !logged {
+		log.Printf("%d providers of %v may be stale, registry not heard from since %v", len(stale), name, synced.Format(time.RFC3339))
+	}
+}
+
+/*
+	注册中心连不上时按退避间隔一直重试，直到注册成功、被拒绝或者 stop 被关闭（ShutdownService）
+	注册请求发出去之后才关闭的，注册成功后马上注销，不留下已经下线的实例
+*/
+func registerInBackground(r Registration, stop chan struct{}) {
+	defer func() {
+		instances.mutex.Lock()
+		if instances.pending[r.ServiceURL] == stop {
+			delete(instances.pending, r.ServiceURL)
+		}
+		instances.mutex.Unlock()
+	}()
+	backoff := defaultRetryBackoff
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		err := register(r)
+		if err == nil {
+			select {
+			case <-stop:
+				log.Printf("%v shut down while registering, deregistering it", r.ServiceName)
+				stopKeepAlive(r.ServiceURL)
+				instances.mutex.Lock()
+				delete(instances.regs, r.ServiceURL)
+				instances.mutex.Unlock()
+				err = DeregisterInstance(r.ServiceName, r.InstanceID)
+				if err != nil {
+					log.Println(err)
+				}
+				return
+			default:
+			}
+			log.Printf("registered %v after registry came back", r.ServiceName)
+			return
+		}
+		if !errors.Is(err, errRegistryUnreachable) {
+			log.Printf("giving up registering %v: %v", r.ServiceName, err)
+			return
+		}
+		backoff *= 2
+		if backoff > registerRetryMaxBackoff {
+			backoff = registerRetryMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 测试用的 prov 和缓存设置，结束后恢复
+func withProviderCache(t *testing.T, path string, ttl time.Duration) {
+	t.Helper()
+	withProviders(t)
+	providerCache.mutex.Lock()
+	oldPath, oldTTL := providerCache.path, providerCache.ttl
+	providerCache.path, providerCache.ttl = path, ttl
+	providerCache.mutex.Unlock()
+	t.Cleanup(func() {
+		providerCache.mutex.Lock()
+		if providerCache.pending != nil {
+			providerCache.pending.Stop()
+			providerCache.pending = nil
+		}
+		providerCache.path, providerCache.ttl = oldPath, oldTTL
+		providerCache.mutex.Unlock()
+	})
+}
+
+func writeCacheFile(t *testing.T, path string, file providerCacheFile) {
+	t.Helper()
+	data, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 只有注册中心还没确认过的旧实例是 stale 的，确认过的和新来的不是
+func TestStaleProvidersPerEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "providers.json")
+	withProviderCache(t, "", time.Minute)
+	writeCacheFile(t, path, providerCacheFile{
+		Saved: time.Now().Add(-time.Hour),
+		Services: map[ServiceName][]patchEntry{
+			GradingService: {
+				{Name: GradingService, ID: "a", URL: "http://a"},
+				{Name: GradingService, ID: "b", URL: "http://b"},
+			},
+			LogService: {{Name: LogService, ID: "l", URL: "http://l"}},
+		},
+	})
+	if err := SetProviderCache(path, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got := StaleProviders(GradingService); !reflect.DeepEqual(got, []string{"http://a", "http://b"}) {
+		t.Fatalf("StaleProviders before sync = %v", got)
+	}
+
+	prov.mutex.Lock()
+	prov.update(patch{Changed: []patchEntry{{Name: GradingService, ID: "a", URL: "http://a"}}})
+	prov.update(patch{Added: []patchEntry{{Name: GradingService, ID: "c", URL: "http://c"}}})
+	prov.touch()
+	prov.mutex.Unlock()
+	if got := StaleProviders(GradingService); !reflect.DeepEqual(got, []string{"http://b"}) {
+		t.Fatalf("StaleProviders after partial sync = %v, want [http://b]", got)
+	}
+	if got := StaleProviders(LogService); !reflect.DeepEqual(got, []string{"http://l"}) {
+		t.Fatalf("StaleProviders(LogService) = %v, want [http://l]", got)
+	}
+	if !ProvidersStale() {
+		t.Fatal("ProvidersStale = false with stale entries left")
+	}
+
+	prov.reset([]ServiceName{GradingService, LogService}, []patchEntry{{Name: LogService, ID: "l", URL: "http://l"}}, 1)
+	if ProvidersStale() {
+		t.Fatalf("ProvidersStale = true after full sync: %v", StaleProviders(LogService))
+	}
+
+	prov.mutex.Lock()
+	prov.synced = time.Now().Add(-time.Hour) // 很久没有收到注册中心的消息，全部都算 stale
+	prov.mutex.Unlock()
+	if got := StaleProviders(LogService); len(got) != 1 {
+		t.Fatalf("StaleProviders with registry silent = %v", got)
+	}
+}
+
+// 没有启用缓存时不判断 stale
+func TestStaleProvidersDisabled(t *testing.T) {
+	withProviderCache(t, "", time.Minute)
+	prov.mutex.Lock()
+	prov.update(patch{Added: []patchEntry{{Name: GradingService, ID: "a", URL: "http://a"}}})
+	prov.synced = time.Now().Add(-time.Hour)
+	prov.mutex.Unlock()
+	if got := StaleProviders(GradingService); len(got) != 0 || ProvidersStale() {
+		t.Fatalf("StaleProviders without cache = %v", got)
+	}
+}
+
+// 连着来的变化只写一次文件，flush 马上写
+func TestProviderCacheDebounce(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "providers.json")
+	withProviderCache(t, path, time.Minute)
+	for i := 0; i < 100; i++ {
+		prov.mutex.Lock()
+		prov.update(patch{Added: []patchEntry{{Name: GradingService, ID: string(rune('a' + i%26)), URL: "http://a"}}})
+		prov.mutex.Unlock()
+		scheduleProviderCacheSave()
+	}
+	providerCache.mutex.Lock()
+	pending := providerCache.pending != nil
+	providerCache.mutex.Unlock()
+	if !pending {
+		t.Fatal("no save scheduled")
+	}
+	if _, err := ioutil.ReadFile(path); err == nil {
+		t.Fatal("cache written before the debounce delay")
+	}
+
+	flushProviderCache()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file providerCacheFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+	if len(file.Services[GradingService]) != 26 {
+		t.Fatalf("cached %d instances, want 26", len(file.Services[GradingService]))
+	}
+	providerCache.mutex.Lock()
+	pending = providerCache.pending != nil
+	providerCache.mutex.Unlock()
+	if pending {
+		t.Fatal("save still pending after flush")
+	}
+}
+
+// 后台重试注册的时候下线：还没发出去的不再注册，已经发出去的注册成功后马上注销
+func TestShutdownCancelsBackgroundRegistration(t *testing.T) {
+	withRegistryURLs(t)
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	var up int32
+	hold := make(chan struct{}) // 注册请求收到之后等它关闭才返回
+	requests := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		requests <- r.Method
+		if r.Method == http.MethodPost {
+			var reg Registration
+			json.NewDecoder(r.Body).Decode(&reg)
+			<-hold
+			json.NewEncoder(w).Encode(registrationResult{InstanceID: reg.InstanceID})
+		}
+	}))
+	defer srv.Close()
+	SetRegistryURLs(srv.URL + "/services")
+	SetRegistryRetry(0, 0)
+
+	background := func(r Registration) chan struct{} {
+		done := make(chan struct{})
+		stop := pendingRegistration(r.ServiceURL)
+		go func() {
+			registerInBackground(r, stop)
+			close(done)
+		}()
+		return done
+	}
+	finished := func(done chan struct{}) {
+		t.Helper()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("background registration still running after shutdown")
+		}
+		instances.mutex.Lock()
+		defer instances.mutex.Unlock()
+		if len(instances.regs) != 0 || len(instances.pending) != 0 {
+			t.Fatalf("left behind: regs %v, pending %v", instances.regs, instances.pending)
+		}
+	}
+
+	r := Registration{ServiceName: GradingService, ServiceURL: "http://background-1", InstanceID: "grading-1"}
+	done := background(r)
+	if err := ShutdownService(r.ServiceURL); err != nil {
+		t.Fatalf("shutdown while the registry is unreachable: %v", err)
+	}
+	atomic.StoreInt32(&up, 1)
+	close(hold)
+	finished(done)
+	if len(requests) != 0 {
+		t.Fatalf("%d requests after shutdown, want none", len(requests))
+	}
+
+	hold = make(chan struct{})
+	r = Registration{ServiceName: GradingService, ServiceURL: "http://background-2", InstanceID: "grading-2"}
+	done = background(r)
+	if method := <-requests; method != http.MethodPost { // 注册请求已经到了注册中心
+		t.Fatalf("first request %s, want POST", method)
+	}
+	ShutdownService(r.ServiceURL)
+	close(hold)
+	finished(done)
+	if method := <-requests; method != http.MethodDelete {
+		t.Fatalf("after a registration that finished during shutdown: %s, want DELETE", method)
+	}
+}
@@ -0,0 +1,190 @@
+/*
+	注册表的只读查询接口，方便运维排查“portal 为什么找不到 grading”这类问题
+		GET /services                               所有服务
+		GET /services/{name}                        某个服务的所有实例
+		GET /services/{name}/instances/{id}         某个实例
+	前两个可以带 ?filter=tag=primary,version>=1.2 只看满足条件的实例（语法见 filter.go）
+	集群模式下转发给 leader，因为只有 leader 在做心跳检查，健康状态和最近心跳时间才准
+*/
+package registry
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	statusPassing     = "passing"     // 心跳检查通过
+	statusWarning     = "warning"     // 最近的检查失败了，但还没到 FailureThreshold，仍然可以用
+	statusCritical    = "critical"    // 连续失败 FailureThreshold 次，客户端不会用它
+	statusQuarantined = "quarantined" // 状态来回抖动，隔离一段时间，客户端不会用它
+	statusRecovering  = "recovering"  // 从磁盘恢复，等待心跳检查确认
+	statusMaintenance = "maintenance" // 手动摘掉，仍然注册着、照常检查，但客户端不会用它
+)
+
+// 每个实例的状态，集群模式下随 opStatus、opMaintenance 和 Raft 快照复制；单机模式重启后不恢复，实例要重新检查
+type instanceHealth struct {
+	Status            string // 健康检查的结果，维护状态单独记，检查照常进行
+	Maintenance       bool
+	MaintenanceReason string
+	RegisteredAt      time.Time
+	LastHeartbeat     time.Time
+}
+
+type instanceInfo struct {
+	ID                string
+	Registration      Registration
+	Status            string // 在维护中的是 maintenance，CheckStatus 里是检查的结果
+	CheckStatus       string `json:",omitempty"`
+	MaintenanceReason string `json:",omitempty"`
+	RegisteredAt      time.Time
+	LastHeartbeat     time.Time
+	Checks            []checkRecord `json:",omitempty"` // 最近几次健康检查，最新的在最后
+}
+
+type serviceInfo struct {
+	Name      ServiceName
+	Instances []instanceInfo
+}
+
+// 记录一次通过的心跳，状态由 health.go 通过 opStatus 修改
+func (r *registry) touchHeartbeat(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if h, ok := r.health[id]; ok {
+		h.LastHeartbeat = time.Now()
+	}
+}
+
+// 带上当前健康状态的 patchEntry，调用方需持有 r.mutex
+func (r *registry) entry(reg Registration) patchEntry {
+	e := reg.entry()
+	if h, ok := r.health[reg.InstanceID]; ok {
+		e.Status = h.Status
+		if h.Maintenance {
+			e.Status = statusMaintenance
+		}
+	}
+	return e
+}
+
+func (r *registry) catalog(filter Filter) []serviceInfo {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	services := make(map[ServiceName]*serviceInfo)
+	addInstance := func(reg Registration, info instanceInfo) {
+		s, ok := services[reg.ServiceName]
+		if !ok {
+			s = &serviceInfo{Name: reg.ServiceName, Instances: make([]instanceInfo, 0)}
+			services[reg.ServiceName] = s
+		}
+		s.Instances = append(s.Instances, info)
+	}
+	for _, reg := range r.registrations {
+		if !filter.Match(reg.entry()) {
+			continue
+		}
+		info := instanceInfo{ID: reg.InstanceID, Registration: reg, Status: r.entry(reg).Status}
+		if h, ok := r.health[reg.InstanceID]; ok {
+			info.CheckStatus = h.Status
+			info.MaintenanceReason = h.MaintenanceReason
+			info.RegisteredAt = h.RegisteredAt
+			info.LastHeartbeat = h.LastHeartbeat
+		}
+		if state, ok := r.checks[reg.InstanceID]; ok {
+			info.Checks = append([]checkRecord(nil), state.history...)
+		}
+		addInstance(reg, info)
+	}
+	for _, reg := range r.recovered {
+		if !filter.Match(reg.entry()) {
+			continue
+		}
+		info := instanceInfo{ID: reg.InstanceID, Registration: reg, Status: statusRecovering}
+		if state, ok := r.checks[reg.InstanceID]; ok {
+			info.Checks = append([]checkRecord(nil), state.history...)
+		}
+		addInstance(reg, info)
+	}
+
+	result := make([]serviceInfo, 0, len(services))
+	for _, s := range services {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func (r *registry) service(name ServiceName, filter Filter) (serviceInfo, bool) {
+	for _, s := range r.catalog(filter) {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return serviceInfo{}, false
+}
+
+/*
+	pathSegments:
+	/services                        => ["", "services"]
+	/services/{name}                 => ["", "services", name]
+	/services/{name}/instances/{id}  => ["", "services", name, "instances", id]
+*/
+func (s RegistrationService) serveCatalog(w http.ResponseWriter, r *http.Request, pathSegments []string) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if reg.forwardToLeader(w, r) {
+		return
+	}
+	filter, err := ParseFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var result interface{}
+	switch len(pathSegments) {
+	case 2:
+		result = reg.catalog(filter)
+	case 3:
+		service, ok := reg.service(ServiceName(pathSegments[2]), filter)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		result = service
+	case 5:
+		if pathSegments[3] != "instances" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		service, _ := reg.service(ServiceName(pathSegments[2]), nil)
+		for _, instance := range service.Instances {
+			if instance.ID == pathSegments[4] {
+				result = instance
+			}
+		}
+		if result == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,81 @@
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// 在注册中心上 GET path，返回状态码，200 时把结果解到 v 里
+func getCatalog(t *testing.T, path string, v interface{}) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	RegistrationService{}.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if w.Code == http.StatusOK && v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+	}
+	return w.Code
+}
+
+func TestCatalog(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, r := range []Registration{
+		{ServiceName: GradingService, ServiceURL: "http://grading-1", InstanceID: "catalog-1", Version: "1.2.0", Tags: []string{"primary"}},
+		{ServiceName: GradingService, ServiceURL: "http://grading-2", InstanceID: "catalog-2", Version: "1.3.0", Tags: []string{"canary"}},
+		{ServiceName: LogService, ServiceURL: "http://log-1", InstanceID: "catalog-3"},
+	} {
+		r := r
+		reg.apply(walEntry{Op: opAdd, Registration: &r})
+		t.Cleanup(func() { reg.remove(r.InstanceID) })
+	}
+
+	var services []serviceInfo
+	if code := getCatalog(t, "/services", &services); code != http.StatusOK {
+		t.Fatalf("GET /services: %d", code)
+	}
+	counts := make(map[ServiceName]int)
+	for _, s := range services {
+		counts[s.Name] = len(s.Instances)
+	}
+	if counts[GradingService] != 2 || counts[LogService] != 1 {
+		t.Fatalf("GET /services: instances per service = %v", counts)
+	}
+
+	var grading serviceInfo
+	if code := getCatalog(t, "/services/GradingService?filter=tag=primary", &grading); code != http.StatusOK {
+		t.Fatalf("GET filtered service: %d", code)
+	}
+	if len(grading.Instances) != 1 || grading.Instances[0].ID != "catalog-1" || grading.Instances[0].Status != statusPassing {
+		t.Fatalf("tag=primary: %+v, want only catalog-1, passing", grading.Instances)
+	}
+	services = nil
+	getCatalog(t, "/services?filter=version>=1.3", &services)
+	if len(services) != 1 || services[0].Name != GradingService || services[0].Instances[0].ID != "catalog-2" {
+		t.Fatalf("version>=1.3: %+v, want only catalog-2", services)
+	}
+
+	var instance instanceInfo
+	if code := getCatalog(t, "/services/LogService/instances/catalog-3", &instance); code != http.StatusOK || instance.Registration.ServiceURL != "http://log-1" {
+		t.Fatalf("GET instance: %d %+v", code, instance)
+	}
+
+	for path, want := range map[string]int{
+		"/services/NoSuchService":                      http.StatusNotFound,
+		"/services/GradingService?filter=tag=missing":  http.StatusNotFound, // 没有满足条件的实例就是没有这个服务
+		"/services/GradingService/instances/catalog-3": http.StatusNotFound, // 实例属于别的服务
+		"/services/GradingService/instances/nope":      http.StatusNotFound,
+		"/services/GradingService/replicas/catalog-1":  http.StatusNotFound,
+		"/services?filter=version>>1":                  http.StatusBadRequest,
+	} {
+		if code := getCatalog(t, path, nil); code != want {
+			t.Errorf("GET %s: %d, want %d", path, code, want)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+/*
+	健康检查的调度
+	- 每个实例一个定时器，到点把实例 ID 放进任务队列；检查完才按它自己的 Interval 重新计时，同一个实例不会同时检查两次
+	- 固定数量的 worker 从队列里取任务，一个很慢的服务只占一个 worker，不会拖慢其他服务的检查
+	- 间隔加上随机抖动，新实例第一次检查的时间也随机打散，几千个实例不会挤在同一时刻
+	- 定时器只在 leader 上运行；reconcile 定期在锁里拷贝一份注册表，给新实例建定时器、停掉已经注销的
+*/
+package registry
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	checkWorkers   = 64              // 最多同时进行多少个检查
+	checkJitter    = 0.1             // 每次检查间隔随机加减 10%
+	reconcileEvery = 1 * time.Second // 多久对一次注册表
+)
+
+type checkScheduler struct {
+	r      *registry
+	jobs   chan string            // 到了检查时间的 InstanceID
+	timers map[string]*time.Timer // InstanceID -> 下次检查的定时器
+	stop   <-chan struct{}
+	mutex  *sync.Mutex
+}
+
+// 需要检查的实例：注册表里的和从磁盘恢复、正在观察的，租约模式的服务由它自己续约，不检查
+type checkTarget struct {
+	reg       Registration
+	observing bool
+}
+
+func (r *registry) checkTargets() map[string]checkTarget {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	targets := make(map[string]checkTarget, len(r.registrations)+len(r.recovered))
+	for _, reg := range r.registrations {
+		if reg.TTL <= 0 {
+			targets[reg.InstanceID] = checkTarget{reg: reg}
+		}
+	}
+	for _, reg := range r.recovered {
+		if reg.TTL <= 0 {
+			targets[reg.InstanceID] = checkTarget{reg: reg, observing: true}
+		}
+	}
+	return targets
+}
+
+// 检查时取最新的注册信息，重新注册后检查配置可能变了
+func (r *registry) checkTarget(id string) (checkTarget, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, reg := range r.registrations {
+		if reg.InstanceID == id && reg.TTL <= 0 {
+			return checkTarget{reg: reg}, true
+		}
+	}
+	for _, reg := range r.recovered {
+		if reg.InstanceID == id && reg.TTL <= 0 {
+			return checkTarget{reg: reg, observing: true}, true
+		}
+	}
+	return checkTarget{}, false
+}
+
+func newCheckScheduler(r *registry, workers int, stop <-chan struct{}) *checkScheduler {
+	return &checkScheduler{
+		r:      r,
+		jobs:   make(chan string, workers),
+		timers: make(map[string]*time.Timer),
+		stop:   stop,
+		mutex:  new(sync.Mutex),
+	}
+}
+
+// 启动 workers 个 worker，然后每 every 对一次注册表，直到 stop 被关闭；stop 为 nil 时一直运行
+func (r *registry) heartbeat(workers int, every time.Duration, stop <-chan struct{}) {
+	s := newCheckScheduler(r, workers, stop)
+	for i := 0; i < workers; i++ {
+		go s.worker()
+	}
+	for {
+		s.reconcile()
+		select {
+		case <-stop:
+			s.mutex.Lock()
+			for id, timer := range s.timers {
+				timer.Stop()
+				delete(s.timers, id)
+			}
+			s.mutex.Unlock()
+			return
+		case <-time.After(every):
+		}
+	}
+}
+
+func (s *checkScheduler) reconcile() {
+	leader := s.r.isLeader()
+	if leader {
+		s.r.verifyRecovered()
+	}
+	targets := s.r.checkTargets()
+
+	s.mutex.Lock()
+	for id, timer := range s.timers {
+		if _, ok := targets[id]; !ok || !leader { // 已经注销，或者不是 leader 了
+			timer.Stop()
+			delete(s.timers, id)
+		}
+	}
+	if leader {
+		for id, target := range targets {
+			if _, ok := s.timers[id]; !ok {
+				s.timers[id] = s.schedule(id, firstCheckDelay(target.reg.healthCheck().Interval))
+			}
+		}
+	}
+	s.mutex.Unlock()
+
+	// 已经不需要检查的实例，它的连续成功/失败次数也不用留着了
+	s.r.mutex.Lock()
+	for id := range s.r.checks {
+		if _, ok := targets[id]; !ok {
+			delete(s.r.checks, id)
+		}
+	}
+	s.r.mutex.Unlock()
+}
+
+// 定时器到点只是把任务放进队列，worker 都在忙的时候在这里等着
+func (s *checkScheduler) schedule(id string, delay time.Duration) *time.Timer {
+	return time.AfterFunc(delay, func() {
+		select {
+		case s.jobs <- id:
+		case <-s.stop:
+		}
+	})
+}
+
+func (s *checkScheduler) worker() {
+	for {
+		var id string
+		select {
+		case id = <-s.jobs:
+		case <-s.stop:
+			return
+		}
+		target, ok := s.r.checkTarget(id)
+		if ok && s.r.isLeader() {
+			s.r.check(target.reg, target.observing)
+			target, ok = s.r.checkTarget(id) // 检查的结果可能是 add 回注册表或者丢掉
+		}
+
+		s.mutex.Lock()
+		if timer, exists := s.timers[id]; exists {
+			if ok {
+				timer.Reset(jitter(target.reg.healthCheck().Interval))
+			} else {
+				delete(s.timers, id)
+			}
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// 第一次检查在一个间隔内随机打散
+func firstCheckDelay(interval time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(interval)))
+}
+
+func jitter(d time.Duration) time.Duration {
+	delta := time.Duration((rand.Float64()*2 - 1) * checkJitter * float64(d))
+	return d + delta
+}
+
+// 租约模式的服务没有心跳地址，从磁盘恢复后直接放回去，TTL 内没续约会照常过期
+func (r *registry) verifyRecovered() {
+	r.mutex.RLock()
+	pending := make([]Registration, 0)
+	for _, reg := range r.recovered {
+		if reg.TTL > 0 {
+			pending = append(pending, reg)
+		}
+	}
+	r.mutex.RUnlock()
+	for _, reg := range pending {
+		log.Printf("[Lease] Recovered service %v with %v", reg.ServiceName, reg.ServiceURL)
+		err := r.add(reg)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
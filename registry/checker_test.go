@@ -0,0 +1,210 @@
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/*
+	几千个健康的实例加上几个一直不返回的实例一起调度
+	每一轮等所有健康的实例都被检查过一次，慢的实例只占 worker，不能让这一轮拖到超过检查间隔太多
+*/
+func BenchmarkCheckScheduler(b *testing.B) {
+	const (
+		healthy  = 3000
+		hanging  = 16
+		interval = time.Second
+	)
+	log.SetOutput(ioutil.Discard) // 每次检查都打日志
+	transport := http.DefaultTransport.(*http.Transport)
+	idle := transport.MaxIdleConnsPerHost
+	transport.MaxIdleConnsPerHost = checkWorkers // 所有实例都在同一个地址上，连接要能复用
+	defer func() { transport.MaxIdleConnsPerHost = idle }()
+
+	checked := make([]int64, healthy) // 每个实例最近一次被检查的时间
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if err == nil && i < healthy {
+			atomic.StoreInt64(&checked[i], time.Now().UnixNano())
+		}
+	}))
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+
+	r := newRegistry()
+	for i := 0; i < healthy+hanging; i++ {
+		reg := Registration{
+			ServiceName: GradingService,
+			InstanceID:  fmt.Sprintf("instance-%d", i),
+			HealthCheck: &HealthCheck{Interval: interval, Timeout: 5 * interval},
+		}
+		if i < healthy {
+			reg.HeartbeatURL = fmt.Sprintf("%s/%d", fast.URL, i)
+		} else {
+			reg.HeartbeatURL = slow.URL + "/hang"
+		}
+		reg.ServiceURL = reg.HeartbeatURL
+		r.registrations = append(r.registrations, reg)
+		r.health[reg.InstanceID] = &instanceHealth{Status: statusPassing, RegisteredAt: time.Now()}
+	}
+	stop := make(chan struct{})
+	go r.heartbeat(checkWorkers, 100*time.Millisecond, stop)
+	defer func() { // 停掉调度器，等正在进行的检查结束再恢复日志
+		close(stop)
+		close(release)
+		time.Sleep(500 * time.Millisecond)
+		fast.Close()
+		slow.Close()
+		log.SetOutput(os.Stderr)
+	}()
+
+	limit := 2 * interval // 第一轮的随机延迟加上抖动，最多不会超过两个间隔
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		start := time.Now()
+		for i := 0; i < healthy; i++ {
+			for atomic.LoadInt64(&checked[i]) < start.UnixNano() {
+				if time.Since(start) > limit {
+					b.Fatalf("instance %d not checked within %v while %d targets hang", i, limit, hanging)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+	b.ReportMetric(float64(healthy*b.N)/b.Elapsed().Seconds(), "checks/s")
+}
+
+// 定时器的 InstanceID，排好序
+func scheduledIDs(s *checkScheduler) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ids := make([]string, 0, len(s.timers))
+	for id := range s.timers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// 启动之后新注册的实例建定时器，注销的停掉，租约模式的不检查
+func TestCheckSchedulerReconcile(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	r := newRegistry()
+	s := newCheckScheduler(r, 1, stop)
+	add := func(id string, ttl time.Duration) {
+		reg := Registration{
+			ServiceName: GradingService, ServiceURL: "http://" + id, InstanceID: id, TTL: ttl,
+			HealthCheck: &HealthCheck{Interval: time.Hour}, // 测试期间不会到点
+		}
+		r.apply(walEntry{Op: opAdd, Registration: &reg})
+	}
+
+	add("grading-1", 0)
+	s.reconcile()
+	if ids := scheduledIDs(s); !reflect.DeepEqual(ids, []string{"grading-1"}) {
+		t.Fatalf("timers = %v, want [grading-1]", ids)
+	}
+
+	add("grading-2", 0)
+	add("leased-1", time.Minute)
+	s.reconcile()
+	if ids := scheduledIDs(s); !reflect.DeepEqual(ids, []string{"grading-1", "grading-2"}) {
+		t.Fatalf("timers after adding = %v, want [grading-1 grading-2]", ids)
+	}
+
+	r.apply(walEntry{Op: opRemove, ID: "grading-1"})
+	r.mutex.Lock()
+	r.checks["grading-1"] = &checkState{failures: 2}
+	r.mutex.Unlock()
+	s.reconcile()
+	if ids := scheduledIDs(s); !reflect.DeepEqual(ids, []string{"grading-2"}) {
+		t.Fatalf("timers after removing = %v, want [grading-2]", ids)
+	}
+	r.mutex.RLock()
+	_, kept := r.checks["grading-1"]
+	r.mutex.RUnlock()
+	if kept {
+		t.Fatal("check state of a removed instance kept")
+	}
+}
+
+// 第一次检查落在一个间隔之内，之后的间隔上下浮动不超过 checkJitter
+func TestCheckDelays(t *testing.T) {
+	const interval = 10 * time.Second
+	low := time.Duration(float64(interval) * (1 - checkJitter))
+	high := time.Duration(float64(interval) * (1 + checkJitter))
+	for i := 0; i < 1000; i++ {
+		if d := firstCheckDelay(interval); d < 0 || d >= interval {
+			t.Fatalf("first check after %v, want within [0, %v)", d, interval)
+		}
+		if d := jitter(interval); d < low || d > high {
+			t.Fatalf("next check after %v, want within [%v, %v]", d, low, high)
+		}
+	}
+}
+
+// 所有检查都卡住时，同时进行的检查不超过 checkWorkers 个
+func TestCheckSchedulerBoundsWorkers(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var inFlight, peak int64
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		for {
+			old := atomic.LoadInt64(&peak)
+			if n <= old || atomic.CompareAndSwapInt64(&peak, old, n) {
+				break
+			}
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+
+	r := newRegistry()
+	for i := 0; i < 2*checkWorkers; i++ {
+		reg := Registration{
+			ServiceName:  GradingService,
+			InstanceID:   fmt.Sprintf("hanging-%d", i),
+			HeartbeatURL: fmt.Sprintf("%s/%d", slow.URL, i),
+			HealthCheck:  &HealthCheck{Interval: 20 * time.Millisecond, Timeout: time.Minute},
+		}
+		reg.ServiceURL = reg.HeartbeatURL
+		r.registrations = append(r.registrations, reg)
+		r.health[reg.InstanceID] = &instanceHealth{Status: statusPassing, RegisteredAt: time.Now()}
+	}
+	stop := make(chan struct{})
+	go r.heartbeat(checkWorkers, 10*time.Millisecond, stop)
+	defer func() {
+		close(stop)
+		close(release)
+		time.Sleep(100 * time.Millisecond) // 等卡住的检查返回再恢复日志
+		slow.Close()
+		log.SetOutput(os.Stderr)
+	}()
+
+	waitFor(t, "every worker busy", func() bool { return atomic.LoadInt64(&inFlight) == checkWorkers })
+	time.Sleep(200 * time.Millisecond) // 再过几个间隔，到点的实例只能排队
+	if p := atomic.LoadInt64(&peak); p != checkWorkers {
+		t.Fatalf("%d checks ran at once, want at most %d", p, checkWorkers)
+	}
+}
@@ -18,28 +18,61 @@ package registry
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
-	"math/rand"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type providers struct {
-	services map[ServiceName][]string
-	mutex    *sync.RWMutex
+	services map[ServiceName][]patchEntry
+	filters  map[ServiceName]Filter // 每个依赖的服务只用满足条件的实例，见 filter.go
+	required []ServiceName          // 本服务依赖的服务，拉全量时用
+	revision uint64                 // 已经同步到的注册中心 Revision
+	cached   bool                   // 实例是从缓存文件读出来的，还没和注册中心对过，见 cache.go
+	cachedAt map[string]time.Time   // 从缓存文件读出来、注册中心还没确认过的实例 -> 缓存保存的时间
+	synced   time.Time              // 最后一次收到注册中心的消息
+	// 已经提示过 stale 的服务，收到注册中心的消息后清空
+	staleLogged map[ServiceName]bool
+	mutex       *sync.RWMutex
 }
 
 var prov = providers{
-	services: make(map[ServiceName][]string), // 键是ServiceName，值是string切片
+	services: make(map[ServiceName][]patchEntry), // 键是ServiceName，值是这个服务的所有实例
+	filters:  make(map[ServiceName]Filter),
+	cachedAt: make(map[string]time.Time),
 	mutex:    new(sync.RWMutex),
 }
 
 func (prv *providers) Update(pat patch) {
 	prv.mutex.Lock()
-	defer prv.mutex.Unlock()
+	prv.update(pat)
+	prv.mutex.Unlock()
+	prv.changed()
+}
+
+// 实例有变化，写缓存文件，触发 OnServiceAvailable 的回调
+func (prv *providers) changed() {
+	scheduleProviderCacheSave()
+	notifyAvailable()
+}
+
+// 注册中心发来的实例都算确认过，不再是缓存里的；调用方需持有 prv.mutex
+func (prv *providers) update(pat patch) {
+	for _, entries := range [][]patchEntry{pat.Added, pat.Removed, pat.Changed} {
+		for _, e := range entries {
+			delete(prv.cachedAt, entryKey(e))
+		}
+	}
 	// 两种情况
 	// 1.新增
 	for _, patchEntry := range pat.Added {
@@ -49,39 +82,228 @@ func (prv *providers) Update(pat patch) {
 				}
 				表达式 prv.services[patchEntry.Name] 返回了两个值：1.映射中键为 patchEntry.Name 的值	2.一个布尔值，表示该键是否存在
 			*/
-			prv.services[patchEntry.Name] = make([]string, 0)
+			prv.services[patchEntry.Name] = nil // 空切片，append 时再分配
+		}
+		if i := prv.find(patchEntry); i >= 0 { // 同一个实例重新注册，不要重复添加，标签、版本可能变了
+			prv.services[patchEntry.Name][i] = patchEntry
+			continue
 		}
-		// 将 patchEntry.URL 添加进 键为prv.services[patchEntry.Name] 的切片中
-		prv.services[patchEntry.Name] = append(prv.services[patchEntry.Name], patchEntry.URL)
+		// 将 patchEntry 添加进 键为prv.services[patchEntry.Name] 的切片中
+		prv.services[patchEntry.Name] = append(prv.services[patchEntry.Name], patchEntry)
 	}
 	// 2.移除
-	// 在patch的removed里找，如果providerUrl存在，则将他们对比，相同的去掉
+	// 在patch的removed里找，如果这个实例存在，去掉
 	for _, patchEntry := range pat.Removed {
-		if providerUrls, ok := prv.services[patchEntry.Name]; ok {
-			for i := range providerUrls {
-				if providerUrls[i] == patchEntry.URL {
-					prv.services[patchEntry.Name] = append(providerUrls[:i], providerUrls[i+1:]...)
-				}
-			}
+		if i := prv.find(patchEntry); i >= 0 {
+			entries := prv.services[patchEntry.Name]
+			prv.services[patchEntry.Name] = append(entries[:i], entries[i+1:]...)
+		}
+	}
+	// 3.健康状态变化
+	for _, patchEntry := range pat.Changed {
+		if i := prv.find(patchEntry); i >= 0 {
+			prv.services[patchEntry.Name][i] = patchEntry
 		}
 	}
 }
 
-func (prv providers) get(name ServiceName) (string, error) {
-	providersValue, ok := prv.services[name]
-	if !ok {
-		return "", fmt.Errorf("no providers available for service %v", name)
+// 按实例 ID 找到同一个实例的下标，没有返回 -1。调用方需持有 prv.mutex
+func (prv *providers) find(entry patchEntry) int {
+	for i, e := range prv.services[entry.Name] {
+		if e.ID == entry.ID {
+			return i
+		}
+	}
+	return -1
+}
+
+// 用 revision 时的全量数据整体替换 names 这些服务的实例，names 为空表示替换全部
+func (prv *providers) reset(names []ServiceName, added []patchEntry, revision uint64) {
+	prv.mutex.Lock()
+	if len(names) == 0 {
+		prv.services = make(map[ServiceName][]patchEntry)
+		prv.cachedAt = make(map[string]time.Time)
+	}
+	for _, name := range names {
+		for _, e := range prv.services[name] {
+			delete(prv.cachedAt, entryKey(e))
+		}
+		delete(prv.services, name)
+	}
+	prv.update(patch{Added: added})
+	prv.revision = revision
+	prv.cached = false
+	prv.touch()
+	prv.mutex.Unlock()
+	prv.changed()
+}
+
+/*
+	处理注册中心推送的 patch
+	- Revision 比自己的还旧：已经拉过更新的全量数据，丢掉；除非注册中心重启丢了状态
+	- PrevRevision 比自己的新：中间有 patch 没收到，拉一次全量
+	- 手上的实例是从缓存文件读的：注册中心回来了，拉一次全量
+*/
+func (prv *providers) receive(p patch) {
+	prv.mutex.Lock()
+	prv.touch()
+	if prv.cached {
+		prv.mutex.Unlock()
+		log.Println("registry is back, replacing cached providers")
+		prv.resync()
+		return
+	}
+	if p.Revision != 0 && p.Revision < prv.revision {
+		restarted := p.PrevRevision == 0 // 注册中心没发过东西给我们，却比我们还旧：它丢了状态重启过
+		have := prv.revision
+		prv.mutex.Unlock()
+		if restarted {
+			log.Printf("registry revision went back from %d to %d, resyncing", have, p.Revision)
+			prv.resync()
+		}
+		return
+	}
+	if p.PrevRevision > prv.revision {
+		have := prv.revision
+		prv.mutex.Unlock()
+		log.Printf("missed registry updates (have revision %d, registry sent %d before), resyncing", have, p.PrevRevision)
+		prv.resync()
+		return
+	}
+	prv.update(p)
+	if p.Revision > prv.revision {
+		prv.revision = p.Revision
+	}
+	prv.mutex.Unlock()
+	prv.changed()
+}
+
+// 心跳检查时注册中心告诉我们它最后发出的 Revision，最后一个 patch 丢了也能发现
+func (prv *providers) checkRevision(revision uint64) {
+	prv.mutex.RLock()
+	behind := revision > prv.revision
+	prv.mutex.RUnlock()
+	if behind {
+		log.Printf("registry is at revision %d, resyncing", revision)
+		go prv.resync()
+	}
+}
+
+// 从注册中心拉依赖服务的全量数据
+func (prv *providers) resync() {
+	prv.mutex.RLock()
+	names := prv.required
+	prv.mutex.RUnlock()
+	result, err := watchOnce(context.Background(), ClientFor(RegistryService, 5*time.Second), names, 0)
+	if err != nil {
+		log.Println("failed to resync providers:", err)
+		return
+	}
+	added := make([]patchEntry, 0, len(result.Events))
+	for _, e := range result.Events {
+		added = append(added, e.Entry)
+	}
+	prv.reset(names, added, result.Index)
+}
+
+// 某个服务当前满足过滤条件的所有实例的 URL，选哪个由 balancer.go 决定
+func (prv *providers) get(name ServiceName) []string {
+	prv.mutex.RLock()
+	defer prv.mutex.RUnlock()
+	urls := make([]string, 0, len(prv.services[name]))
+	for _, e := range prv.services[name] {
+		if usable(e) && prv.filters[name].Match(e) {
+			urls = append(urls, e.URL)
+		}
+	}
+	return urls
+}
+
+// 只用 passing 和 warning 的实例，critical、quarantined、维护中的都不用
+func usable(e patchEntry) bool {
+	return e.Status == statusPassing || e.Status == statusWarning
+}
+
+/*
+	只使用满足条件的实例，比如 SetProviderFilter(GradingService, "tag=primary, version>=1.2")
+	filter 为空表示不过滤；通过 RegisterService 注册的服务用 Registration.RequiredFilters 就行，
+	注册中心推送时也会按它过滤
+*/
+func SetProviderFilter(name ServiceName, filter string) error {
+	f, err := ParseFilter(filter)
+	if err != nil {
+		return err
 	}
-	index := int(rand.Float32() * float32(len(providersValue)))
-	return providersValue[index], nil
+	prov.mutex.Lock()
+	defer prov.mutex.Unlock()
+	prov.filters[name] = f
+	return nil
+}
+
+/*
+	通过长轮询 GET /services/watch 发现 names 这些服务的变化，交给 prov
+	不需要 ServiceUpdateUrl，适合在 NAT 后面或者没有 HTTP 服务器的服务；ctx 取消后停止
+*/
+func WatchServices(ctx context.Context, names ...ServiceName) {
+	go func() {
+		var index uint64
+		client := ClientFor(RegistryService, watchTimeout+10*time.Second) // 比注册中心挂起的时间长一些
+		for ctx.Err() == nil {
+			result, err := watchOnce(ctx, client, names, index)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Println(err)
+					time.Sleep(1 * time.Second)
+				}
+				continue
+			}
+			index = result.Index
+			var p patch
+			for _, e := range result.Events {
+				switch e.Type {
+				case "Added":
+					p.Added = append(p.Added, e.Entry)
+				case "Removed":
+					p.Removed = append(p.Removed, e.Entry)
+				case "Changed":
+					p.Changed = append(p.Changed, e.Entry)
+				}
+			}
+			if result.Reset {
+				prov.reset(names, p.Added, result.Index)
+				continue
+			}
+			prov.Update(p)
+		}
+	}()
 }
 
-func GetProvider(name ServiceName) (string, error) {
-	return prov.get(name)
+func watchOnce(ctx context.Context, client *http.Client, names []ServiceName, index uint64) (watchResult, error) {
+	var result watchResult
+	query := url.Values{}
+	for _, name := range names {
+		query.Add("name", string(name))
+	}
+	query.Set("index", strconv.FormatUint(index, 10))
+
+	res, err := callRegistry(client, func(servicesUrl string) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, servicesUrl+"/watch?"+query.Encode(), nil)
+	})
+	if err != nil {
+		return result, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("failed to watch services. registry service responsed with code %v", res.StatusCode)
+	}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	return result, err
 }
 
 // 服务有变化，接收更新的Handler
-type serviceUpdateHandler struct{}
+type serviceUpdateHandler struct {
+	name ServiceName // 用它的密钥验证 patch 的签名
+}
 
 func (suh serviceUpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -93,9 +315,19 @@ func (suh serviceUpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 		1.ioutil.ReadAll和json.Unmarshal的组合方式
 		2.json.Decode方法
 	*/
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !verifyPatch(r, suh.name, body) { // 不是注册中心发来的
+		log.Printf("rejecting patch with invalid signature from %s", r.RemoteAddr)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 	var p patch
-	dec := json.NewDecoder(r.Body)
-	err := dec.Decode(&p)
+	err = json.Unmarshal(body, &p)
 	if err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusBadRequest)
@@ -104,61 +336,486 @@ func (suh serviceUpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 	// [插桩] 输出一句话，看是否收到更新
 	// => 输出的案例，依赖服务已注销：{[] [{LogService http://localhost:4000}]}，第一个元素是Added，第二个是Removed
 	// fmt.Printf("Update received %v\n", p)
-	prov.Update(p)
+	prov.receive(p)
 }
 
 func RegisterService(r Registration) error {
-	/* 心跳检查 */
-	heartUrl, err := url.Parse(r.HeartbeatURL)
-	if err != nil {
-		return err
+	/* 心跳检查，租约模式下可以不提供 HeartbeatURL */
+	if r.HeartbeatURL != "" {
+		heartUrl, err := url.Parse(r.HeartbeatURL)
+		if err != nil {
+			return err
+		}
+		http.HandleFunc(heartUrl.Path, func(w http.ResponseWriter, r *http.Request) {
+			prov.heard()
+			if revision, err := strconv.ParseUint(r.Header.Get(revisionHeader), 10, 64); err == nil {
+				prov.checkRevision(revision)
+			}
+			w.WriteHeader(http.StatusOK)
+		})
 	}
-	http.HandleFunc(heartUrl.Path, func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
 
 	/* 更新动作 */
 	serviceUpdateUrl, err := url.Parse(r.ServiceUpdateUrl) // 解析成 url 类型
 	if err != nil {
 		return err
 	}
-	http.Handle(serviceUpdateUrl.Path, &serviceUpdateHandler{})
+	if _, ok := serviceKey(r.ServiceName); !ok {
+		if path := keyFileFromEnv(r.ServiceName); path != "" {
+			err = LoadServiceKey(r.ServiceName, path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	http.Handle(serviceUpdateUrl.Path, &serviceUpdateHandler{name: r.ServiceName})
+	for name, filter := range r.RequiredFilters {
+		err = SetProviderFilter(name, filter)
+		if err != nil {
+			return err
+		}
+	}
+	prov.mutex.Lock()
+	prov.required = r.RequiredServices
+	prov.mutex.Unlock()
+
+	if r.InstanceID == "" { // 在第一次发请求之前生成，换节点重发、后台重试注册的都是同一个实例，不会注册出两个
+		r.InstanceID = newID()
+	}
+	err = register(r)
+	if errors.Is(err, errRegistryUnreachable) && providerCacheEnabled() { // 先用缓存里的实例，注册中心回来后再注册
+		log.Printf("%v, using cached providers and registering in the background", err)
+		go registerInBackground(r, pendingRegistration(r.ServiceURL))
+		return nil
+	}
+	return err
+}
 
-	/* 以下是注册 */
+// 向注册中心发 POST 注册；租约模式下注册成功后在后台开始续约
+func register(r Registration) error {
 	buf := new(bytes.Buffer) // 开辟一个buf 实现 io.Reader
 	enc := json.NewEncoder(buf)
-	err = enc.Encode(r)
+	err := enc.Encode(r)
 	if err != nil { // 编码发生错误
 		return err
 	}
+	data := buf.Bytes()
 
-	res, err := http.Post(ServicesUrl, "application/json", buf)
-	if err != nil { // post 请求错误
-		return err
+	res, err := callRegistry(ClientFor(RegistryService, 0), func(servicesUrl string) (*http.Request, error) {
+		req, err := newSignedRequest(http.MethodPost, servicesUrl, r.ServiceName, data)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil { // post 请求错误，所有节点都连不上
+		return fmt.Errorf("%w: %v", errRegistryUnreachable, err)
 	}
-
+	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK { // 状态码不是200，仍然有错
 		return fmt.Errorf("failed to register service. registry service responsed with code %v", res.StatusCode)
 	}
-
 	// 如果上述三种错误都没发生
+	var result registrationResult
+	err = json.NewDecoder(res.Body).Decode(&result)
+	if err != nil {
+		return err
+	}
+	r.InstanceID = result.InstanceID // 注销、重新注册时都用这个 ID
+	instances.mutex.Lock()
+	instances.regs[r.ServiceURL] = r
+	instances.mutex.Unlock()
+	if result.LeaseID != "" && result.TTL > 0 {
+		startKeepAlive(r, result.LeaseID, result.TTL)
+	}
+	return nil
+}
+
+// 本进程注册过的实例：ServiceURL -> 注册信息（带注册中心分配的实例 ID）
+var instances = struct {
+	regs    map[string]Registration
+	pending map[string]chan struct{} // 注册中心连不上、还在后台重试注册的：ServiceURL -> 用来取消的 channel
+	mutex   *sync.Mutex
+}{
+	regs:    make(map[string]Registration),
+	pending: make(map[string]chan struct{}),
+	mutex:   new(sync.Mutex),
+}
+
+// 记下 serviceURL 在后台重试注册，返回取消用的 channel
+func pendingRegistration(serviceURL string) chan struct{} {
+	stop := make(chan struct{})
+	instances.mutex.Lock()
+	defer instances.mutex.Unlock()
+	if old, ok := instances.pending[serviceURL]; ok {
+		close(old)
+	}
+	instances.pending[serviceURL] = stop
+	return stop
+}
+
+// 取消 serviceURL 在后台的重试注册，没有的话返回 false
+func cancelRegistration(serviceURL string) bool {
+	instances.mutex.Lock()
+	defer instances.mutex.Unlock()
+	stop, ok := instances.pending[serviceURL]
+	if ok {
+		close(stop)
+		delete(instances.pending, serviceURL)
+	}
+	return ok
+}
+
+// 正在续约的服务：ServiceURL -> 用来停止续约的 channel
+var keepAlives = struct {
+	stops map[string]chan struct{}
+	mutex *sync.Mutex
+}{
+	stops: make(map[string]chan struct{}),
+	mutex: new(sync.Mutex),
+}
+
+func startKeepAlive(r Registration, leaseID string, ttl time.Duration) {
+	stop := make(chan struct{})
+	keepAlives.mutex.Lock()
+	if old, ok := keepAlives.stops[r.ServiceURL]; ok {
+		close(old)
+	}
+	keepAlives.stops[r.ServiceURL] = stop
+	keepAlives.mutex.Unlock()
+	go keepAlive(r, leaseID, ttl, stop)
+}
+
+func stopKeepAlive(serviceURL string) {
+	keepAlives.mutex.Lock()
+	defer keepAlives.mutex.Unlock()
+	if stop, ok := keepAlives.stops[serviceURL]; ok {
+		close(stop)
+		delete(keepAlives.stops, serviceURL)
+	}
+}
+
+// 每 TTL/3 续约一次，留出两次失败重试的余地；租约已经没了就重新注册
+func keepAlive(r Registration, leaseID string, ttl time.Duration, stop chan struct{}) {
+	interval := ttl / 3
+	if interval <= 0 { // 注册中心检查过 TTL，这里只是防止 NewTicker panic
+		interval = ttl
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		err := renewLease(r.ServiceName, leaseID)
+		if err == errLeaseNotFound {
+			log.Printf("lease for %v expired, registering again", r.ServiceName)
+			r.LeaseID = ""
+			err = register(r) // 成功的话会启动新的 keepAlive 并关闭这个
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		prov.heard()
+	}
+}
+
+func renewLease(name ServiceName, leaseID string) error {
+	res, err := callRegistry(ClientFor(RegistryService, 0), func(servicesUrl string) (*http.Request, error) {
+		leaseUrl := strings.TrimSuffix(servicesUrl, "/services") + "/leases/" + leaseID
+		return newSignedRequest(http.MethodPut, leaseUrl, name, nil)
+	})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return errLeaseNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to renew lease. registry service responsed with code %v", res.StatusCode)
+	}
 	return nil
 }
 
 /* 关闭服务
 应该放在 Service包 的 startService() 两个取消的协程中 */
 func ShutdownService(url string) error {
-	req, err := http.NewRequest(http.MethodDelete, ServicesUrl, bytes.NewBuffer([]byte(url)))
-	if err != nil {
-		return err
+	return ShutdownServiceContext(context.Background(), url)
+}
+
+// 同 ShutdownService，ctx 取消或者到期后不再等注册中心，比如下线时最多等 DrainTimeout
+func ShutdownServiceContext(ctx context.Context, url string) error {
+	pending := cancelRegistration(url)
+	stopKeepAlive(url)
+	flushProviderCache()
+	instances.mutex.Lock()
+	r, ok := instances.regs[url]
+	delete(instances.regs, url)
+	instances.mutex.Unlock()
+	if ok && r.InstanceID != "" {
+		return deregisterInstance(ctx, r.ServiceName, r.InstanceID)
+	}
+	if pending && !ok { // 还没注册上，后台的重试已经取消了
+		return nil
 	}
-	req.Header.Add("Content-type", "text/plain")
-	res, err := http.DefaultClient.Do(req)
+
+	// 不是本进程注册的（或者注册中心没有返回实例 ID），只能按 URL 注销；启用了认证时要用这个服务的密钥签名
+	name := r.ServiceName
+	if !ok {
+		name = kvCaller() // 不知道是哪个服务，用本进程加载了的密钥
+	}
+	res, err := callRegistry(ClientFor(RegistryService, 0), func(servicesUrl string) (*http.Request, error) {
+		req, err := newSignedRequest(http.MethodDelete, servicesUrl, name, []byte(url))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Content-type", "text/plain")
+		return req.WithContext(ctx), nil
+	})
 	if err != nil {
 		return err
 	}
+	res.Body.Close()
 	if res.StatusCode != http.StatusOK {
 		return fmt.Errorf("failed to deregister service. Registry service responsed with code %v", res.StatusCode)
 	}
 	return nil // 如果都没错就取消成功
 }
+
+// 按实例 ID 注销：DELETE /services/{name}/instances/{id}
+func DeregisterInstance(name ServiceName, id string) error {
+	return deregisterInstance(context.Background(), name, id)
+}
+
+func deregisterInstance(ctx context.Context, name ServiceName, id string) error {
+	res, err := callRegistry(ClientFor(RegistryService, 0), func(servicesUrl string) (*http.Request, error) {
+		req, err := newSignedRequest(http.MethodDelete, fmt.Sprintf("%s/%s/instances/%s", servicesUrl, url.PathEscape(string(name)), url.PathEscape(id)), name, nil)
+		if err != nil {
+			return nil, err
+		}
+		return req.WithContext(ctx), nil
+	})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to deregister instance %s. Registry service responsed with code %v", id, res.StatusCode)
+	}
+	return nil
+}
+
+/*
+	把本进程注册的实例（ServiceURL 为 serviceURL）设为维护状态：仍然注册着、照常心跳，但依赖方不会再选它
+	enable 为 false 时退出维护；下线前先进入维护、等正在处理的请求结束再注销，见 service.Start
+*/
+func SetMaintenance(serviceURL string, enable bool, reason string) error {
+	return SetMaintenanceContext(context.Background(), serviceURL, enable, reason)
+}
+
+// 同 SetMaintenance，ctx 取消或者到期后不再等注册中心
+func SetMaintenanceContext(ctx context.Context, serviceURL string, enable bool, reason string) error {
+	instances.mutex.Lock()
+	r, ok := instances.regs[serviceURL]
+	instances.mutex.Unlock()
+	if !ok || r.InstanceID == "" {
+		return fmt.Errorf("service %s is not registered by this process", serviceURL)
+	}
+	method := http.MethodDelete
+	var data []byte
+	if enable {
+		method = http.MethodPut
+		var err error
+		data, err = json.Marshal(maintenanceRequest{Reason: reason})
+		if err != nil {
+			return err
+		}
+	}
+	res, err := callRegistry(ClientFor(RegistryService, 0), func(servicesUrl string) (*http.Request, error) {
+		maintenanceUrl := fmt.Sprintf("%s/%s/instances/%s/maintenance", servicesUrl, url.PathEscape(string(r.ServiceName)), url.PathEscape(r.InstanceID))
+		req, err := newSignedRequest(method, maintenanceUrl, r.ServiceName, data)
+		if err != nil {
+			return nil, err
+		}
+		return req.WithContext(ctx), nil
+	})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to set maintenance of instance %s. Registry service responsed with code %v", r.InstanceID, res.StatusCode)
+	}
+	return nil
+}
+
+/*
+	依次尝试每个注册中心节点，直到有一个节点正常响应，返回的 res 由调用方关闭
+	集群模式下 follower 会把写请求转发给 leader，所以随便哪个节点都可以
+	- 从上次成功的节点开始试，一个节点挂了之后不用每次都先等它超时
+	- client 没有设置超时的话，每个节点的一次请求最多等 SetRegistryTimeout 设置的时间，挂住的节点也会换下一个
+	- 所有节点都失败时，按退避间隔再从头试 retries 轮；请求的 ctx 取消了就不再等
+*/
+func callRegistry(client *http.Client, newRequest func(servicesUrl string) (*http.Request, error)) (*http.Response, error) {
+	retries, backoff := registryRetry()
+	timeout := registryTimeout()
+	ctx := context.Background() // 请求带的 ctx，等待重试时也要看它
+	var err error
+	for round := 0; round <= retries; round++ {
+		if round > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, err
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+		}
+		for _, servicesUrl := range registryEndpoints() {
+			var req *http.Request
+			req, err = newRequest(servicesUrl)
+			if err != nil {
+				return nil, err
+			}
+			ctx = req.Context()
+			var res *http.Response
+			res, err = doAttempt(client, req, timeout)
+			if err != nil { // 请求错误或者超时，换下一个节点
+				continue
+			}
+			if retryOnAnotherNode(res.StatusCode) { // 节点不可用或正在选举，换下一个节点
+				res.Body.Close()
+				err = fmt.Errorf("registry service %s responsed with code %v", servicesUrl, res.StatusCode)
+				continue
+			}
+			preferEndpoint(servicesUrl)
+			return res, nil
+		}
+	}
+	return nil, err
+}
+
+// 对一个节点的一次请求，client 自己没有超时的话最多等 timeout；超时一直管到调用方关闭 res.Body
+func doAttempt(client *http.Client, req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if client.Timeout > 0 || timeout <= 0 { // 比如 watch 的长轮询，自己定了更长的超时
+		return client.Do(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+var registryURLs = struct {
+	urls      []string
+	preferred int // 上次成功的节点在 urls 里的下标
+	retries   int
+	backoff   time.Duration
+	timeout   time.Duration
+	mutex     *sync.RWMutex
+}{
+	urls:    []string{ServicesUrl},
+	retries: defaultRegistryRetries,
+	backoff: defaultRetryBackoff,
+	timeout: defaultRequestTimeout,
+	mutex:   new(sync.RWMutex),
+}
+
+/*
+	设置注册中心集群的各个节点，如 http://localhost:3000/services、http://localhost:3001/services
+	RegisterService、ShutdownService 会按顺序尝试，直到有一个节点处理成功
+	一般不用直接调用，见 config.go 的 ConfigureRegistry
+*/
+func SetRegistryURLs(urls ...string) {
+	if len(urls) == 0 {
+		return
+	}
+	registryURLs.mutex.Lock()
+	defer registryURLs.mutex.Unlock()
+	registryURLs.urls = urls
+	registryURLs.preferred = 0
+}
+
+// 所有节点都失败后再试 retries 轮，第一轮之后等 backoff，之后每轮翻倍；backoff 为 0 时保持原来的
+func SetRegistryRetry(retries int, backoff time.Duration) {
+	registryURLs.mutex.Lock()
+	defer registryURLs.mutex.Unlock()
+	registryURLs.retries = retries
+	if backoff > 0 {
+		registryURLs.backoff = backoff
+	}
+}
+
+func registryRetry() (int, time.Duration) {
+	registryURLs.mutex.RLock()
+	defer registryURLs.mutex.RUnlock()
+	return registryURLs.retries, registryURLs.backoff
+}
+
+// 每个节点的一次请求最多等 timeout，超时了换下一个节点
+func SetRegistryTimeout(timeout time.Duration) {
+	registryURLs.mutex.Lock()
+	defer registryURLs.mutex.Unlock()
+	registryURLs.timeout = timeout
+}
+
+func registryTimeout() time.Duration {
+	registryURLs.mutex.RLock()
+	defer registryURLs.mutex.RUnlock()
+	return registryURLs.timeout
+}
+
+func preferEndpoint(servicesUrl string) {
+	registryURLs.mutex.Lock()
+	defer registryURLs.mutex.Unlock()
+	for i, url := range registryURLs.urls {
+		if withScheme(url) == servicesUrl {
+			registryURLs.preferred = i
+			return
+		}
+	}
+}
+
+// 503：节点正在选举或 leader 刚切换；502：follower 转发给 leader 失败
+func retryOnAnotherNode(statusCode int) bool {
+	return statusCode == http.StatusServiceUnavailable || statusCode == http.StatusBadGateway
+}
+
+func registryEndpoints() []string {
+	registryURLs.mutex.RLock()
+	defer registryURLs.mutex.RUnlock()
+	// 从上次成功的节点开始，依次往后
+	n := len(registryURLs.urls)
+	urls := make([]string, n)
+	for i := range urls {
+		urls[i] = withScheme(registryURLs.urls[(registryURLs.preferred+i)%n])
+	}
+	return urls
+}
@@ -0,0 +1,121 @@
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 测试用一份空的 prov，结束后恢复
+func withProviders(t *testing.T, required ...ServiceName) {
+	t.Helper()
+	old := prov
+	prov = providers{
+		services: make(map[ServiceName][]patchEntry),
+		filters:  make(map[ServiceName]Filter),
+		required: required,
+		cachedAt: make(map[string]time.Time),
+		mutex:    new(sync.RWMutex),
+	}
+	t.Cleanup(func() { prov = old })
+}
+
+// 假的注册中心，watch 请求都返回 result，返回请求计数
+func fakeRegistry(t *testing.T, result watchResult) *int32 {
+	t.Helper()
+	var watches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/services/watch" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&watches, 1)
+		json.NewEncoder(w).Encode(result)
+	}))
+	t.Cleanup(srv.Close)
+	old := registryEndpoints()
+	SetRegistryURLs(srv.URL + "/services")
+	t.Cleanup(func() { SetRegistryURLs(old...) })
+	return &watches
+}
+
+func providerIDs(name ServiceName) []string {
+	prov.mutex.RLock()
+	defer prov.mutex.RUnlock()
+	ids := make([]string, 0)
+	for _, e := range prov.services[name] {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func gradingEntry(id string) patchEntry {
+	return patchEntry{Name: GradingService, ID: id, URL: "http://" + id, Status: statusPassing}
+}
+
+// 重复的、比已有的旧的 patch 丢掉；PrevRevision 对不上说明中间漏了，拉一次全量
+func TestReceiveResyncsOnGap(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	withProviders(t, GradingService)
+	full := watchResult{Index: 10, Reset: true, Events: []watchEvent{
+		{Index: 10, Type: "Added", Entry: gradingEntry("a")},
+		{Index: 10, Type: "Added", Entry: gradingEntry("b")},
+	}}
+	watches := fakeRegistry(t, full)
+
+	added := patch{Revision: 3, Added: []patchEntry{gradingEntry("a")}}
+	prov.receive(added)
+	prov.receive(added)
+	if ids := providerIDs(GradingService); len(ids) != 1 || ids[0] != "a" || prov.revision != 3 {
+		t.Fatalf("after a duplicate patch: %v at revision %d, want [a] at 3", ids, prov.revision)
+	}
+	prov.receive(patch{Revision: 2, PrevRevision: 1, Removed: []patchEntry{gradingEntry("a")}})
+	if ids := providerIDs(GradingService); len(ids) != 1 || prov.revision != 3 {
+		t.Fatalf("old patch applied: %v at revision %d", ids, prov.revision)
+	}
+	if n := atomic.LoadInt32(watches); n != 0 {
+		t.Fatalf("%d resyncs without a gap", n)
+	}
+
+	prov.receive(patch{Revision: 8, PrevRevision: 5, Added: []patchEntry{gradingEntry("c")}})
+	if n := atomic.LoadInt32(watches); n != 1 {
+		t.Fatalf("%d resyncs after a gap, want 1", n)
+	}
+	if ids := providerIDs(GradingService); len(ids) != 2 || ids[0] != "a" || ids[1] != "b" || prov.revision != 10 {
+		t.Fatalf("after resync: %v at revision %d, want the registry's [a b] at 10", ids, prov.revision)
+	}
+}
+
+// 心跳带来的 Revision 比自己的新，说明最后一个 patch 丢了
+func TestCheckRevision(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	withProviders(t, GradingService)
+	watches := fakeRegistry(t, watchResult{Index: 12, Reset: true, Events: []watchEvent{
+		{Index: 12, Type: "Added", Entry: gradingEntry("a")},
+	}})
+	prov.receive(patch{Revision: 10, Added: []patchEntry{gradingEntry("b")}})
+
+	prov.checkRevision(9)
+	prov.checkRevision(10)
+	if n := atomic.LoadInt32(watches); n != 0 {
+		t.Fatalf("%d resyncs while up to date", n)
+	}
+	prov.checkRevision(12)
+	waitFor(t, "resync", func() bool {
+		prov.mutex.RLock()
+		defer prov.mutex.RUnlock()
+		return prov.revision == 12
+	})
+	if ids := providerIDs(GradingService); len(ids) != 1 || ids[0] != "a" {
+		t.Fatalf("after resync: %v, want [a]", ids)
+	}
+}
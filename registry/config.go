@@ -0,0 +1,170 @@
+/*
+	注册中心的地址从哪里来，优先级从高到低
+	- 命令行 -registry http://host1:3000,http://host2:3000（要先调用 RegistryFlags）
+	- 环境变量 REGISTRY_URLS，格式同上
+	- 配置文件：命令行 -registry-config 或者环境变量 REGISTRY_CONFIG 指定的 JSON 文件
+		{
+			"URLs": ["http://host1:3000", "http://host2:3000"],
+			"Retries": 3,
+			"RetryBackoff": "200ms",
+			"RequestTimeout": "5s",
+			"Cache": "portal.providers.json",
+			"CacheTTL": "5m"
+		}
+	- 都没有就用默认的 ServicesUrl
+	地址可以只写到端口，会自动补上 /services
+	依赖服务实例的缓存文件（见 cache.go）同样按命令行 -provider-cache、-provider-cache-ttl，
+	环境变量 REGISTRY_CACHE、REGISTRY_CACHE_TTL，配置文件的顺序确定，都没有就不启用
+*/
+package registry
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRegistryRetries = 2                      // 所有节点都失败后再从头试几轮
+	defaultRetryBackoff    = 200 * time.Millisecond // 第一轮之后等多久，之后每轮翻倍
+	maxRetryBackoff        = 2 * time.Second
+	defaultRequestTimeout  = 5 * time.Second // 每个节点的一次请求最多等多久，挂住的节点不会一直卡住调用方
+)
+
+type registryConfig struct {
+	URLs           []string
+	Retries        *int   // 不写用默认的重试轮数，0 表示不重试
+	RetryBackoff   string // time.ParseDuration 的格式
+	RequestTimeout string // time.ParseDuration 的格式，每个节点的一次请求最多等多久
+	Cache          string // 依赖服务实例的缓存文件
+	CacheTTL       string // time.ParseDuration 的格式
+}
+
+var registryFlags = struct {
+	urls     *string
+	config   *string
+	cache    *string
+	cacheTTL *string
+}{}
+
+// 在 fs 上定义 -registry、-registry-config 和 -provider-cache，fs.Parse 之后调用 ConfigureRegistry
+func RegistryFlags(fs *flag.FlagSet) {
+	registryFlags.urls = fs.String("registry", "", "comma separated registry addresses, e.g. http://host1:3000,http://host2:3000")
+	registryFlags.config = fs.String("registry-config", "", "JSON file with the registry addresses and retry settings")
+	registryFlags.cache = fs.String("provider-cache", "", "file to keep the last known providers in, used while the registry is unreachable")
+	registryFlags.cacheTTL = fs.String("provider-cache-ttl", "", "how long providers stay fresh without hearing from the registry, e.g. 5m")
+}
+
+func flagValue(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
+}
+
+// 按命令行、环境变量、配置文件的顺序确定注册中心的地址和重试设置，都没有的话保持默认
+func ConfigureRegistry() error {
+	var cfg registryConfig
+	path := flagValue(registryFlags.config)
+	if path == "" {
+		path = os.Getenv("REGISTRY_CONFIG")
+	}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, &cfg)
+		if err != nil {
+			return fmt.Errorf("invalid registry config %s: %v", path, err)
+		}
+	}
+	if env := os.Getenv("REGISTRY_URLS"); env != "" {
+		cfg.URLs = strings.Split(env, ",")
+	}
+	if urls := flagValue(registryFlags.urls); urls != "" {
+		cfg.URLs = strings.Split(urls, ",")
+	}
+
+	if len(cfg.URLs) > 0 {
+		urls := make([]string, 0, len(cfg.URLs))
+		for _, raw := range cfg.URLs {
+			if strings.TrimSpace(raw) == "" {
+				continue
+			}
+			servicesUrl, err := normalizeRegistryURL(raw)
+			if err != nil {
+				return err
+			}
+			urls = append(urls, servicesUrl)
+		}
+		SetRegistryURLs(urls...)
+	}
+
+	backoff := time.Duration(0)
+	if cfg.RetryBackoff != "" {
+		var err error
+		backoff, err = time.ParseDuration(cfg.RetryBackoff)
+		if err != nil || backoff < 0 {
+			return fmt.Errorf("invalid RetryBackoff %q in registry config", cfg.RetryBackoff)
+		}
+	}
+	retries, _ := registryRetry()
+	if cfg.Retries != nil {
+		if *cfg.Retries < 0 {
+			return fmt.Errorf("invalid Retries %d in registry config", *cfg.Retries)
+		}
+		retries = *cfg.Retries
+	}
+	SetRegistryRetry(retries, backoff)
+	if cfg.RequestTimeout != "" {
+		timeout, err := time.ParseDuration(cfg.RequestTimeout)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid RequestTimeout %q in registry config", cfg.RequestTimeout)
+		}
+		SetRegistryTimeout(timeout)
+	}
+
+	if env := os.Getenv("REGISTRY_CACHE"); env != "" {
+		cfg.Cache = env
+	}
+	if cache := flagValue(registryFlags.cache); cache != "" {
+		cfg.Cache = cache
+	}
+	if env := os.Getenv("REGISTRY_CACHE_TTL"); env != "" {
+		cfg.CacheTTL = env
+	}
+	if ttl := flagValue(registryFlags.cacheTTL); ttl != "" {
+		cfg.CacheTTL = ttl
+	}
+	if cfg.Cache == "" {
+		return nil
+	}
+	ttl := time.Duration(0)
+	if cfg.CacheTTL != "" {
+		var err error
+		ttl, err = time.ParseDuration(cfg.CacheTTL)
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("invalid CacheTTL %q in registry config", cfg.CacheTTL)
+		}
+	}
+	return SetProviderCache(cfg.Cache, ttl)
+}
+
+// http://host:3000 => http://host:3000/services
+func normalizeRegistryURL(raw string) (string, error) {
+	raw = strings.TrimRight(strings.TrimSpace(raw), "/")
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid registry address %q", raw)
+	}
+	if !strings.HasSuffix(u.Path, "/services") {
+		u.Path += "/services"
+	}
+	return u.String(), nil
+}
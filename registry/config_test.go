@@ -0,0 +1,204 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 测试里改注册中心的地址、重试设置和命令行参数，结束后恢复
+func withRegistryURLs(t *testing.T) {
+	t.Helper()
+	registryURLs.mutex.Lock()
+	urls, preferred := registryURLs.urls, registryURLs.preferred
+	retries, backoff, timeout := registryURLs.retries, registryURLs.backoff, registryURLs.timeout
+	registryURLs.urls, registryURLs.preferred = []string{ServicesUrl}, 0
+	registryURLs.retries, registryURLs.backoff, registryURLs.timeout = defaultRegistryRetries, defaultRetryBackoff, defaultRequestTimeout
+	registryURLs.mutex.Unlock()
+	flags := registryFlags
+	for _, name := range []string{"REGISTRY_URLS", "REGISTRY_CONFIG", "REGISTRY_CACHE", "REGISTRY_CACHE_TTL"} {
+		t.Setenv(name, "")
+	}
+	t.Cleanup(func() {
+		registryURLs.mutex.Lock()
+		registryURLs.urls, registryURLs.preferred = urls, preferred
+		registryURLs.retries, registryURLs.backoff, registryURLs.timeout = retries, backoff, timeout
+		registryURLs.mutex.Unlock()
+		registryFlags = flags
+	})
+}
+
+// 命令行 > 环境变量 > 配置文件 > 默认；配置文件里没写 Retries 时保持默认，写 0 表示不重试
+func TestConfigureRegistryPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	noRetry := write("no-retry.json", `{"URLs": ["http://file:3000"], "Retries": 0, "RetryBackoff": "50ms"}`)
+	backoffOnly := write("backoff.json", `{"URLs": ["http://file:3000/"], "RetryBackoff": "50ms"}`)
+	flagURLs := "http://flag:3000"
+
+	tests := []struct {
+		name    string
+		env     string
+		config  string
+		flag    *string
+		urls    []string
+		retries int
+		backoff time.Duration
+	}{
+		{"default", "", "", nil, []string{ServicesUrl}, defaultRegistryRetries, defaultRetryBackoff},
+		{"file", "", noRetry, nil, []string{"http://file:3000/services"}, 0, 50 * time.Millisecond},
+		{"file without Retries", "", backoffOnly, nil, []string{"http://file:3000/services"}, defaultRegistryRetries, 50 * time.Millisecond},
+		{"env over file", "http://env:3000,http://env:3001/services", noRetry, nil,
+			[]string{"http://env:3000/services", "http://env:3001/services"}, 0, 50 * time.Millisecond},
+		{"flag over env", "http://env:3000", "", &flagURLs, []string{"http://flag:3000/services"}, defaultRegistryRetries, defaultRetryBackoff},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			withRegistryURLs(t)
+			t.Setenv("REGISTRY_URLS", test.env)
+			t.Setenv("REGISTRY_CONFIG", test.config)
+			registryFlags.urls = test.flag
+			if err := ConfigureRegistry(); err != nil {
+				t.Fatal(err)
+			}
+			if urls := registryEndpoints(); !reflect.DeepEqual(urls, test.urls) {
+				t.Errorf("urls = %v, want %v", urls, test.urls)
+			}
+			if retries, backoff := registryRetry(); retries != test.retries || backoff != test.backoff {
+				t.Errorf("retries = %d, backoff = %v; want %d, %v", retries, backoff, test.retries, test.backoff)
+			}
+		})
+	}
+
+	withRegistryURLs(t)
+	t.Setenv("REGISTRY_CONFIG", write("negative.json", `{"Retries": -1}`))
+	if err := ConfigureRegistry(); err == nil {
+		t.Fatal("negative Retries accepted")
+	}
+}
+
+// 连不上的、返回 503 的节点都跳过，同一个注册请求（同一个实例 ID）发给下一个节点，之后先试成功的那个
+func TestCallRegistryFailover(t *testing.T) {
+	withRegistryURLs(t)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	seen := make(chan string, 10)
+	record := func(code int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var reg Registration
+			json.NewDecoder(r.Body).Decode(&reg)
+			seen <- r.Host + " " + reg.InstanceID
+			w.WriteHeader(code)
+			if code == http.StatusOK {
+				json.NewEncoder(w).Encode(registrationResult{InstanceID: reg.InstanceID})
+			}
+		}))
+	}
+	unavailable := record(http.StatusServiceUnavailable)
+	defer unavailable.Close()
+	ok := record(http.StatusOK)
+	defer ok.Close()
+	SetRegistryURLs(down.URL+"/services", unavailable.URL+"/services", ok.URL+"/services")
+	SetRegistryRetry(0, 0)
+
+	r := Registration{ServiceName: GradingService, ServiceURL: "http://failover-test", InstanceID: "grading-1"}
+	t.Cleanup(func() {
+		instances.mutex.Lock()
+		delete(instances.regs, r.ServiceURL)
+		instances.mutex.Unlock()
+	})
+	if err := register(r); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{unavailable.Listener.Addr().String() + " grading-1", ok.Listener.Addr().String() + " grading-1"}
+	for _, w := range want {
+		if got := <-seen; got != w {
+			t.Fatalf("request reached %q, want %q", got, w)
+		}
+	}
+	if first := registryEndpoints()[0]; first != ok.URL+"/services" {
+		t.Fatalf("preferred endpoint = %s, want the one that answered", first)
+	}
+
+	// 所有节点都不可用：不重试时每个节点只试一次
+	SetRegistryURLs(down.URL+"/services", unavailable.URL+"/services")
+	if err := register(r); !errors.Is(err, errRegistryUnreachable) {
+		t.Fatalf("err = %v, want errRegistryUnreachable", err)
+	}
+	if len(seen) != 1 {
+		t.Fatalf("%d requests with retries disabled, want 1", len(seen))
+	}
+	<-seen
+	SetRegistryRetry(1, time.Millisecond)
+	register(r)
+	if len(seen) != 2 {
+		t.Fatalf("%d requests with one retry, want 2", len(seen))
+	}
+}
+
+// 收到请求却一直不响应的节点，等够 RequestTimeout 就换下一个节点，不会一直卡住
+func TestCallRegistryTimeout(t *testing.T) {
+	withRegistryURLs(t)
+	dir := t.TempDir()
+	config := filepath.Join(dir, "registry.json")
+	if err := ioutil.WriteFile(config, []byte(`{"RequestTimeout": "100ms"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("REGISTRY_CONFIG", config)
+	if err := ConfigureRegistry(); err != nil {
+		t.Fatal(err)
+	}
+	if timeout := registryTimeout(); timeout != 100*time.Millisecond {
+		t.Fatalf("RequestTimeout = %v, want 100ms from the config file", timeout)
+	}
+
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+	defer hung.Close()
+	defer close(release)
+	answered := make(chan string, 1)
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reg Registration
+		json.NewDecoder(r.Body).Decode(&reg)
+		answered <- reg.InstanceID
+		json.NewEncoder(w).Encode(registrationResult{InstanceID: reg.InstanceID})
+	}))
+	defer ok.Close()
+	SetRegistryURLs(hung.URL+"/services", ok.URL+"/services")
+	SetRegistryRetry(0, 0)
+
+	r := Registration{ServiceName: GradingService, ServiceURL: "http://timeout-test", InstanceID: "grading-1"}
+	t.Cleanup(func() {
+		instances.mutex.Lock()
+		delete(instances.regs, r.ServiceURL)
+		instances.mutex.Unlock()
+	})
+	done := make(chan error, 1)
+	go func() { done <- register(r) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("register still waiting on the hung node")
+	}
+	if id := <-answered; id != "grading-1" {
+		t.Fatalf("next node got %q, want grading-1", id)
+	}
+	if first := registryEndpoints()[0]; first != ok.URL+"/services" {
+		t.Fatalf("preferred endpoint = %s, want the one that answered", first)
+	}
+}
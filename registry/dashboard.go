@@ -0,0 +1,95 @@
+/*
+	注册中心的网页控制台：GET /dashboard
+	- 所有服务和实例：状态、版本、标签、最近心跳、最近几次健康检查
+	- 依赖关系（同 /services/graph）、最近的注册表变化和每个订阅方的 patch 投递情况
+	- 每个实例可以注销、进入/退出维护；启用了认证的话要在页面上填管理员的密钥（Admin.key）
+	默认每 5 秒刷新一次，?refresh=0 不自动刷新；集群模式下转发给 leader，健康检查的记录只在 leader 上
+*/
+package registry
+
+import (
+	_ "embed"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	dashboardRefresh = 5  // 秒
+	dashboardEvents  = 50 // 页面上显示最近多少个变化
+)
+
+//go:embed dashboard.html
+var dashboardHTML string
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return time.Since(t).Round(time.Second).String() + " ago"
+	},
+	"clock": func(t time.Time) string {
+		return t.Format("15:04:05")
+	},
+	"ms": func(d time.Duration) string {
+		return strconv.FormatInt(d.Milliseconds(), 10) + "ms"
+	},
+}).Parse(dashboardHTML))
+
+type dashboardData struct {
+	Services    []serviceInfo
+	Graph       serviceGraph
+	Events      []watchEvent // 最新的在前
+	Deliveries  []subscriberInfo
+	Revision    uint64
+	Refresh     int
+	AuthEnabled bool
+}
+
+func (r *registry) dashboard(refresh int) dashboardData {
+	data := dashboardData{
+		Services:   r.catalog(nil),
+		Graph:      r.graph(),
+		Deliveries: r.deliveryInfo(),
+		Refresh:    refresh,
+	}
+	r.mutex.RLock()
+	data.Revision = r.index
+	for i := len(r.events) - 1; i >= 0 && len(data.Events) < dashboardEvents; i-- {
+		data.Events = append(data.Events, r.events[i])
+	}
+	r.mutex.RUnlock()
+	registryKeys.mutex.RLock()
+	data.AuthEnabled = registryKeys.keys != nil
+	registryKeys.mutex.RUnlock()
+	return data
+}
+
+type DashboardService struct{}
+
+func (s DashboardService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if reg.forwardToLeader(w, r) {
+		return
+	}
+	refresh := dashboardRefresh
+	if value := r.URL.Query().Get("refresh"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		refresh = n
+	}
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	err := dashboardTemplate.Execute(w, reg.dashboard(refresh))
+	if err != nil {
+		log.Println(err)
+	}
+}
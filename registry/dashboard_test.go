@@ -0,0 +1,44 @@
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// 控制台能渲染出服务、实例、依赖和最近的变化；refresh 不合法时返回 400
+func TestDashboardRender(t *testing.T) {
+	r := grading("dashboard-1")
+	r.RequiredServices = []ServiceName{LogService}
+	reg.apply(walEntry{Op: opAdd, Registration: r})
+	defer reg.remove(r.InstanceID)
+
+	w := httptest.NewRecorder()
+	DashboardService{}.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dashboard?refresh=0", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("GET /dashboard: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	body := w.Body.String()
+	for _, want := range []string{string(GradingService), r.ServiceURL, `data-action="deregister"`, `data-id="dashboard-1"`, string(LogService)} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("dashboard is missing %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "location.reload(); }, ") {
+		t.Fatal("refresh=0 still reloads the page")
+	}
+
+	for _, target := range []string{"/dashboard?refresh=-1", "/dashboard?refresh=x"} {
+		w := httptest.NewRecorder()
+		DashboardService{}.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("GET %s: %d, want 400", target, w.Code)
+		}
+	}
+	w = httptest.NewRecorder()
+	DashboardService{}.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/dashboard", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST /dashboard: %d, want 405", w.Code)
+	}
+}
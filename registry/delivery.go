@@ -0,0 +1,303 @@
+/*
+	patch 的投递队列，每个订阅方（ServiceUpdateUrl）一个
+	- notify 只把 patch 放进队列，每个队列一个 goroutine 按 Revision 的顺序逐个发送，前一个送到了才发下一个
+	- 发送失败按指数退避重试（deliveryMinBackoff 起，最多 deliveryMaxBackoff），
+	  同一个 patch 连续失败 deliveryMaxAttempts 次进入 dead-letter，订阅方进入 dead 状态
+	- dead 状态下后面的 patch 每个只试一次，有一个送到了就恢复；订阅方重新注册时拿到全量数据，队列里更旧的 patch 直接丢掉
+	- 丢掉的 patch 不会让依赖方一直用着已经不在的实例：心跳检查会带上最后发给它的 Revision，客户端发现落后了就拉全量
+	- 订阅方注销后队列清空，不再重试
+		GET /services/deliveries   每个订阅方的队列长度、状态、投递次数、失败次数、平均延迟和最近的 dead-letter
+*/
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	deliveryMinBackoff  = 200 * time.Millisecond
+	deliveryMaxBackoff  = 30 * time.Second
+	deliveryMaxAttempts = 8    // 一个 patch 连续失败这么多次进入 dead-letter
+	deliveryMaxQueue    = 1000 // 队列满了丢最旧的
+	maxDeadLetters      = 100  // 每个订阅方保留最近多少个 dead-letter
+)
+
+const (
+	deliveryActive   = "active"
+	deliveryRetrying = "retrying" // 队头的 patch 正在退避重试
+	deliveryDead     = "dead"
+)
+
+type queuedPatch struct {
+	seq      uint64
+	patch    patch
+	to       Registration
+	enqueued time.Time
+	attempts int
+}
+
+type deadLetter struct {
+	Revision uint64
+	Enqueued time.Time
+	Attempts int
+	Error    string
+}
+
+type deliveryStats struct {
+	Enqueued     uint64
+	Delivered    uint64
+	Attempts     uint64 // 包括重试
+	Failures     uint64
+	DeadLettered uint64
+	Dropped      uint64    // 队列满了或者被全量数据取代而丢掉的
+	LastError    string    `json:",omitempty"`
+	LastDelivery time.Time `json:",omitempty"`
+	latency      time.Duration
+}
+
+type subscriber struct {
+	url         string
+	service     ServiceName
+	queue       []queuedPatch
+	deadLetters []deadLetter
+	state       string
+	running     bool // 有没有 goroutine 在发这个队列
+	stats       deliveryStats
+}
+
+type deliveryQueues struct {
+	subscribers map[string]*subscriber // ServiceUpdateUrl -> 订阅方
+	seq         uint64
+	minBackoff  time.Duration // 这三个默认是 deliveryMinBackoff、deliveryMaxBackoff 和 deliveryMaxAttempts
+	maxBackoff  time.Duration
+	maxAttempts int
+	mutex       *sync.Mutex
+}
+
+// 查询接口返回的
+type subscriberInfo struct {
+	URL         string
+	Service     ServiceName
+	State       string
+	QueueLength int
+	AvgLatency  time.Duration // 从进队列到送到
+	deliveryStats
+	DeadLetters []deadLetter
+}
+
+func newDeliveryQueues() *deliveryQueues {
+	return &deliveryQueues{
+		subscribers: make(map[string]*subscriber),
+		minBackoff:  deliveryMinBackoff,
+		maxBackoff:  deliveryMaxBackoff,
+		maxAttempts: deliveryMaxAttempts,
+		mutex:       new(sync.Mutex),
+	}
+}
+
+// 放进 to 的队列，没有 goroutine 在发的话启动一个；notify 持有 r.mutex 时调用，这里不能再去拿 r.mutex
+func (r *registry) enqueuePatch(p patch, to Registration) {
+	d := r.deliveries
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	s, ok := d.subscribers[to.ServiceUpdateUrl]
+	if !ok {
+		s = &subscriber{url: to.ServiceUpdateUrl, state: deliveryActive}
+		d.subscribers[to.ServiceUpdateUrl] = s
+	}
+	s.service = to.ServiceName
+	if len(s.queue) >= deliveryMaxQueue {
+		dropped := s.queue[0]
+		s.queue = s.queue[1:]
+		s.stats.Dropped++
+		s.addDeadLetter(dropped, "queue full")
+	}
+	d.seq++
+	s.queue = append(s.queue, queuedPatch{seq: d.seq, patch: p, to: to, enqueued: time.Now()})
+	s.stats.Enqueued++
+	if !s.running {
+		s.running = true
+		go r.deliver(s)
+	}
+}
+
+// 订阅方拿到了 Revision 为 revision 的全量数据，队列里不比它新的 patch 都不用发了
+func (r *registry) resetDelivery(url string, revision uint64) {
+	d := r.deliveries
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	s, ok := d.subscribers[url]
+	if !ok {
+		return
+	}
+	queue := make([]queuedPatch, 0, len(s.queue))
+	for _, q := range s.queue {
+		if q.patch.Revision > revision {
+			queue = append(queue, q)
+		} else {
+			s.stats.Dropped++
+		}
+	}
+	s.queue = queue
+	s.state = deliveryActive
+}
+
+// 调用方需持有 d.mutex
+func (s *subscriber) addDeadLetter(q queuedPatch, reason string) {
+	s.deadLetters = append(s.deadLetters, deadLetter{Revision: q.patch.Revision, Enqueued: q.enqueued, Attempts: q.attempts, Error: reason})
+	if len(s.deadLetters) > maxDeadLetters {
+		s.deadLetters = s.deadLetters[len(s.deadLetters)-maxDeadLetters:]
+	}
+}
+
+// 有没有实例还在用这个 ServiceUpdateUrl
+func (r *registry) subscribed(url string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, reg := range r.registrations {
+		if reg.ServiceUpdateUrl == url {
+			return true
+		}
+	}
+	return false
+}
+
+// 按顺序发 s 的队列，发完就退出，下次有 patch 进来再启动
+func (r *registry) deliver(s *subscriber) {
+	d := r.deliveries
+	backoff := d.minBackoff
+	for {
+		d.mutex.Lock()
+		if len(s.queue) == 0 {
+			s.running = false
+			d.mutex.Unlock()
+			return
+		}
+		item := s.queue[0]
+		d.mutex.Unlock()
+
+		if !r.subscribed(s.url) { // 已经注销了，不用再发
+			d.mutex.Lock()
+			s.stats.Dropped += uint64(len(s.queue))
+			s.queue = nil
+			s.running = false
+			delete(d.subscribers, s.url)
+			d.mutex.Unlock()
+			return
+		}
+
+		err := r.postPatch(item.patch, item.to)
+		now := time.Now()
+		d.mutex.Lock()
+		s.stats.Attempts++
+		current := len(s.queue) > 0 && s.queue[0].seq == item.seq // 发送期间可能被 resetDelivery 丢掉了
+		item.attempts++
+		if current {
+			s.queue[0].attempts = item.attempts
+		}
+		if err == nil {
+			if current {
+				s.queue = s.queue[1:]
+			}
+			s.state = deliveryActive
+			s.stats.Delivered++
+			s.stats.LastDelivery = now
+			s.stats.latency += now.Sub(item.enqueued)
+			d.mutex.Unlock()
+			backoff = d.minBackoff
+			recordAudit(patchAudit(item, nil))
+			continue
+		}
+
+		s.stats.Failures++
+		s.stats.LastError = err.Error()
+		if !current {
+			d.mutex.Unlock()
+			continue
+		}
+		if s.state == deliveryDead || item.attempts >= d.maxAttempts {
+			s.queue = s.queue[1:]
+			s.state = deliveryDead
+			s.stats.DeadLettered++
+			s.addDeadLetter(item, err.Error())
+			d.mutex.Unlock()
+			log.Printf("[Delivery] Dead-lettered patch %d for %s after %d attempts: %v", item.patch.Revision, s.url, item.attempts, err)
+			recordAudit(patchAudit(item, err))
+			continue
+		}
+		s.state = deliveryRetrying
+		wait := backoff
+		d.mutex.Unlock()
+		log.Printf("[Delivery] Patch %d for %s failed (attempt %d), retrying in %v: %v", item.patch.Revision, s.url, item.attempts, wait, err)
+		time.Sleep(wait)
+		backoff *= 2
+		if backoff > d.maxBackoff {
+			backoff = d.maxBackoff
+		}
+	}
+}
+
+// 一个 patch 的最终结果：送到了，或者进了 dead-letter
+func patchAudit(item queuedPatch, err error) auditEvent {
+	delivered := err == nil
+	p, to := item.patch, item.to
+	e := auditEvent{
+		Type:       auditPatch,
+		Service:    to.ServiceName,
+		InstanceID: to.InstanceID,
+		URL:        to.ServiceUpdateUrl,
+		Actor:      actorRegistry,
+		Reason:     fmt.Sprintf("added %d, removed %d, changed %d", len(p.Added), len(p.Removed), len(p.Changed)),
+		Revision:   p.Revision,
+		Target:     to.ServiceName,
+		Delivered:  &delivered,
+		Attempts:   item.attempts,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+func (r *registry) deliveryInfo() []subscriberInfo {
+	d := r.deliveries
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	result := make([]subscriberInfo, 0, len(d.subscribers))
+	for _, s := range d.subscribers {
+		info := subscriberInfo{
+			URL:           s.url,
+			Service:       s.service,
+			State:         s.state,
+			QueueLength:   len(s.queue),
+			deliveryStats: s.stats,
+			DeadLetters:   append([]deadLetter(nil), s.deadLetters...),
+		}
+		if s.stats.Delivered > 0 {
+			info.AvgLatency = s.stats.latency / time.Duration(s.stats.Delivered)
+		}
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].URL < result[j].URL })
+	return result
+}
+
+func (s RegistrationService) serveDeliveries(w http.ResponseWriter, r *http.Request) {
+	if reg.forwardToLeader(w, r) { // 只有 leader 在发 patch
+		return
+	}
+	data, err := json.Marshal(reg.deliveryInfo())
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(data)
+}
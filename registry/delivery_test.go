@@ -0,0 +1,166 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记下收到的每个 patch，fail 返回 true 时回 500
+type patchReceiver struct {
+	srv      *httptest.Server
+	received []uint64    // 送到的 Revision
+	attempts []time.Time // 每次收到请求的时间，包括失败的
+	fail     func(revision uint64, attempt int) bool
+	mutex    *sync.Mutex
+}
+
+func newPatchReceiver(t *testing.T, fail func(revision uint64, attempt int) bool) *patchReceiver {
+	pr := &patchReceiver{fail: fail, mutex: new(sync.Mutex)}
+	pr.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p patch
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		pr.mutex.Lock()
+		defer pr.mutex.Unlock()
+		pr.attempts = append(pr.attempts, time.Now())
+		if pr.fail(p.Revision, len(pr.attempts)) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		pr.received = append(pr.received, p.Revision)
+	}))
+	t.Cleanup(pr.srv.Close)
+	return pr
+}
+
+func (pr *patchReceiver) snapshot() ([]uint64, []time.Time) {
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	return append([]uint64(nil), pr.received...), append([]time.Time(nil), pr.attempts...)
+}
+
+// 注册一个订阅方，投递的退避调小
+func deliveryTestRegistry(t *testing.T, url string) (*registry, Registration) {
+	log.SetOutput(ioutil.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	r := newRegistry()
+	r.deliveries.minBackoff = 20 * time.Millisecond
+	r.deliveries.maxBackoff = 50 * time.Millisecond
+	r.deliveries.maxAttempts = 3
+	to := Registration{ServiceName: PortalService, ServiceURL: url, ServiceUpdateUrl: url, InstanceID: "portal-1"}
+	r.registrations = append(r.registrations, to)
+	return r, to
+}
+
+func subscriberOf(r *registry, url string) subscriberInfo {
+	for _, info := range r.deliveryInfo() {
+		if info.URL == url {
+			return info
+		}
+	}
+	return subscriberInfo{}
+}
+
+// 队头的 patch 失败时后面的等着，重试间隔按指数增长，送到的顺序和 Revision 一致
+func TestDeliveryOrderAndBackoff(t *testing.T) {
+	pr := newPatchReceiver(t, func(revision uint64, attempt int) bool { return attempt <= 3 })
+	r, to := deliveryTestRegistry(t, pr.srv.URL)
+	r.deliveries.maxAttempts = 5
+	for revision := uint64(1); revision <= 5; revision++ {
+		r.enqueuePatch(patch{Revision: revision}, to)
+	}
+	waitFor(t, "all patches delivered", func() bool {
+		received, _ := pr.snapshot()
+		return len(received) == 5
+	})
+	received, attempts := pr.snapshot()
+	if fmt.Sprint(received) != "[1 2 3 4 5]" {
+		t.Fatalf("delivered %v, want [1 2 3 4 5]", received)
+	}
+	for i, want := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond} {
+		if gap := attempts[i+1].Sub(attempts[i]); gap < want {
+			t.Errorf("retry %d after %v, want at least %v", i+1, gap, want)
+		}
+	}
+	info := subscriberOf(r, to.ServiceUpdateUrl)
+	if info.State != deliveryActive || info.Delivered != 5 || info.Failures != 3 || info.Attempts != 8 || info.QueueLength != 0 {
+		t.Fatalf("subscriber = %+v", info)
+	}
+}
+
+// 连续失败 maxAttempts 次进入 dead-letter；dead 状态下后面的只试一次，有一个送到就恢复
+func TestDeliveryDeadLetter(t *testing.T) {
+	down := true
+	var mutex sync.Mutex
+	pr := newPatchReceiver(t, func(uint64, int) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return down
+	})
+	r, to := deliveryTestRegistry(t, pr.srv.URL)
+	r.enqueuePatch(patch{Revision: 1}, to)
+	r.enqueuePatch(patch{Revision: 2}, to)
+	waitFor(t, "both patches dead-lettered", func() bool {
+		return subscriberOf(r, to.ServiceUpdateUrl).DeadLettered == 2
+	})
+	info := subscriberOf(r, to.ServiceUpdateUrl)
+	if info.State != deliveryDead || info.Attempts != 4 || len(info.DeadLetters) != 2 {
+		t.Fatalf("subscriber = %+v, want dead after 3 attempts on patch 1 and 1 on patch 2", info)
+	}
+	if dl := info.DeadLetters[0]; dl.Revision != 1 || dl.Attempts != 3 || dl.Error == "" {
+		t.Fatalf("dead letter = %+v", dl)
+	}
+	if dl := info.DeadLetters[1]; dl.Revision != 2 || dl.Attempts != 1 {
+		t.Fatalf("dead letter = %+v", dl)
+	}
+
+	mutex.Lock()
+	down = false
+	mutex.Unlock()
+	r.enqueuePatch(patch{Revision: 3}, to)
+	waitFor(t, "patch 3 delivered", func() bool {
+		return subscriberOf(r, to.ServiceUpdateUrl).Delivered == 1
+	})
+	if info := subscriberOf(r, to.ServiceUpdateUrl); info.State != deliveryActive {
+		t.Fatalf("state after a delivery = %s, want active", info.State)
+	}
+	if received, _ := pr.snapshot(); fmt.Sprint(received) != "[3]" {
+		t.Fatalf("delivered %v, want [3]", received)
+	}
+}
+
+// 订阅方注销后队列清空，不再重试；拿到全量数据后更旧的 patch 不再发
+func TestDeliveryDropsStalePatches(t *testing.T) {
+	r, to := deliveryTestRegistry(t, "http://127.0.0.1:1")
+	d := r.deliveries
+	d.mutex.Lock()
+	d.subscribers[to.ServiceUpdateUrl] = &subscriber{url: to.ServiceUpdateUrl, state: deliveryRetrying, running: true}
+	d.mutex.Unlock()
+	for revision := uint64(1); revision <= 4; revision++ {
+		r.enqueuePatch(patch{Revision: revision}, to) // running 为 true，不会启动 goroutine
+	}
+	r.resetDelivery(to.ServiceUpdateUrl, 2)
+	info := subscriberOf(r, to.ServiceUpdateUrl)
+	if info.QueueLength != 2 || info.Dropped != 2 || info.State != deliveryActive {
+		t.Fatalf("after reset to 2: %+v", info)
+	}
+
+	d.mutex.Lock()
+	s := d.subscribers[to.ServiceUpdateUrl]
+	d.mutex.Unlock()
+	r.registrations = nil
+	r.deliver(s)
+	if info := subscriberOf(r, to.ServiceUpdateUrl); info.URL != "" {
+		t.Fatalf("unsubscribed queue still there: %+v", info)
+	}
+}
@@ -0,0 +1,434 @@
+/*
+	内置的 DNS 接口，给 curl 脚本和其他语言写的程序用
+	注册中心用 -dns 127.0.0.1:8600 启动后，在这个 UDP 端口上回答（服务名不区分大小写，domain 默认 service.local）
+	- A/AAAA  gradingservice.service.local                          所有可用实例的地址
+	- SRV     _gradingservice._tcp.service.local                    所有可用实例的端口，target 是下面这种名字，地址放在附加段
+	- A/AAAA  <InstanceID>.gradingservice.service.local              某个实例的地址
+	只返回可用的实例（critical、quarantined 的不返回），TTL 跟着健康状态走：
+	passing 的缓存 dnsTTLPassing 秒，warning 的不缓存并且 SRV 优先级排在后面
+	集群模式下每个节点都用自己的注册表回答，健康状态通过 opStatus 复制过来
+		dig @127.0.0.1 -p 8600 _gradingservice._tcp.service.local SRV
+*/
+package registry
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsTypeOPT  = 41
+	dnsTypeANY  = 255
+	dnsClassIN  = 1
+
+	dnsRcodeOK       = 0
+	dnsRcodeFormErr  = 1
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotImp   = 4
+	dnsRcodeRefused  = 5
+
+	dnsFlagQR = 0x8000
+	dnsFlagAA = 0x0400
+	dnsFlagTC = 0x0200
+	dnsFlagRD = 0x0100
+
+	dnsMaxUDPSize  = 512  // 查询没有带 EDNS 时最大的响应
+	dnsMaxEDNSSize = 4096 // 带了 EDNS 时最多按这个大小回
+	dnsTTLPassing  = 5    // 秒
+	dnsTTLWarning  = 0    // warning 的实例随时可能变成 critical，不让缓存
+
+	dnsLookupTimeout = 500 * time.Millisecond // ServiceURL 里是主机名时解析它的超时
+)
+
+var errDNSFormat = errors.New("malformed dns message")
+
+type dnsQuestion struct {
+	name  string // 小写，不带最后的点
+	qtype uint16
+	class uint16
+}
+
+type dnsRecord struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+	data  []byte
+}
+
+// 一个可用实例在 DNS 里的样子
+type dnsInstance struct {
+	id       string
+	ips      []net.IP
+	port     uint16
+	ttl      uint32
+	priority uint16 // passing 的排在 warning 的前面
+}
+
+// 在 addr 上监听 UDP，后台回答 domain 下的查询；监听失败时返回错误
+func ServeDNS(addr, domain string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	log.Printf("[DNS] Answering *.%s on %s", domain, conn.LocalAddr())
+	go func() {
+		buf := make([]byte, dnsMaxEDNSSize)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			query := append([]byte(nil), buf[:n]...)
+			go func() {
+				res := reg.answerDNS(query, domain)
+				if res != nil {
+					conn.WriteTo(res, from)
+				}
+			}()
+		}
+	}()
+	return nil
+}
+
+// 解析查询并生成响应，连头部都解析不了的包不回答
+func (r *registry) answerDNS(query []byte, domain string) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+	id := binary.BigEndian.Uint16(query[0:])
+	flags := binary.BigEndian.Uint16(query[2:])
+	if flags&dnsFlagQR != 0 { // 是响应不是查询
+		return nil
+	}
+	res := dnsResponse{id: id, flags: dnsFlagQR | dnsFlagAA | flags&(0xF<<11|dnsFlagRD), maxSize: dnsMaxUDPSize}
+	if opcode := flags >> 11 & 0xF; opcode != 0 {
+		res.rcode = dnsRcodeNotImp
+		return res.pack()
+	}
+	if binary.BigEndian.Uint16(query[4:]) != 1 { // 只支持一个问题
+		res.rcode = dnsRcodeFormErr
+		return res.pack()
+	}
+	q, offset, err := parseQuestion(query, 12)
+	if err == nil {
+		_, err = appendName(nil, q.name) // 太长的名字回答时编码不回去
+	}
+	if err != nil {
+		res.rcode = dnsRcodeFormErr
+		return res.pack()
+	}
+	res.question = &q
+	if binary.BigEndian.Uint16(query[10:]) > 0 { // 附加段里的 EDNS OPT 记录告诉我们能回多大的包
+		if size, ok := parseOPT(query, offset); ok {
+			res.edns = true
+			if size > dnsMaxUDPSize {
+				res.maxSize = int(size)
+			}
+			if res.maxSize > dnsMaxEDNSSize {
+				res.maxSize = dnsMaxEDNSSize
+			}
+		}
+	}
+	res.answers, res.additional, res.rcode = r.resolveDNS(q, domain)
+	return res.pack()
+}
+
+func (r *registry) resolveDNS(q dnsQuestion, domain string) (answers, additional []dnsRecord, rcode int) {
+	if q.class == dnsClassIN && q.name == domain { // domain 本身存在，只是没有记录
+		return nil, nil, dnsRcodeOK
+	}
+	if q.class != dnsClassIN || !strings.HasSuffix(q.name, "."+domain) {
+		return nil, nil, dnsRcodeRefused // 不是我们负责的名字，包括根
+	}
+	labels := strings.Split(strings.TrimSuffix(q.name, "."+domain), ".")
+	switch {
+	case len(labels) == 2 && strings.HasPrefix(labels[0], "_") && labels[1] == "_tcp": // _service._tcp
+		service := strings.TrimPrefix(labels[0], "_")
+		instances, ok := r.dnsInstances(service)
+		if !ok {
+			return nil, nil, dnsRcodeNXDomain
+		}
+		if q.qtype != dnsTypeSRV && q.qtype != dnsTypeANY {
+			return nil, nil, dnsRcodeOK
+		}
+		for _, inst := range instances {
+			target := inst.id + "." + service + "." + domain
+			answers = append(answers, dnsRecord{name: q.name, rtype: dnsTypeSRV, ttl: inst.ttl, data: srvData(inst, target)})
+			additional = append(additional, addressRecords(target, dnsTypeANY, inst)...)
+		}
+		return answers, additional, dnsRcodeOK
+	case len(labels) == 1: // service
+		instances, ok := r.dnsInstances(labels[0])
+		if !ok {
+			return nil, nil, dnsRcodeNXDomain
+		}
+		seen := make(map[string]bool) // 同一台机器上的多个实例只返回一次地址
+		for _, inst := range instances {
+			for _, rec := range addressRecords(q.name, q.qtype, inst) {
+				if !seen[string(rec.data)] {
+					seen[string(rec.data)] = true
+					answers = append(answers, rec)
+				}
+			}
+		}
+		return answers, nil, dnsRcodeOK
+	case len(labels) == 2: // id.service
+		instances, _ := r.dnsInstances(labels[1])
+		for _, inst := range instances {
+			if inst.id == labels[0] {
+				return addressRecords(q.name, q.qtype, inst), nil, dnsRcodeOK
+			}
+		}
+	}
+	return nil, nil, dnsRcodeNXDomain
+}
+
+/*
+	service 这个服务（小写）现在可用的实例，第二个返回值表示有没有这个服务
+	ServiceURL 里是主机名的话在锁外面解析，解析不出来的实例跳过
+*/
+func (r *registry) dnsInstances(service string) ([]dnsInstance, bool) {
+	type target struct {
+		id     string
+		host   string
+		port   uint16
+		status string
+	}
+	r.mutex.RLock()
+	known := false
+	targets := make([]target, 0)
+	for _, reg := range r.registrations {
+		if strings.ToLower(string(reg.ServiceName)) != service {
+			continue
+		}
+		known = true
+		e := r.entry(reg)
+		if !usable(e) {
+			continue
+		}
+		id := strings.ToLower(reg.InstanceID)
+		if len(id) == 0 || len(id) > 63 || strings.Contains(id, ".") { // 放不进一个 DNS label
+			continue
+		}
+		u, err := url.Parse(reg.ServiceURL)
+		if err != nil {
+			continue
+		}
+		port := u.Port()
+		if port == "" {
+			port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+		}
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			continue
+		}
+		targets = append(targets, target{id: id, host: u.Hostname(), port: uint16(p), status: e.Status})
+	}
+	r.mutex.RUnlock()
+
+	instances := make([]dnsInstance, 0, len(targets))
+	for _, t := range targets {
+		ips := lookupHost(t.host)
+		if len(ips) == 0 {
+			continue
+		}
+		inst := dnsInstance{id: t.id, ips: ips, port: t.port, ttl: dnsTTLPassing, priority: 1}
+		if t.status == statusWarning {
+			inst.ttl, inst.priority = dnsTTLWarning, 2
+		}
+		instances = append(instances, inst)
+	}
+	return instances, known
+}
+
+func lookupHost(host string) []net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	if strings.EqualFold(host, "localhost") {
+		return []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		log.Printf("[DNS] Failed to resolve %s: %v", host, err)
+		return nil
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips
+}
+
+// qtype 为 dnsTypeANY 时 A 和 AAAA 都要
+func addressRecords(name string, qtype uint16, inst dnsInstance) []dnsRecord {
+	records := make([]dnsRecord, 0, len(inst.ips))
+	for _, ip := range inst.ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			if qtype == dnsTypeA || qtype == dnsTypeANY {
+				records = append(records, dnsRecord{name: name, rtype: dnsTypeA, ttl: inst.ttl, data: ip4})
+			}
+		} else if qtype == dnsTypeAAAA || qtype == dnsTypeANY {
+			records = append(records, dnsRecord{name: name, rtype: dnsTypeAAAA, ttl: inst.ttl, data: ip.To16()})
+		}
+	}
+	return records
+}
+
+func srvData(inst dnsInstance, target string) []byte {
+	data := make([]byte, 6)
+	binary.BigEndian.PutUint16(data[0:], inst.priority)
+	binary.BigEndian.PutUint16(data[2:], 1) // 同一优先级的实例权重都一样
+	binary.BigEndian.PutUint16(data[4:], inst.port)
+	name, _ := appendName(nil, target)
+	return append(data, name...)
+}
+
+// 从 offset 开始解析一个问题，返回问题和它之后的位置；问题里不应该有压缩指针
+func parseQuestion(msg []byte, offset int) (dnsQuestion, int, error) {
+	labels := make([]string, 0)
+	for {
+		if offset >= len(msg) {
+			return dnsQuestion{}, 0, errDNSFormat
+		}
+		n := int(msg[offset])
+		offset++
+		if n == 0 {
+			break
+		}
+		if n > 63 || offset+n > len(msg) {
+			return dnsQuestion{}, 0, errDNSFormat
+		}
+		label := strings.ToLower(string(msg[offset : offset+n]))
+		if strings.Contains(label, ".") { // 用点连起来的名字表示不了，回答时也编码不回去
+			return dnsQuestion{}, 0, errDNSFormat
+		}
+		labels = append(labels, label)
+		offset += n
+	}
+	if offset+4 > len(msg) {
+		return dnsQuestion{}, 0, errDNSFormat
+	}
+	q := dnsQuestion{
+		name:  strings.Join(labels, "."),
+		qtype: binary.BigEndian.Uint16(msg[offset:]),
+		class: binary.BigEndian.Uint16(msg[offset+2:]),
+	}
+	return q, offset + 4, nil
+}
+
+// 附加段的第一条如果是 OPT 记录，返回对方能接收的 UDP 包大小
+func parseOPT(msg []byte, offset int) (uint16, bool) {
+	// OPT 的名字是根（一个 0 字节），后面是 type 和 class，class 就是包大小
+	if offset+5 > len(msg) || msg[offset] != 0 || binary.BigEndian.Uint16(msg[offset+1:]) != dnsTypeOPT {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(msg[offset+3:]), true
+}
+
+// 编码一个名字，根（空字符串或者 "."）只有一个 0 字节；名字不合法时 b 原样返回
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.Trim(name, ".")
+	if name == "" {
+		return append(b, 0), nil
+	}
+	if len(name) > 253 {
+		return b, errDNSFormat
+	}
+	encoded := b
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return b, errDNSFormat
+		}
+		encoded = append(encoded, byte(len(label)))
+		encoded = append(encoded, label...)
+	}
+	return append(encoded, 0), nil
+}
+
+type dnsResponse struct {
+	id         uint16
+	flags      uint16
+	rcode      int
+	question   *dnsQuestion
+	answers    []dnsRecord
+	additional []dnsRecord
+	edns       bool // 查询带了 OPT，响应也带一个
+	maxSize    int
+}
+
+/*
+	装不下的时候先丢附加段，还装不下就设置 TC 让客户端改用 TCP
+	这里没有实现 TCP，客户端拿到 TC 可以换用 EDNS 加大包的大小，或者直接用注册中心的 HTTP 接口
+*/
+func (res dnsResponse) pack() []byte {
+	msg := res.build(res.answers, res.additional, 0)
+	if len(msg) > res.maxSize {
+		msg = res.build(res.answers, nil, 0)
+	}
+	if len(msg) > res.maxSize {
+		msg = res.build(nil, nil, dnsFlagTC)
+	}
+	return msg
+}
+
+func (res dnsResponse) build(answers, additional []dnsRecord, extraFlags uint16) []byte {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], res.id)
+	binary.BigEndian.PutUint16(msg[2:], res.flags|extraFlags|uint16(res.rcode))
+	if res.question != nil {
+		binary.BigEndian.PutUint16(msg[4:], 1)
+		msg, _ = appendName(msg, res.question.name)
+		msg = appendUint16(msg, res.question.qtype)
+		msg = appendUint16(msg, res.question.class)
+	}
+	binary.BigEndian.PutUint16(msg[6:], uint16(len(answers)))
+	for _, rec := range answers {
+		msg = appendRecord(msg, rec)
+	}
+	arcount := len(additional)
+	for _, rec := range additional {
+		msg = appendRecord(msg, rec)
+	}
+	if res.edns {
+		arcount++
+		msg = append(msg, 0) // 根
+		msg = appendUint16(msg, dnsTypeOPT)
+		msg = appendUint16(msg, dnsMaxEDNSSize)
+		msg = appendUint32(msg, 0)
+		msg = appendUint16(msg, 0)
+	}
+	binary.BigEndian.PutUint16(msg[10:], uint16(arcount))
+	return msg
+}
+
+func appendRecord(msg []byte, rec dnsRecord) []byte {
+	msg, _ = appendName(msg, rec.name)
+	msg = appendUint16(msg, rec.rtype)
+	msg = appendUint16(msg, dnsClassIN)
+	msg = appendUint32(msg, rec.ttl)
+	msg = appendUint16(msg, uint16(len(rec.data)))
+	return append(msg, rec.data...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
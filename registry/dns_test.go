@@ -0,0 +1,322 @@
+package registry
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// 按 RFC 1035 拼一个只有一个问题的查询，labels 为空表示根
+func dnsQuery(id uint16, qtype uint16, labels ...string) []byte {
+	msg := []byte{byte(id >> 8), byte(id), 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range labels {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = appendUint16(msg, qtype)
+	return appendUint16(msg, dnsClassIN)
+}
+
+type dnsHeader struct {
+	id                                 uint16
+	rcode                              int
+	qdcount, ancount, nscount, arcount int
+}
+
+func parseHeader(t *testing.T, msg []byte) dnsHeader {
+	t.Helper()
+	if len(msg) < 12 {
+		t.Fatalf("response too short: %d bytes", len(msg))
+	}
+	return dnsHeader{
+		id:      binary.BigEndian.Uint16(msg[0:]),
+		rcode:   int(binary.BigEndian.Uint16(msg[2:]) & 0xF),
+		qdcount: int(binary.BigEndian.Uint16(msg[4:])),
+		ancount: int(binary.BigEndian.Uint16(msg[6:])),
+		nscount: int(binary.BigEndian.Uint16(msg[8:])),
+		arcount: int(binary.BigEndian.Uint16(msg[10:])),
+	}
+}
+
+// 根和 domain 以外的名字：响应能被完整解析回来，问题原样带回，rcode 正确
+func TestDNSRoundTripOutsideDomain(t *testing.T) {
+	r := newRegistry()
+	tests := []struct {
+		name   string
+		labels []string
+		rcode  int
+	}{
+		{"root", nil, dnsRcodeRefused},
+		{"other domain", []string{"example", "com"}, dnsRcodeRefused},
+		{"domain suffix without dot", []string{"xservice", "local"}, dnsRcodeRefused},
+		{"apex", []string{"service", "local"}, dnsRcodeOK},
+		{"unknown service", []string{"nosuch", "service", "local"}, dnsRcodeNXDomain},
+	}
+	for _, tt := range tests {
+		query := dnsQuery(0x1234, dnsTypeA, tt.labels...)
+		res := r.answerDNS(query, "service.local")
+		h := parseHeader(t, res)
+		if h.id != 0x1234 || h.rcode != tt.rcode || h.qdcount != 1 || h.ancount != 0 || h.arcount != 0 {
+			t.Errorf("%s: header = %+v, want rcode %d with the question only", tt.name, h, tt.rcode)
+			continue
+		}
+		q, end, err := parseQuestion(res, 12)
+		if err != nil {
+			t.Errorf("%s: parse question: %v", tt.name, err)
+			continue
+		}
+		want, _, _ := parseQuestion(query, 12)
+		if q != want || end != len(res) {
+			t.Errorf("%s: question = %+v ending at %d, want %+v ending at %d", tt.name, q, end, want, len(res))
+		}
+	}
+}
+
+func TestAppendNameRoot(t *testing.T) {
+	for _, name := range []string{"", "."} {
+		b, err := appendName(nil, name)
+		if err != nil || len(b) != 1 || b[0] != 0 {
+			t.Errorf("appendName(%q) = %v, %v; want a single zero byte", name, b, err)
+		}
+	}
+	b, err := appendName([]byte{1}, "a..b")
+	if err == nil || len(b) != 1 {
+		t.Errorf("appendName(a..b) = %v, %v; want error and input unchanged", b, err)
+	}
+}
+
+// label 里带点的名字编码不回去，回 FORMERR 而不是半截的包
+func TestDNSDottedLabel(t *testing.T) {
+	for _, label := range []string{".", "a.b"} {
+		res := newRegistry().answerDNS(dnsQuery(7, dnsTypeA, label, "service", "local"), "service.local")
+		if h := parseHeader(t, res); h.rcode != dnsRcodeFormErr || h.qdcount != 0 || len(res) != 12 {
+			t.Errorf("%q: header = %+v (%d bytes), want FORMERR without question", label, h, len(res))
+		}
+	}
+}
+
+// 响应里的一条记录，名字都没有压缩
+type parsedRecord struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+	data  []byte
+}
+
+// 解析响应的问题之后的所有记录（回答段和附加段）
+func parseRecords(t *testing.T, msg []byte) []parsedRecord {
+	t.Helper()
+	h := parseHeader(t, msg)
+	offset := 12
+	if h.qdcount == 1 {
+		_, end, err := parseQuestion(msg, offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset = end
+	}
+	records := make([]parsedRecord, 0)
+	for i := 0; i < h.ancount+h.arcount; i++ {
+		q, end, err := parseQuestion(msg, offset) // 名字、type、class 和问题的格式一样
+		if err != nil || end+6 > len(msg) {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		n := int(binary.BigEndian.Uint16(msg[end+4:]))
+		if end+6+n > len(msg) {
+			t.Fatalf("record %d: data runs past the message", i)
+		}
+		records = append(records, parsedRecord{
+			name:  q.name,
+			rtype: q.qtype,
+			ttl:   binary.BigEndian.Uint32(msg[end:]),
+			data:  msg[end+6 : end+6+n],
+		})
+		offset = end + 6 + n
+	}
+	if offset != len(msg) {
+		t.Fatalf("%d trailing bytes", len(msg)-offset)
+	}
+	return records
+}
+
+// 两个 passing、一个 warning、一个 critical 的实例
+func dnsTestRegistry() *registry {
+	r := newRegistry()
+	for i := 0; i < 4; i++ {
+		reg := Registration{
+			ServiceName: GradingService,
+			ServiceURL:  fmt.Sprintf("http://127.0.0.%d:%d", i+1, 6000+i),
+			InstanceID:  fmt.Sprintf("G%d", i),
+		}
+		if i == 1 {
+			reg.ServiceURL = "http://[::1]:6001"
+		}
+		r.apply(walEntry{Op: opAdd, Registration: &reg})
+	}
+	r.health["G2"].Status = statusWarning
+	r.health["G3"].Status = statusCritical
+	return r
+}
+
+func TestDNSAddressRecords(t *testing.T) {
+	r := dnsTestRegistry()
+	tests := []struct {
+		qtype  uint16
+		labels []string
+		want   []string // rtype ttl ip
+	}{
+		{dnsTypeA, []string{"GradingService", "service", "local"}, []string{"1 5 127.0.0.1", "1 0 127.0.0.3"}},
+		{dnsTypeAAAA, []string{"gradingservice", "service", "local"}, []string{"28 5 ::1"}},
+		{dnsTypeANY, []string{"gradingservice", "service", "local"}, []string{"1 5 127.0.0.1", "28 5 ::1", "1 0 127.0.0.3"}},
+		{dnsTypeA, []string{"g2", "gradingservice", "service", "local"}, []string{"1 0 127.0.0.3"}},
+		{dnsTypeA, []string{"g3", "gradingservice", "service", "local"}, nil}, // critical 的不返回
+	}
+	for _, tt := range tests {
+		res := r.answerDNS(dnsQuery(1, tt.qtype, tt.labels...), "service.local")
+		h := parseHeader(t, res)
+		records := parseRecords(t, res)
+		got := make([]string, len(records))
+		for i, rec := range records {
+			got[i] = fmt.Sprintf("%d %d %s", rec.rtype, rec.ttl, net.IP(rec.data))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%v type %d: answers = %v, want %v", tt.labels, tt.qtype, got, tt.want)
+		}
+		wantRcode := dnsRcodeOK
+		if tt.want == nil {
+			wantRcode = dnsRcodeNXDomain
+		}
+		if h.rcode != wantRcode {
+			t.Errorf("%v type %d: rcode = %d, want %d", tt.labels, tt.qtype, h.rcode, wantRcode)
+		}
+	}
+}
+
+// SRV 的 target 是实例的名字，地址放在附加段；warning 的优先级排在后面
+func TestDNSSRV(t *testing.T) {
+	r := dnsTestRegistry()
+	res := r.answerDNS(dnsQuery(2, dnsTypeSRV, "_gradingservice", "_tcp", "service", "local"), "service.local")
+	h := parseHeader(t, res)
+	if h.rcode != dnsRcodeOK || h.ancount != 3 || h.arcount != 3 {
+		t.Fatalf("header = %+v, want 3 answers and 3 additional", h)
+	}
+	records := parseRecords(t, res)
+	for i, rec := range records[:3] {
+		priority := binary.BigEndian.Uint16(rec.data)
+		port := binary.BigEndian.Uint16(rec.data[4:])
+		target, end, err := parseQuestion(append(append([]byte(nil), rec.data[6:]...), 0, 0, 0, 0), 0)
+		if err != nil || end != len(rec.data)-6+4 {
+			t.Fatalf("SRV %d target: %v", i, err)
+		}
+		wantPriority := uint16(1)
+		if i == 2 {
+			wantPriority = 2
+		}
+		wantTarget := fmt.Sprintf("g%d.gradingservice.service.local", i)
+		if rec.rtype != dnsTypeSRV || priority != wantPriority || port != uint16(6000+i) || target.name != wantTarget {
+			t.Errorf("SRV %d = priority %d port %d target %s, want %d %d %s", i, priority, port, target.name, wantPriority, 6000+i, wantTarget)
+		}
+		if extra := records[3+i]; extra.name != wantTarget {
+			t.Errorf("additional %d = %s, want the address of %s", i, extra.name, wantTarget)
+		}
+	}
+
+	res = r.answerDNS(dnsQuery(3, dnsTypeA, "_gradingservice", "_tcp", "service", "local"), "service.local")
+	if h := parseHeader(t, res); h.rcode != dnsRcodeOK || h.ancount != 0 {
+		t.Errorf("A query for the SRV name: header = %+v, want an empty answer", h)
+	}
+	res = r.answerDNS(dnsQuery(4, dnsTypeSRV, "_nosuch", "_tcp", "service", "local"), "service.local")
+	if h := parseHeader(t, res); h.rcode != dnsRcodeNXDomain {
+		t.Errorf("unknown SRV: rcode = %d, want NXDOMAIN", h.rcode)
+	}
+}
+
+// 解析不了的查询回 FORMERR 或 NOTIMP，不是查询或者连头部都不全的不回答
+func TestDNSMalformedQueries(t *testing.T) {
+	r := dnsTestRegistry()
+	valid := dnsQuery(5, dnsTypeA, "gradingservice", "service", "local")
+	twoQuestions := append([]byte(nil), valid...)
+	twoQuestions[5] = 2
+	notQuery := append([]byte(nil), valid...)
+	notQuery[2] |= 0x80
+	inverse := append([]byte(nil), valid...)
+	inverse[2] |= 1 << 3 // opcode 1
+	longLabel := make([]byte, 64)
+	for i := range longLabel {
+		longLabel[i] = 'a'
+	}
+	tests := []struct {
+		name  string
+		query []byte
+		rcode int // -1 表示不回答
+	}{
+		{"short header", valid[:11], -1},
+		{"response", notQuery, -1},
+		{"truncated question", valid[:len(valid)-3], dnsRcodeFormErr},
+		{"truncated label", valid[:15], dnsRcodeFormErr},
+		{"two questions", twoQuestions, dnsRcodeFormErr},
+		{"label too long", dnsQuery(5, dnsTypeA, string(longLabel), "service", "local"), dnsRcodeFormErr},
+		{"inverse query", inverse, dnsRcodeNotImp},
+	}
+	for _, tt := range tests {
+		res := r.answerDNS(tt.query, "service.local")
+		if tt.rcode < 0 {
+			if res != nil {
+				t.Errorf("%s: answered %d bytes, want no answer", tt.name, len(res))
+			}
+			continue
+		}
+		h := parseHeader(t, res)
+		if h.id != 5 || h.rcode != tt.rcode || h.qdcount != 0 || len(res) != 12 {
+			t.Errorf("%s: header = %+v (%d bytes), want rcode %d without question", tt.name, h, len(res), tt.rcode)
+		}
+	}
+}
+
+// 没有 EDNS 时最多 512 字节：先丢附加段，还装不下就设置 TC；带了 EDNS 按对方的大小回，并带上 OPT
+func TestDNSTruncation(t *testing.T) {
+	instances := func(count int) *registry {
+		r := newRegistry()
+		for i := 0; i < count; i++ {
+			reg := Registration{ServiceName: GradingService, ServiceURL: fmt.Sprintf("http://10.0.0.%d:6000", i+1), InstanceID: fmt.Sprintf("grading-instance-%d", i)}
+			r.apply(walEntry{Op: opAdd, Registration: &reg})
+		}
+		return r
+	}
+	query := dnsQuery(6, dnsTypeSRV, "_gradingservice", "_tcp", "service", "local")
+	res := instances(4).answerDNS(query, "service.local")
+	h := parseHeader(t, res)
+	flags := binary.BigEndian.Uint16(res[2:])
+	if len(res) > dnsMaxUDPSize || flags&dnsFlagTC != 0 || h.ancount != 4 || h.arcount != 0 {
+		t.Fatalf("4 SRV records without EDNS: %d bytes, flags %#x, header %+v; want answers without additional", len(res), flags, h)
+	}
+	parseRecords(t, res)
+
+	r := instances(20)
+	res = r.answerDNS(query, "service.local")
+	h = parseHeader(t, res)
+	flags = binary.BigEndian.Uint16(res[2:])
+	if len(res) > dnsMaxUDPSize || flags&dnsFlagTC == 0 || h.ancount != 0 || h.arcount != 0 {
+		t.Fatalf("20 SRV records without EDNS: %d bytes, flags %#x, header %+v; want TC", len(res), flags, h)
+	}
+
+	edns := append([]byte(nil), query...)
+	edns[11] = 1 // ARCOUNT
+	edns = append(edns, 0)
+	edns = appendUint16(edns, dnsTypeOPT)
+	edns = appendUint16(edns, 8192) // 比我们支持的大，按 dnsMaxEDNSSize 回
+	edns = appendUint32(edns, 0)
+	edns = appendUint16(edns, 0)
+	res = r.answerDNS(edns, "service.local")
+	h = parseHeader(t, res)
+	flags = binary.BigEndian.Uint16(res[2:])
+	if len(res) > dnsMaxEDNSSize || flags&dnsFlagTC != 0 || h.ancount != 20 || h.arcount != 21 {
+		t.Fatalf("with EDNS: %d bytes, flags %#x, header %+v; want 20 answers, 20 addresses and OPT", len(res), flags, h)
+	}
+	records := parseRecords(t, res)
+	if opt := records[len(records)-1]; opt.rtype != dnsTypeOPT || opt.name != "" {
+		t.Fatalf("last additional record = %+v, want OPT", opt)
+	}
+}
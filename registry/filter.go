@@ -0,0 +1,251 @@
+/*
+	按标签、版本、元数据筛选实例
+	过滤条件用逗号分隔，所有条件都满足才算匹配，比如 "tag=primary, version>=1.2"
+		tag=primary        有 primary 标签
+		tag!=canary        没有 canary 标签
+		version>=1.2       语义化版本比较，支持 = != > >= < <=，没有版本号的实例不匹配
+		region=cn-east     元数据 region 等于 cn-east（!= 表示不等于，没有这个键也算不等于）
+*/
+package registry
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+type condition struct {
+	field string // "tag"、"version" 或者元数据的键
+	op    string
+	value string
+}
+
+type Filter []condition
+
+// 注意先匹配两个字符的运算符
+var filterOps = []string{">=", "<=", "!=", ">", "<", "="}
+
+func ParseFilter(s string) (Filter, error) {
+	f := make(Filter, 0)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		c, err := parseCondition(part)
+		if err != nil {
+			return nil, err
+		}
+		f = append(f, c)
+	}
+	return f, nil
+}
+
+func parseCondition(s string) (condition, error) {
+	i, op := -1, ""
+	for _, o := range filterOps {
+		if j := strings.Index(s, o); j > 0 && (i < 0 || j < i) {
+			i, op = j, o
+		}
+	}
+	if i < 0 {
+		return condition{}, fmt.Errorf("invalid filter condition %q", s)
+	}
+	c := condition{
+		field: strings.TrimSpace(s[:i]),
+		op:    op,
+		value: strings.TrimSpace(s[i+len(op):]),
+	}
+	switch c.field {
+	case "version":
+		if _, err := parseVersion(c.value); err != nil {
+			return condition{}, err
+		}
+	default:
+		if c.op != "=" && c.op != "!=" {
+			return condition{}, fmt.Errorf("operator %s is only supported for version in %q", c.op, s)
+		}
+	}
+	return c, nil
+}
+
+func (f Filter) Match(e patchEntry) bool {
+	for _, c := range f {
+		if !c.match(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c condition) match(e patchEntry) bool {
+	switch c.field {
+	case "tag":
+		has := false
+		for _, tag := range e.Tags {
+			if tag == c.value {
+				has = true
+			}
+		}
+		return has == (c.op == "=")
+	case "version":
+		if e.Version == "" {
+			return false
+		}
+		v, err := parseVersion(e.Version)
+		if err != nil {
+			return false
+		}
+		want, _ := parseVersion(c.value) // ParseFilter 时已经检查过
+		cmp := v.compare(want)
+		switch c.op {
+		case "=":
+			return cmp == 0
+		case "!=":
+			return cmp != 0
+		case ">":
+			return cmp > 0
+		case ">=":
+			return cmp >= 0
+		case "<":
+			return cmp < 0
+		case "<=":
+			return cmp <= 0
+		}
+		return false
+	default:
+		value, ok := e.Metadata[c.field]
+		return (ok && value == c.value) == (c.op == "=")
+	}
+}
+
+// 语义化版本 MAJOR.MINOR.PATCH[-PRERELEASE]，可以带 v 前缀，缺的部分当 0
+type version struct {
+	parts      [3]int
+	prerelease string
+}
+
+func parseVersion(s string) (version, error) {
+	var v version
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if i := strings.IndexByte(s, '+'); i >= 0 { // 构建信息不参与比较
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.prerelease = s[i+1:]
+		s = s[:i]
+	}
+	nums := strings.Split(s, ".")
+	if len(nums) > 3 {
+		return v, fmt.Errorf("invalid version %q", s)
+	}
+	for i, n := range nums {
+		x, err := strconv.Atoi(n)
+		if err != nil || x < 0 {
+			return v, fmt.Errorf("invalid version %q", s)
+		}
+		v.parts[i] = x
+	}
+	return v, nil
+}
+
+// 返回 -1、0、1；预发布版本比同号的正式版本小，预发布之间按语义化版本的规则逐段比较
+func (v version) compare(o version) int {
+	for i := range v.parts {
+		if v.parts[i] != o.parts[i] {
+			if v.parts[i] < o.parts[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case v.prerelease == o.prerelease:
+		return 0
+	case v.prerelease == "":
+		return 1
+	case o.prerelease == "":
+		return -1
+	}
+	return comparePrerelease(v.prerelease, o.prerelease)
+}
+
+// 按点分段：数字段按数值比较，数字段比字母段小，前面都相同时段少的小（rc.2 < rc.10 < rc.10.1）
+func comparePrerelease(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		x, errX := strconv.Atoi(as[i])
+		y, errY := strconv.Atoi(bs[i])
+		switch {
+		case errX == nil && errY == nil:
+			if x != y {
+				if x < y {
+					return -1
+				}
+				return 1
+			}
+		case errX == nil:
+			return -1
+		case errY == nil:
+			return 1
+		case as[i] != bs[i]:
+			if as[i] < bs[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(as) < len(bs):
+		return -1
+	case len(as) > len(bs):
+		return 1
+	}
+	return 0
+}
+
+// 注册时检查版本号、租约、健康检查配置和过滤条件是否合法
+func (reg Registration) validate() error {
+	if reg.TTL < 0 || (reg.TTL > 0 && reg.TTL < minLeaseTTL) {
+		return fmt.Errorf("invalid TTL %v, a lease must last at least %v", reg.TTL, minLeaseTTL)
+	}
+	if reg.Version != "" {
+		if _, err := parseVersion(reg.Version); err != nil {
+			return err
+		}
+	}
+	if reg.HealthCheck != nil {
+		if err := reg.HealthCheck.validate(); err != nil {
+			return err
+		}
+	}
+	for name, filter := range reg.RequiredFilters {
+		if _, err := ParseFilter(filter); err != nil {
+			return fmt.Errorf("invalid filter for %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// 这个服务是否依赖实例 e：服务名在 RequiredServices 里，并且满足对应的过滤条件
+func (reg Registration) wants(e patchEntry) bool {
+	if !reg.requires(e.Name) {
+		return false
+	}
+	filter, err := ParseFilter(reg.RequiredFilters[e.Name])
+	if err != nil { // 注册时检查过，到这里说明数据坏了，宁可不发也不能当成没有过滤
+		log.Printf("Ignoring %v for %v: %v", e.Name, reg.ServiceName, err)
+		return false
+	}
+	return filter.Match(e)
+}
+
+func (reg Registration) requires(name ServiceName) bool {
+	for _, required := range reg.RequiredServices {
+		if required == name {
+			return true
+		}
+	}
+	return false
+}
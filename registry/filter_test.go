@@ -0,0 +1,137 @@
+package registry
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   Filter
+		bad    bool
+	}{
+		{filter: "", want: Filter{}},
+		{filter: "tag=primary, version>=1.2", want: Filter{{"tag", "=", "primary"}, {"version", ">=", "1.2"}}},
+		{filter: " region != cn-east ,, tag!=canary", want: Filter{{"region", "!=", "cn-east"}, {"tag", "!=", "canary"}}},
+		{filter: "version<=v2.0.0-rc.1", want: Filter{{"version", "<=", "v2.0.0-rc.1"}}},
+		{filter: "url=http://a?x=1", want: Filter{{"url", "=", "http://a?x=1"}}}, // 值里可以再有运算符
+		{filter: "primary", bad: true},
+		{filter: "=primary", bad: true},
+		{filter: "tag>=primary", bad: true},
+		{filter: "version>=latest", bad: true},
+		{filter: "version=1.2.3.4", bad: true},
+	}
+	for _, test := range tests {
+		got, err := ParseFilter(test.filter)
+		if test.bad {
+			if err == nil {
+				t.Errorf("ParseFilter(%q) = %v, want an error", test.filter, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseFilter(%q): %v", test.filter, err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("ParseFilter(%q) = %v, want %v", test.filter, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("ParseFilter(%q) = %v, want %v", test.filter, got, test.want)
+			}
+		}
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	// 从小到大
+	ordered := []string{
+		"0.9", "1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta",
+		"1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.2", "v1.2.1", "1.10.0", "2",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			a, err := parseVersion(ordered[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := parseVersion(ordered[j])
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := a.compare(b); got != want {
+				t.Errorf("compare(%s, %s) = %d, want %d", ordered[i], ordered[j], got, want)
+			}
+		}
+	}
+	for _, same := range [][2]string{{"1.2", "1.2.0"}, {"v1", "1.0.0"}, {"1.0.0+build.5", "1.0.0"}} {
+		a, _ := parseVersion(same[0])
+		b, _ := parseVersion(same[1])
+		if a.compare(b) != 0 {
+			t.Errorf("compare(%s, %s) != 0", same[0], same[1])
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	e := patchEntry{Name: GradingService, Version: "1.3.0", Tags: []string{"primary"}, Metadata: map[string]string{"region": "cn-east"}}
+	tests := []struct {
+		filter string
+		match  bool
+	}{
+		{"", true},
+		{"tag=primary, version>=1.2", true},
+		{"tag=primary, version>=1.4", false},
+		{"tag!=canary", true},
+		{"tag!=primary", false},
+		{"version<1.3.0", false},
+		{"version>1.3.0-rc.1", true},
+		{"version!=1.3", false},
+		{"region=cn-east", true},
+		{"region!=cn-east", false},
+		{"zone!=a", true}, // 没有这个键也算不等于
+		{"zone=a", false},
+	}
+	for _, test := range tests {
+		f, err := ParseFilter(test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Match(e); got != test.match {
+			t.Errorf("%q matches %+v = %v, want %v", test.filter, e, got, test.match)
+		}
+	}
+	f, _ := ParseFilter("version>=0")
+	if f.Match(patchEntry{Name: GradingService}) {
+		t.Error("instance without a version matched a version filter")
+	}
+}
+
+// 过滤条件解析不了的时候不匹配任何实例
+func TestWantsInvalidFilter(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	e := patchEntry{Name: GradingService, Version: "1.3.0"}
+	portal := Registration{ServiceName: PortalService, RequiredServices: []ServiceName{GradingService}}
+	if !portal.wants(e) {
+		t.Fatal("instance without filter not wanted")
+	}
+	portal.RequiredFilters = map[ServiceName]string{GradingService: "version>=x"}
+	if portal.wants(e) {
+		t.Fatal("invalid filter matched")
+	}
+	if portal.wants(patchEntry{Name: LogService}) {
+		t.Fatal("service that is not required wanted")
+	}
+}
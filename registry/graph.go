@@ -0,0 +1,348 @@
+/*
+	服务依赖图
+	- 节点是服务名，边是 RequiredServices：A -> B 表示 A 依赖 B
+	- 注册时如果新的依赖关系形成环，拒绝注册（409）；依赖了没人注册过、也不在已知服务里的名字只打警告，它可能稍后才注册
+	- 用了改过名的旧服务名（比如 Portald）的，注册或者依赖时打警告，依赖图里列在 Renamed 里
+	- GET /services/graph             JSON
+	- GET /services/graph?format=dot  Graphviz DOT，可以直接 dot -Tsvg 画出当前的拓扑
+*/
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// 代码里定义过的服务名，依赖了不在这里、也没有注册过的名字多半是拼错了
+var knownServices = []ServiceName{LogService, GradingService, PortalService}
+
+// 改过名的服务：旧名字 -> 现在的名字，还在用旧名字的进程要换掉
+var renamedServices = map[ServiceName]ServiceName{"Portald": PortalService}
+
+type graphNode struct {
+	Name      ServiceName
+	Instances int // 可用的实例数，critical、quarantined 的不算
+	Known     bool
+}
+
+type graphEdge struct {
+	From      ServiceName
+	To        ServiceName
+	Available bool // To 有可用的实例
+}
+
+type serviceGraph struct {
+	Nodes   []graphNode
+	Edges   []graphEdge
+	Unknown []ServiceName   // 被依赖但没人注册过、也不是已知服务的名字
+	Renamed []ServiceName   // 还在用的旧服务名，见 renamedServices
+	Cycles  [][]ServiceName // 比如 [A B A]
+}
+
+// 服务名 -> 它依赖的服务名，同一个服务的多个实例取并集
+func dependencies(regs []Registration) map[ServiceName][]ServiceName {
+	deps := make(map[ServiceName][]ServiceName)
+	for _, reg := range regs {
+		if _, ok := deps[reg.ServiceName]; !ok {
+			deps[reg.ServiceName] = make([]ServiceName, 0)
+		}
+		for _, required := range reg.RequiredServices {
+			if !containsName(deps[reg.ServiceName], required) {
+				deps[reg.ServiceName] = append(deps[reg.ServiceName], required)
+			}
+		}
+	}
+	return deps
+}
+
+func containsName(names []ServiceName, name ServiceName) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	依赖图的强连通分量（Tarjan），只返回有环的：多于一个节点，或者节点依赖自己
+	每个节点只访问一次，分量里的名字从小到大排好
+*/
+func stronglyConnected(deps map[ServiceName][]ServiceName) [][]ServiceName {
+	names := make([]ServiceName, 0, len(deps))
+	for name := range deps {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+
+	components := make([][]ServiceName, 0)
+	index := make(map[ServiceName]int) // 访问的顺序，从 1 开始
+	low := make(map[ServiceName]int)
+	onStack := make(map[ServiceName]bool)
+	var stack []ServiceName
+	var visit func(name ServiceName)
+	visit = func(name ServiceName) {
+		index[name] = len(index) + 1
+		low[name] = index[name]
+		stack = append(stack, name)
+		onStack[name] = true
+		for _, next := range deps[name] {
+			if index[next] == 0 {
+				visit(next)
+				if low[next] < low[name] {
+					low[name] = low[next]
+				}
+			} else if onStack[next] && index[next] < low[name] {
+				low[name] = index[next]
+			}
+		}
+		if low[name] != index[name] {
+			return
+		}
+		component := make([]ServiceName, 0)
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			component = append(component, top)
+			if top == name {
+				break
+			}
+		}
+		if len(component) > 1 || containsName(deps[name], name) {
+			sort.Slice(component, func(i, j int) bool { return component[i] < component[j] })
+			components = append(components, component)
+		}
+	}
+	for _, name := range names {
+		if index[name] == 0 {
+			visit(name)
+		}
+	}
+	sort.Slice(components, func(i, j int) bool { return components[i][0] < components[j][0] })
+	return components
+}
+
+// 每个有环的强连通分量报一个环：从分量里名字最小的节点出发、最短的那个
+func findCycles(deps map[ServiceName][]ServiceName) [][]ServiceName {
+	cycles := make([][]ServiceName, 0)
+	for _, component := range stronglyConnected(deps) {
+		cycles = append(cycles, cycleThrough(deps, component, component[0]))
+	}
+	return cycles
+}
+
+// 在强连通分量 component 里找一条从 start 出发回到 start 的最短路径（广度优先），比如 [A B A]
+func cycleThrough(deps map[ServiceName][]ServiceName, component []ServiceName, start ServiceName) []ServiceName {
+	from := make(map[ServiceName]ServiceName) // 广度优先时每个节点是从哪里来的
+	queue := []ServiceName{start}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, next := range deps[name] {
+			if !containsName(component, next) {
+				continue
+			}
+			if next == start {
+				cycle := []ServiceName{start}
+				for n := name; n != start; n = from[n] {
+					cycle = append(cycle, n)
+				}
+				cycle = append(cycle, start)
+				for i, j := 0, len(cycle)-1; i < j; i, j = i+1, j-1 {
+					cycle[i], cycle[j] = cycle[j], cycle[i]
+				}
+				return cycle
+			}
+			if _, ok := from[next]; !ok {
+				from[next] = name
+				queue = append(queue, next)
+			}
+		}
+	}
+	return []ServiceName{start, start} // 强连通分量里不会走到这里
+}
+
+// [B C A B] => [A B C A]，同一个环不管从哪里发现都一样
+func rotateCycle(cycle []ServiceName) []ServiceName {
+	nodes := cycle[:len(cycle)-1]
+	start := 0
+	for i := range nodes {
+		if nodes[i] < nodes[start] {
+			start = i
+		}
+	}
+	rotated := append(append([]ServiceName(nil), nodes[start:]...), nodes[:start]...)
+	return append(rotated, rotated[0])
+}
+
+/*
+	检查新的注册会不会让依赖图出现环，顺便对不认识的依赖打警告
+	同一个实例重新注册时，用新的依赖关系替换旧的
+*/
+func (r *registry) checkDependencies(reg Registration) error {
+	r.mutex.RLock()
+	regs := make([]Registration, 0, len(r.registrations)+1)
+	for _, existing := range r.registrations {
+		if existing.InstanceID != reg.InstanceID {
+			regs = append(regs, existing)
+		}
+	}
+	r.mutex.RUnlock()
+	regs = append(regs, reg)
+
+	deps := dependencies(regs)
+	if renamed, ok := renamedServices[reg.ServiceName]; ok {
+		log.Printf("[Graph] %v registers under the old name %q, use %q", reg.InstanceID, reg.ServiceName, renamed)
+	}
+	for _, required := range reg.RequiredServices {
+		if renamed, ok := renamedServices[required]; ok {
+			log.Printf("[Graph] %v requires %q by its old name, use %q", reg.ServiceName, required, renamed)
+			continue
+		}
+		if _, ok := deps[required]; !ok && !containsName(knownServices, required) {
+			log.Printf("[Graph] %v requires unknown service %q, check for typos", reg.ServiceName, required)
+		}
+	}
+	for _, component := range stronglyConnected(deps) {
+		if containsName(component, reg.ServiceName) {
+			cycle := rotateCycle(cycleThrough(deps, component, reg.ServiceName))
+			return fmt.Errorf("dependency cycle %v", formatCycle(cycle))
+		}
+	}
+	return nil
+}
+
+func formatCycle(cycle []ServiceName) string {
+	names := make([]string, len(cycle))
+	for i, name := range cycle {
+		names[i] = string(name)
+	}
+	return strings.Join(names, " -> ")
+}
+
+func (r *registry) graph() serviceGraph {
+	r.mutex.RLock()
+	regs := append([]Registration(nil), r.registrations...)
+	available := make(map[ServiceName]int)
+	for _, reg := range r.registrations {
+		if usable(r.entry(reg)) {
+			available[reg.ServiceName]++
+		}
+	}
+	r.mutex.RUnlock()
+
+	deps := dependencies(regs)
+	g := serviceGraph{
+		Nodes:   make([]graphNode, 0),
+		Edges:   make([]graphEdge, 0),
+		Unknown: make([]ServiceName, 0),
+		Renamed: make([]ServiceName, 0),
+		Cycles:  findCycles(deps),
+	}
+	names := make(map[ServiceName]bool)
+	for name, required := range deps {
+		names[name] = true
+		for _, to := range required {
+			names[to] = true
+			g.Edges = append(g.Edges, graphEdge{From: name, To: to, Available: available[to] > 0})
+		}
+	}
+	for name := range names {
+		_, registered := deps[name]
+		_, renamed := renamedServices[name]
+		known := registered || containsName(knownServices, name) || renamed
+		g.Nodes = append(g.Nodes, graphNode{Name: name, Instances: available[name], Known: known})
+		switch {
+		case renamed:
+			g.Renamed = append(g.Renamed, name)
+		case !known:
+			g.Unknown = append(g.Unknown, name)
+		}
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].Name < g.Nodes[j].Name })
+	sort.Slice(g.Edges, func(i, j int) bool {
+		if g.Edges[i].From != g.Edges[j].From {
+			return g.Edges[i].From < g.Edges[j].From
+		}
+		return g.Edges[i].To < g.Edges[j].To
+	})
+	sort.Slice(g.Unknown, func(i, j int) bool { return g.Unknown[i] < g.Unknown[j] })
+	sort.Slice(g.Renamed, func(i, j int) bool { return g.Renamed[i] < g.Renamed[j] })
+	return g
+}
+
+/*
+	没有可用实例的服务画成红色虚线框，不认识的名字画成灰色，改过名的旧名字画成橙色
+	指向没有可用实例的服务的边画成红色虚线，环上的边画成粗线
+*/
+func (g serviceGraph) dot() string {
+	inCycle := make(map[[2]ServiceName]bool)
+	for _, cycle := range g.Cycles {
+		for i := 0; i+1 < len(cycle); i++ {
+			inCycle[[2]ServiceName{cycle[i], cycle[i+1]}] = true
+		}
+	}
+
+	renamed := make(map[ServiceName]bool)
+	for _, name := range g.Renamed {
+		renamed[name] = true
+	}
+
+	var b strings.Builder
+	b.WriteString("digraph services {\n")
+	b.WriteString("\trankdir=LR;\n")
+	b.WriteString("\tnode [shape=box];\n")
+	for _, n := range g.Nodes {
+		attrs := fmt.Sprintf("label=%q", fmt.Sprintf("%s\n%d instance(s)", n.Name, n.Instances))
+		switch {
+		case !n.Known:
+			attrs += ", style=filled, fillcolor=lightgray"
+		case renamed[n.Name]:
+			attrs += ", style=filled, fillcolor=orange"
+		case n.Instances == 0:
+			attrs += ", style=dashed, color=red"
+		}
+		fmt.Fprintf(&b, "\t%q [%s];\n", n.Name, attrs)
+	}
+	for _, e := range g.Edges {
+		attrs := make([]string, 0)
+		if !e.Available {
+			attrs = append(attrs, "style=dashed", "color=red")
+		}
+		if inCycle[[2]ServiceName{e.From, e.To}] {
+			attrs = append(attrs, "penwidth=3")
+		}
+		if len(attrs) > 0 {
+			fmt.Fprintf(&b, "\t%q -> %q [%s];\n", e.From, e.To, strings.Join(attrs, ", "))
+		} else {
+			fmt.Fprintf(&b, "\t%q -> %q;\n", e.From, e.To)
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func (s RegistrationService) serveGraph(w http.ResponseWriter, r *http.Request) {
+	if reg.forwardToLeader(w, r) { // 可用实例数要看 leader 上的健康状态
+		return
+	}
+	g := reg.graph()
+	if r.URL.Query().Get("format") == "dot" {
+		w.Header().Add("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		w.Write([]byte(g.dot()))
+		return
+	}
+	data, err := json.Marshal(g)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(data)
+}
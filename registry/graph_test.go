@@ -0,0 +1,109 @@
+package registry
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFindCycles(t *testing.T) {
+	tests := []struct {
+		name string
+		deps map[ServiceName][]ServiceName
+		want string
+	}{
+		{"empty", map[ServiceName][]ServiceName{}, "[]"},
+		{"chain", map[ServiceName][]ServiceName{"A": {"B"}, "B": {"C"}, "C": {}}, "[]"},
+		{"diamond", map[ServiceName][]ServiceName{"A": {"B", "C"}, "B": {"D"}, "C": {"D"}, "D": {}}, "[]"},
+		{"unregistered dependency", map[ServiceName][]ServiceName{"A": {"Missing"}}, "[]"},
+		{"self", map[ServiceName][]ServiceName{"A": {"A"}}, "[[A A]]"},
+		{"pair", map[ServiceName][]ServiceName{"B": {"A"}, "A": {"B"}}, "[[A B A]]"},
+		// 从 C 开始也会走到这个环，只报一次，而且从最小的名字开始
+		{"triangle", map[ServiceName][]ServiceName{"C": {"A"}, "B": {"C"}, "A": {"B"}}, "[[A B C A]]"},
+		// A、B、C 是同一个强连通分量，只报一个环
+		{"shared node", map[ServiceName][]ServiceName{"A": {"B"}, "B": {"A", "C"}, "C": {"B"}, "D": {"C"}}, "[[A B A]]"},
+		{"two components", map[ServiceName][]ServiceName{"A": {"B"}, "B": {"A", "C"}, "C": {"D"}, "D": {"C"}}, "[[A B A] [C D C]]"},
+		{"tail into cycle", map[ServiceName][]ServiceName{"A": {"B"}, "B": {"C"}, "C": {"B"}}, "[[B C B]]"},
+	}
+	for _, test := range tests {
+		if got := fmt.Sprint(findCycles(test.deps)); got != test.want {
+			t.Errorf("%s: findCycles = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+// 每层的每个服务都依赖下一层的所有服务，路径数是指数级的，每个节点只能访问一次
+func TestFindCyclesLargeAcyclic(t *testing.T) {
+	const layers, width = 40, 8
+	deps := make(map[ServiceName][]ServiceName)
+	for layer := 0; layer < layers; layer++ {
+		for i := 0; i < width; i++ {
+			name := ServiceName(fmt.Sprintf("S%d-%d", layer, i))
+			deps[name] = make([]ServiceName, 0, width)
+			if layer+1 == layers {
+				continue
+			}
+			for j := 0; j < width; j++ {
+				deps[name] = append(deps[name], ServiceName(fmt.Sprintf("S%d-%d", layer+1, j)))
+			}
+		}
+	}
+	start := time.Now()
+	if cycles := findCycles(deps); len(cycles) != 0 {
+		t.Fatalf("findCycles = %v, want none", cycles)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("findCycles took %v on %d services", elapsed, len(deps))
+	}
+
+	// S39-0 依赖 S0-0 以后，它和前面所有层成了一个强连通分量，也只报一个环
+	deps["S39-0"] = append(deps["S39-0"], "S0-0")
+	cycles := findCycles(deps)
+	if len(cycles) != 1 || len(cycles[0]) != layers+1 || cycles[0][0] != "S0-0" {
+		t.Fatalf("findCycles = %v, want one shortest cycle through S0-0", cycles)
+	}
+}
+
+// 新的注册形成环时拒绝；同一个实例重新注册时按新的依赖算
+func TestCheckDependencies(t *testing.T) {
+	r := newRegistry()
+	r.registrations = []Registration{
+		{ServiceName: PortalService, InstanceID: "portal-1", RequiredServices: []ServiceName{GradingService}},
+		{ServiceName: GradingService, InstanceID: "grading-1", RequiredServices: []ServiceName{LogService}},
+	}
+	logging := Registration{ServiceName: LogService, InstanceID: "log-1", RequiredServices: []ServiceName{PortalService}}
+	err := r.checkDependencies(logging)
+	want := formatCycle([]ServiceName{GradingService, LogService, PortalService, GradingService})
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("cycle through the new registration: err = %v", err)
+	}
+	if err := r.checkDependencies(Registration{ServiceName: LogService, InstanceID: "log-1"}); err != nil {
+		t.Fatalf("no cycle: %v", err)
+	}
+
+	// grading-1 不再依赖 LogService，之前会成环的注册就可以了
+	if err := r.checkDependencies(Registration{ServiceName: GradingService, InstanceID: "grading-1"}); err != nil {
+		t.Fatal(err)
+	}
+	r.registrations[1].RequiredServices = nil
+	if err := r.checkDependencies(logging); err != nil {
+		t.Fatalf("after grading-1 dropped its dependency: %v", err)
+	}
+}
+
+// 依赖了改过名的旧名字（Portald）的列在 Renamed 里，拼错的名字列在 Unknown 里
+func TestGraphRenamedServices(t *testing.T) {
+	r := newRegistry()
+	r.registrations = []Registration{
+		{ServiceName: GradingService, InstanceID: "grading-1", RequiredServices: []ServiceName{"Portald", "LogServce"}},
+	}
+	g := r.graph()
+	if !reflect.DeepEqual(g.Renamed, []ServiceName{"Portald"}) || !reflect.DeepEqual(g.Unknown, []ServiceName{"LogServce"}) {
+		t.Fatalf("Renamed = %v, Unknown = %v; want [Portald], [LogServce]", g.Renamed, g.Unknown)
+	}
+	if dot := g.dot(); !strings.Contains(dot, `"Portald" [label="Portald\n0 instance(s)", style=filled, fillcolor=orange]`) {
+		t.Fatalf("old name not highlighted in DOT:\n%s", dot)
+	}
+}
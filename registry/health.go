@@ -0,0 +1,325 @@
+/*
+	健康检查，每个服务可以在 Registration.HealthCheck 里配置自己的检查方式，不配置就用默认值
+	- HTTP：GET HealthCheck.HTTP（默认 HeartbeatURL），状态码等于 ExpectedStatus、响应体包含 ExpectedBody 算通过
+	- TCP：能连上 HealthCheck.TCP（默认 ServiceURL 的 host:port）就算通过
+	- 每个实例按自己的 Interval 检查，单次检查超过 Timeout 算失败，调度见 checker.go
+	- 三种状态（带滞后，避免一次失败就来回切换）：
+		passing  --失败 1 次-->  warning  --连续失败 FailureThreshold 次-->  critical
+		warning/critical  --连续成功 SuccessThreshold 次-->  passing
+	- 状态变化通过 commit 提交，依赖方收到的是 patch.Changed，实例不会被移除再加回来
+	- 抖动检测：flapWindow 个检查间隔内状态变了 flapThreshold 次，进入 quarantined，
+	  客户端不会用它；之后 flapWindow 个检查间隔内状态不再变化才放出来，恢复成当时按检查结果算出的状态
+	- 按检查结果算出的状态是 critical 超过 DeregisterCriticalAfter 才真正移除；
+	  隔离只影响对外的状态，检查结果不是 critical 的隔离实例不会被移除
+	- 从磁盘恢复的实例先观察：连续成功 SuccessThreshold 次 add 回来，连续失败 FailureThreshold 次丢掉
+	租约模式（TTL > 0）的服务由它自己续约，不做检查
+*/
+package registry
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CheckHTTP = "http"
+	CheckTCP  = "tcp"
+)
+
+// 默认值和原来写死的心跳检查保持一致：3 秒一次，连续 3 次失败移除
+const (
+	defaultCheckInterval    = 3 * time.Second
+	defaultCheckTimeout     = 2 * time.Second
+	defaultFailureThreshold = 3
+	defaultSuccessThreshold = 1
+	defaultDeregisterAfter  = time.Minute
+	flapWindow              = 10        // 抖动检测的时间窗口，单位是检查间隔
+	flapThreshold           = 4         // 窗口内状态变化这么多次算抖动
+	maxCheckBody            = 64 * 1024 // ExpectedBody 只在响应体的前 64KB 里找
+	maxCheckHistory         = 10        // 每个实例保留最近几次检查的结果，给查询接口和控制台看
+)
+
+type HealthCheck struct {
+	Type             string        // CheckHTTP（默认）或 CheckTCP
+	HTTP             string        `json:",omitempty"` // HTTP 检查的地址，默认 HeartbeatURL
+	TCP              string        `json:",omitempty"` // TCP 检查的地址 host:port，默认取 ServiceURL 的
+	ExpectedStatus   int           `json:",omitempty"` // 默认 200
+	ExpectedBody     string        `json:",omitempty"` // 响应体里要包含的内容，空表示不检查
+	Interval         time.Duration `json:",omitempty"`
+	Timeout          time.Duration `json:",omitempty"`
+	FailureThreshold int           `json:",omitempty"`
+	SuccessThreshold int           `json:",omitempty"`
+	// critical 持续多久后移除，默认 1 分钟
+	DeregisterCriticalAfter time.Duration `json:",omitempty"`
+}
+
+// 每个实例的检查状态，只在 leader 上维护
+type checkState struct {
+	failures         int         // 连续失败次数
+	successes        int         // 连续成功次数
+	status           string      // 按检查结果算出的状态，不考虑隔离
+	transitions      []time.Time // 最近的状态变化时间，用于抖动检测
+	quarantinedUntil time.Time   // 在这之前处于隔离状态
+	criticalSince    time.Time   // status 变成 critical 的时间，零值表示不是；隔离不算
+	history          []checkRecord
+}
+
+// 一次检查的结果
+type checkRecord struct {
+	Time     time.Time
+	Passed   bool
+	Status   string        `json:",omitempty"` // 这次检查之后的状态，观察中的实例没有
+	Output   string        `json:",omitempty"` // 失败的原因
+	Duration time.Duration // 检查花了多久
+}
+
+// 补上默认值后的检查配置
+func (reg Registration) healthCheck() HealthCheck {
+	var hc HealthCheck
+	if reg.HealthCheck != nil {
+		hc = *reg.HealthCheck
+	}
+	if hc.Type == "" {
+		hc.Type = CheckHTTP
+	}
+	if hc.HTTP == "" {
+		hc.HTTP = reg.HeartbeatURL
+	}
+	if hc.TCP == "" {
+		hc.TCP = hostPort(reg.ServiceURL)
+	}
+	if hc.ExpectedStatus == 0 {
+		hc.ExpectedStatus = http.StatusOK
+	}
+	if hc.Interval <= 0 {
+		hc.Interval = defaultCheckInterval
+	}
+	if hc.Timeout <= 0 {
+		hc.Timeout = defaultCheckTimeout
+	}
+	if hc.FailureThreshold <= 0 {
+		hc.FailureThreshold = defaultFailureThreshold
+	}
+	if hc.SuccessThreshold <= 0 {
+		hc.SuccessThreshold = defaultSuccessThreshold
+	}
+	if hc.DeregisterCriticalAfter <= 0 {
+		hc.DeregisterCriticalAfter = defaultDeregisterAfter
+	}
+	return hc
+}
+
+// 注册时检查健康检查配置是否合法
+func (hc HealthCheck) validate() error {
+	switch hc.Type {
+	case "", CheckHTTP, CheckTCP:
+	default:
+		return fmt.Errorf("unknown health check type %q", hc.Type)
+	}
+	if hc.Interval < 0 || hc.Timeout < 0 || hc.FailureThreshold < 0 || hc.SuccessThreshold < 0 || hc.DeregisterCriticalAfter < 0 {
+		return fmt.Errorf("health check durations and thresholds must not be negative")
+	}
+	return nil
+}
+
+// http://localhost:4000/log => localhost:4000，没写端口的按协议补上
+func hostPort(serviceURL string) string {
+	u, err := url.Parse(serviceURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	if u.Port() != "" {
+		return u.Host
+	}
+	if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
+
+// 做一次检查，返回 nil 表示通过
+func (r *registry) probe(reg Registration, hc HealthCheck) error {
+	if hc.Type == CheckTCP {
+		conn, err := net.DialTimeout("tcp", hc.TCP, hc.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequest(http.MethodGet, hc.HTTP, nil)
+	if err != nil {
+		return err
+	}
+	// 心跳请求顺便带上最近一次发给它的 Revision，服务发现自己落后了就会去拉全量
+	r.mutex.RLock()
+	revision := r.sent[reg.ServiceUpdateUrl]
+	r.mutex.RUnlock()
+	req.Header.Set(revisionHeader, strconv.FormatUint(revision, 10))
+	client := ClientFor(reg.ServiceName, hc.Timeout)
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != hc.ExpectedStatus {
+		return fmt.Errorf("%s responded with code %v, expected %v", hc.HTTP, res.StatusCode, hc.ExpectedStatus)
+	}
+	if hc.ExpectedBody != "" {
+		body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxCheckBody))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(body), hc.ExpectedBody) {
+			return fmt.Errorf("%s response does not contain %q", hc.HTTP, hc.ExpectedBody)
+		}
+	}
+	return nil
+}
+
+// 检查一个实例并根据连续成功/失败的次数处理，observing 表示它是从磁盘恢复的，还不在注册表里
+func (r *registry) check(reg Registration, observing bool) {
+	hc := reg.healthCheck()
+	start := time.Now()
+	err := r.probe(reg, hc)
+
+	now := time.Now()
+	r.mutex.Lock()
+	state, ok := r.checks[reg.InstanceID]
+	if !ok {
+		state = &checkState{}
+		r.checks[reg.InstanceID] = state
+	}
+	if err == nil {
+		state.failures = 0
+		state.successes++
+	} else {
+		state.successes = 0
+		state.failures++
+	}
+	failures, successes := state.failures, state.successes
+	var published, status string
+	if !observing {
+		if h, ok := r.health[reg.InstanceID]; ok {
+			published = h.Status
+		}
+		if state.status == "" && published != statusQuarantined { // 刚当选的 leader 接着之前的状态算
+			state.status = published
+		}
+		status = state.evaluate(hc, err == nil, now)
+		if state.status == statusCritical {
+			if state.criticalSince.IsZero() {
+				state.criticalSince = now
+			}
+		} else {
+			state.criticalSince = time.Time{}
+		}
+	}
+	record := checkRecord{Time: now, Passed: err == nil, Status: status, Duration: now.Sub(start)}
+	if err != nil {
+		record.Output = err.Error()
+	}
+	state.history = append(state.history, record)
+	if len(state.history) > maxCheckHistory {
+		state.history = state.history[len(state.history)-maxCheckHistory:]
+	}
+	criticalSince := state.criticalSince
+	r.mutex.Unlock()
+
+	if observing {
+		switch {
+		case err == nil && successes >= hc.SuccessThreshold:
+			log.Printf("[Heartbeat-check] Recovered service %v with %v", reg.ServiceName, reg.ServiceURL)
+			err = r.add(reg)
+			if err != nil {
+				log.Println(err)
+			}
+			r.touchHeartbeat(reg.InstanceID)
+		case err != nil && failures >= hc.FailureThreshold:
+			log.Printf("[Heartbeat-check] Dropping recovered service %v with %v", reg.ServiceName, reg.ServiceURL)
+			r.mutex.Lock()
+			if r.forgetRecovered(reg.InstanceID) {
+				r.persist(walEntry{Op: opRemove, ID: reg.InstanceID})
+			}
+			delete(r.checks, reg.InstanceID)
+			r.mutex.Unlock()
+		}
+		return
+	}
+
+	if err == nil {
+		log.Printf("[Heartbeat-check] PASSED for %v", reg.ServiceName)
+		r.touchHeartbeat(reg.InstanceID)
+	} else {
+		log.Printf("[Heartbeat-check] FAILED %d/%d for %v with %v: %v", failures, hc.FailureThreshold, reg.ServiceName, reg.ServiceURL, err)
+	}
+	if published != "" && status != published {
+		log.Printf("[Heartbeat-check] %v with %v is now %v (was %v)", reg.ServiceName, reg.ServiceURL, status, published)
+		err = r.commit(walEntry{Op: opStatus, ID: reg.InstanceID, Status: status})
+		if err != nil {
+			log.Println(err)
+		} else {
+			e := auditInstance(auditStatus, reg, nil, actorHealthCheck)
+			e.Status, e.Reason = status, fmt.Sprintf("was %s", published)
+			recordAudit(e)
+		}
+	}
+	if !criticalSince.IsZero() && now.Sub(criticalSince) >= hc.DeregisterCriticalAfter {
+		log.Printf("[Heartbeat-check] Removing %v with %v, critical since %v", reg.ServiceName, reg.ServiceURL, criticalSince.Format(time.RFC3339))
+		err = r.remove(reg.InstanceID)
+		if err != nil {
+			log.Println(err)
+		} else {
+			e := auditInstance(auditRemoved, reg, nil, actorHealthCheck)
+			e.Reason = fmt.Sprintf("critical since %s", criticalSince.Format(time.RFC3339))
+			recordAudit(e)
+		}
+	}
+}
+
+/*
+	根据这次检查结果算出对外的状态，调用方需持有 r.mutex
+	- 先按滞后规则算出检查状态 s.status
+	- 检查状态在窗口内变化太频繁就隔离，隔离期间状态再变化会延长隔离
+*/
+func (s *checkState) evaluate(hc HealthCheck, passed bool, now time.Time) string {
+	if s.status == "" {
+		s.status = statusPassing
+	}
+	status := s.status
+	switch {
+	case passed && s.successes >= hc.SuccessThreshold:
+		status = statusPassing
+	case !passed && s.failures >= hc.FailureThreshold:
+		status = statusCritical
+	case !passed && s.status == statusPassing:
+		status = statusWarning
+	}
+
+	window := time.Duration(flapWindow) * hc.Interval
+	if status != s.status {
+		s.status = status
+		recent := make([]time.Time, 0, len(s.transitions)+1)
+		for _, t := range s.transitions {
+			if now.Sub(t) < window {
+				recent = append(recent, t)
+			}
+		}
+		s.transitions = append(recent, now)
+		if len(s.transitions) >= flapThreshold || now.Before(s.quarantinedUntil) {
+			s.quarantinedUntil = now.Add(window)
+		}
+	}
+	if now.Before(s.quarantinedUntil) {
+		return statusQuarantined
+	}
+	return s.status
+}
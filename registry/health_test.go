@@ -0,0 +1,227 @@
+package registry
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbeHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/teapot":
+			w.WriteHeader(http.StatusTeapot)
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte(`{"status": "ok"}`))
+	}))
+	defer srv.Close()
+
+	r := newRegistry()
+	tests := []struct {
+		name string
+		hc   HealthCheck
+		ok   bool
+	}{
+		{"default 200", HealthCheck{HTTP: srv.URL + "/"}, true},
+		{"unexpected status", HealthCheck{HTTP: srv.URL + "/teapot"}, false},
+		{"expected status", HealthCheck{HTTP: srv.URL + "/teapot", ExpectedStatus: http.StatusTeapot}, true},
+		{"expected body", HealthCheck{HTTP: srv.URL + "/", ExpectedBody: `"ok"`}, true},
+		{"missing body", HealthCheck{HTTP: srv.URL + "/", ExpectedBody: "healthy"}, false},
+		{"timeout", HealthCheck{HTTP: srv.URL + "/slow", Timeout: 50 * time.Millisecond}, false},
+		{"within timeout", HealthCheck{HTTP: srv.URL + "/slow", Timeout: 2 * time.Second}, true},
+	}
+	for _, test := range tests {
+		reg := Registration{ServiceName: GradingService, ServiceURL: srv.URL, HealthCheck: &test.hc}
+		err := r.probe(reg, reg.healthCheck())
+		if (err == nil) != test.ok {
+			t.Errorf("%s: probe = %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestProbeTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	open := l.Addr().String()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := closed.Addr().String()
+	closed.Close()
+	defer l.Close()
+
+	r := newRegistry()
+	for addr, ok := range map[string]bool{open: true, closedAddr: false} {
+		reg := Registration{ServiceName: GradingService, ServiceURL: "http://" + addr, HealthCheck: &HealthCheck{Type: CheckTCP}}
+		if err := r.probe(reg, reg.healthCheck()); (err == nil) != ok {
+			t.Errorf("TCP %s: probe = %v, want ok %v", addr, err, ok)
+		}
+	}
+}
+
+// 像 check 一样先记下连续成功/失败的次数，再算状态
+func (s *checkState) step(hc HealthCheck, passed bool, now time.Time) string {
+	if passed {
+		s.failures = 0
+		s.successes++
+	} else {
+		s.successes = 0
+		s.failures++
+	}
+	return s.evaluate(hc, passed, now)
+}
+
+func TestCheckThresholds(t *testing.T) {
+	hc := Registration{HealthCheck: &HealthCheck{Interval: time.Second, FailureThreshold: 3, SuccessThreshold: 2}}.healthCheck()
+	steps := []struct {
+		passed bool
+		want   string
+	}{
+		{true, statusPassing},
+		{false, statusWarning}, // 失败一次就是 warning，仍然可以用
+		{false, statusWarning},
+		{true, statusWarning}, // 成功次数不够，不回到 passing，失败次数也清零了
+		{false, statusWarning},
+		{false, statusWarning},
+		{false, statusCritical},
+		{true, statusCritical},
+		{true, statusPassing},
+	}
+	s := &checkState{}
+	now := time.Unix(0, 0)
+	for i, step := range steps {
+		now = now.Add(time.Minute) // 间隔足够长，不触发抖动检测
+		if got := s.step(hc, step.passed, now); got != step.want {
+			t.Fatalf("step %d (passed=%v): status = %s, want %s", i, step.passed, got, step.want)
+		}
+	}
+}
+
+// 窗口内状态变了 flapThreshold 次就隔离，之后一个窗口内不再变化才放出来
+func TestCheckFlapQuarantine(t *testing.T) {
+	hc := Registration{HealthCheck: &HealthCheck{Interval: time.Second, FailureThreshold: 1}}.healthCheck()
+	window := time.Duration(flapWindow) * hc.Interval
+	s := &checkState{}
+	now := time.Unix(0, 0)
+	passed := true
+	s.step(hc, passed, now)
+	for i := 1; i < flapThreshold; i++ {
+		now = now.Add(hc.Interval)
+		passed = !passed
+		if got := s.step(hc, passed, now); got == statusQuarantined {
+			t.Fatalf("quarantined after %d transitions, want %d", i, flapThreshold)
+		}
+	}
+	now = now.Add(hc.Interval)
+	passed = !passed
+	if got := s.step(hc, passed, now); got != statusQuarantined {
+		t.Fatalf("status after %d transitions = %s, want quarantined", flapThreshold, got)
+	}
+
+	// 隔离期间再变一次，隔离从这次变化重新算
+	now = now.Add(hc.Interval)
+	passed = !passed
+	changed := now
+	s.step(hc, passed, now)
+	for now.Add(hc.Interval).Sub(changed) < window {
+		now = now.Add(hc.Interval)
+		if got := s.step(hc, passed, now); got != statusQuarantined {
+			t.Fatalf("released %v after the last change, want %v", now.Sub(changed), window)
+		}
+	}
+	now = changed.Add(window)
+	if got := s.step(hc, passed, now); got != s.status || got == statusQuarantined {
+		t.Fatalf("status after a quiet window = %s, want the checked status %s", got, s.status)
+	}
+
+	// 变化分散在窗口之外不算抖动
+	slow := &checkState{}
+	for i := 0; i < 3*flapThreshold; i++ {
+		now = now.Add(window)
+		if got := slow.step(hc, i%2 == 0, now); got == statusQuarantined {
+			t.Fatalf("transition %d once per window quarantined the instance", i)
+		}
+	}
+}
+
+// 检查结果提交成对外的状态，critical 超过 DeregisterCriticalAfter 后移除，只是隔离的不移除
+func TestCheckPublishesStatus(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	var failing int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	r := newRegistry()
+	reg := Registration{
+		ServiceName:  GradingService,
+		ServiceURL:   srv.URL,
+		HeartbeatURL: srv.URL,
+		InstanceID:   "grading-1",
+		HealthCheck:  &HealthCheck{FailureThreshold: 2, DeregisterCriticalAfter: 50 * time.Millisecond},
+	}
+	r.apply(walEntry{Op: opAdd, Registration: &reg})
+	r.mutex.Lock()
+	r.checks[reg.InstanceID] = &checkState{} // heartbeat 发现新实例时建好
+	r.mutex.Unlock()
+	status := func() string {
+		r.mutex.RLock()
+		defer r.mutex.RUnlock()
+		if h, ok := r.health[reg.InstanceID]; ok {
+			return h.Status
+		}
+		return ""
+	}
+
+	r.check(reg, false)
+	if got := status(); got != statusPassing {
+		t.Fatalf("status = %s, want passing", got)
+	}
+	atomic.StoreInt32(&failing, 1)
+	for _, want := range []string{statusWarning, statusCritical} {
+		r.check(reg, false)
+		if got := status(); got != want {
+			t.Fatalf("status = %s, want %s", got, want)
+		}
+	}
+	time.Sleep(60 * time.Millisecond)
+	r.check(reg, false)
+	if got := status(); got != "" || len(registrationIDs(r)) != 0 {
+		t.Fatalf("critical instance not removed: status %q, registrations %v", got, registrationIDs(r))
+	}
+
+	// 抖动被隔离、但检查结果从没到 critical 的实例，过了 DeregisterCriticalAfter 也不移除
+	reg.InstanceID = "grading-2"
+	reg.HealthCheck = &HealthCheck{Interval: time.Second, FailureThreshold: 3, SuccessThreshold: 1, DeregisterCriticalAfter: 50 * time.Millisecond}
+	r.apply(walEntry{Op: opAdd, Registration: &reg})
+	r.mutex.Lock()
+	r.checks[reg.InstanceID] = &checkState{} // heartbeat 发现新实例时建好
+	r.mutex.Unlock()
+	for i := 0; i <= flapThreshold+1; i++ {
+		atomic.StoreInt32(&failing, int32(i%2))
+		r.check(reg, false)
+	}
+	if got := status(); got != statusQuarantined {
+		t.Fatalf("flapping instance: status = %s, want quarantined", got)
+	}
+	time.Sleep(60 * time.Millisecond)
+	r.check(reg, false)
+	if got := status(); got != statusQuarantined {
+		t.Fatalf("quarantined instance removed without being critical: status %q, registrations %v", got, registrationIDs(r))
+	}
+}
@@ -0,0 +1,404 @@
+/*
+	注册中心上的 key/value 配置存储，用来放功能开关、日志地址、成绩策略这类不想重新部署就能改的配置
+	- key 是用 / 分层的路径，比如 config/portal/log-destination；前缀 config/portal 包括它自己和下面所有的 key
+	- 每次写操作 KV 的 Revision 加一，每个 key 记下创建时和最后修改时的 Revision（CreateRevision、ModRevision）
+	- 写操作和注册一样走 commit：单机模式写 WAL，集群模式通过 Raft 复制，所以重启、leader 切换都不会丢
+		GET    /kv/{key}                   一个 key，不存在返回 404
+		GET    /kv/{prefix}?recurse        前缀下的所有 key，按 key 排序
+		GET    /kv/{prefix}?watch&index=N  长轮询，和 /services/watch 一样：index=0 或者太旧时返回全部（Reset），
+		                                   否则等到前缀下有 Revision > N 的变化
+		PUT    /kv/{key}                   Body 是值；?cas=N 只在 key 的 ModRevision 是 N 时才写，N 为 0 表示 key 必须不存在
+		                                   ?acquire=S、?release=S 用会话 S 拿锁、放锁，见 lock.go
+		DELETE /kv/{key}                   ?cas=N 同上；?recurse 删掉前缀下所有的 key
+	GET 的响应头 X-Registry-KV-Index 是当前的 Revision，可以作为 watch 的起点
+	CAS 不满足或者 key 被别的会话锁着时返回 409，Body 是当前的值；启用了认证时写操作要带任意一个服务（或者管理员）的签名
+*/
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	opKVPut    = walOp("kv-put")
+	opKVDelete = walOp("kv-delete")
+)
+
+const (
+	kvIndexHeader = "X-Registry-KV-Index"
+	maxKVValue    = 512 * 1024
+	maxKVEvents   = 1000 // 最多保留多少个变化，watch 的 index 比这更旧就整体返回
+)
+
+type KVPair struct {
+	Key            string
+	Value          string
+	CreateRevision uint64
+	ModRevision    uint64
+	Session        string `json:",omitempty"` // 持有这把锁的会话，见 lock.go
+}
+
+type KVEvent struct {
+	Revision uint64
+	Type     string // "put" 或 "delete"
+	Pair     KVPair // delete 时是删掉之前的值，ModRevision 是删除时的 Revision
+}
+
+type kvWatchResult struct {
+	Index  uint64
+	Reset  bool // 为 true 时 Events 是前缀下的全部 key（都是 put），客户端应整体替换
+	Events []KVEvent
+}
+
+// 一次写操作的结果，只在收到请求的节点上等
+type kvOutcome struct {
+	OK       bool   // CAS 满足
+	Pair     KVPair // put 之后的值；CAS 不满足时是当前的值
+	Exists   bool   // CAS 不满足时 key 是否存在
+	Deleted  int
+	Revision uint64 // 修改之后的 Revision
+}
+
+// 所有字段由 r.mutex 保护
+type kvStore struct {
+	pairs    map[string]KVPair
+	revision uint64
+	events   []KVEvent
+	changed  chan struct{} // 有变化时被 close，唤醒等待中的 watch
+	outcomes map[string]*kvOutcome
+	sessions map[string]Session // 会话 ID -> 会话
+}
+
+func newKVStore() *kvStore {
+	return &kvStore{
+		pairs:    make(map[string]KVPair),
+		events:   make([]KVEvent, 0),
+		changed:  make(chan struct{}),
+		outcomes: make(map[string]*kvOutcome),
+		sessions: make(map[string]Session),
+	}
+}
+
+// key 是否在 prefix 下；prefix 为空表示全部
+func underPrefix(key, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || key == prefix || strings.HasPrefix(key, prefix+"/")
+}
+
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") || strings.Contains(key, "//") {
+		return fmt.Errorf("invalid key %q", key)
+	}
+	return nil
+}
+
+// 前缀下的所有 key，按 key 排序
+func (kv *kvStore) list(prefix string) []KVPair {
+	pairs := make([]KVPair, 0)
+	for key, pair := range kv.pairs {
+		if underPrefix(key, prefix) {
+			pairs = append(pairs, pair)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	return pairs
+}
+
+func (kv *kvStore) record(e KVEvent) {
+	kv.events = append(kv.events, e)
+	if len(kv.events) > maxKVEvents {
+		kv.events = kv.events[len(kv.events)-maxKVEvents:]
+	}
+}
+
+/*
+	执行一条 KV 的 WAL，各个节点、重放 WAL 时按同样的顺序执行，CAS 的结果也一样
+	没有修改任何东西（CAS 不满足、删除不存在的 key）时 Revision 不变
+*/
+func (kv *kvStore) apply(e walEntry) kvOutcome {
+	current, exists := kv.pairs[e.Key]
+	if e.CAS != nil && !e.Recurse && current.ModRevision != *e.CAS {
+		return kvOutcome{Pair: current, Exists: exists}
+	}
+	switch e.Op {
+	case opKVPut:
+		session := current.Session
+		switch {
+		case e.Acquire != "": // 没有别的会话持有时拿到锁，自己已经持有的话只更新值
+			if _, ok := kv.sessions[e.Acquire]; !ok || (current.Session != "" && current.Session != e.Acquire) {
+				return kvOutcome{Pair: current, Exists: exists}
+			}
+			session = e.Acquire
+		case e.Release != "":
+			if current.Session != e.Release {
+				return kvOutcome{Pair: current, Exists: exists}
+			}
+			session = ""
+		case current.Session != "": // 锁着的 key 只有持有锁的会话能改（带上 acquire 或者 release），不然别人能顶替 leader
+			return kvOutcome{Pair: current, Exists: exists}
+		}
+		kv.revision++
+		pair := KVPair{Key: e.Key, Value: e.Value, CreateRevision: kv.revision, ModRevision: kv.revision, Session: session}
+		if exists {
+			pair.CreateRevision = current.CreateRevision
+		}
+		kv.pairs[e.Key] = pair
+		kv.record(KVEvent{Revision: kv.revision, Type: "put", Pair: pair})
+		return kvOutcome{OK: true, Pair: pair, Revision: kv.revision}
+	case opKVDelete:
+		deleted := make([]KVPair, 0)
+		if e.Recurse {
+			deleted = kv.list(e.Key)
+		} else if exists {
+			deleted = append(deleted, current)
+		}
+		if len(deleted) == 0 {
+			return kvOutcome{OK: true}
+		}
+		for _, pair := range deleted {
+			if pair.Session != "" { // 锁着的 key 不能删，要等持有锁的会话释放
+				return kvOutcome{Pair: pair, Exists: true}
+			}
+		}
+		kv.revision++
+		for _, pair := range deleted {
+			delete(kv.pairs, pair.Key)
+			pair.ModRevision = kv.revision
+			kv.record(KVEvent{Revision: kv.revision, Type: "delete", Pair: pair})
+		}
+		return kvOutcome{OK: true, Deleted: len(deleted), Revision: kv.revision}
+	}
+	return kvOutcome{}
+}
+
+// 快照里读出来的
+func (kv *kvStore) restore(pairs []KVPair, revision uint64) {
+	for _, pair := range pairs {
+		kv.pairs[pair.Key] = pair
+	}
+	kv.revision = revision
+}
+
+// 有写操作提交了，唤醒 watch；调用方需持有 r.mutex
+func (kv *kvStore) notify() {
+	close(kv.changed)
+	kv.changed = make(chan struct{})
+}
+
+// 提交一次写操作并等它在本节点执行完，返回执行的结果
+func (r *registry) writeKV(e walEntry) (kvOutcome, error) {
+	e.Request = newID()
+	outcome := new(kvOutcome)
+	r.mutex.Lock()
+	r.kv.outcomes[e.Request] = outcome
+	r.mutex.Unlock()
+	err := r.commit(e)
+	r.mutex.Lock()
+	delete(r.kv.outcomes, e.Request)
+	r.mutex.Unlock()
+	return *outcome, err
+}
+
+func (r *registry) getKV(key string) (KVPair, uint64, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	pair, ok := r.kv.pairs[key]
+	return pair, r.kv.revision, ok
+}
+
+func (r *registry) listKV(prefix string) ([]KVPair, uint64) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.kv.list(prefix), r.kv.revision
+}
+
+func (r *registry) watchKV(prefix string, index uint64, stop <-chan struct{}) kvWatchResult {
+	timeout := time.After(watchTimeout)
+	for {
+		r.mutex.RLock()
+		kv := r.kv
+		changed := kv.changed
+		tooOld := (len(kv.events) > 0 && index+1 < kv.events[0].Revision) || (len(kv.events) == 0 && index < kv.revision)
+		if index == 0 || index > kv.revision || tooOld {
+			result := kvWatchResult{Index: kv.revision, Reset: true, Events: make([]KVEvent, 0)}
+			for _, pair := range kv.list(prefix) {
+				result.Events = append(result.Events, KVEvent{Revision: pair.ModRevision, Type: "put", Pair: pair})
+			}
+			r.mutex.RUnlock()
+			return result
+		}
+		result := kvWatchResult{Index: kv.revision, Events: make([]KVEvent, 0)}
+		for _, e := range kv.events {
+			if e.Revision > index && underPrefix(e.Pair.Key, prefix) {
+				result.Events = append(result.Events, e)
+			}
+		}
+		r.mutex.RUnlock()
+		if len(result.Events) > 0 {
+			return result
+		}
+		index = result.Index
+
+		select {
+		case <-changed:
+		case <-timeout:
+			return kvWatchResult{Index: index, Events: make([]KVEvent, 0)}
+		case <-stop:
+			return kvWatchResult{Index: index, Events: make([]KVEvent, 0)}
+		}
+	}
+}
+
+type KVService struct{}
+
+func (s KVService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/kv/"), "/")
+	query := r.URL.Query()
+	_, recurse := query["recurse"]
+	switch r.Method {
+	case http.MethodGet:
+		if _, ok := query["watch"]; ok { // 各个节点 apply 的顺序一样，watch 不用转发
+			s.serveWatch(w, r, key)
+			return
+		}
+		if reg.forwardToLeader(w, r) {
+			return
+		}
+		var result interface{}
+		var revision uint64
+		if recurse {
+			result, revision = reg.listKV(key)
+		} else {
+			pair, index, ok := reg.getKV(key)
+			if !ok {
+				w.Header().Set(kvIndexHeader, strconv.FormatUint(index, 10))
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			result, revision = pair, index
+		}
+		w.Header().Set(kvIndexHeader, strconv.FormatUint(revision, 10))
+		writeJSON(w, http.StatusOK, result)
+	case http.MethodPut, http.MethodDelete:
+		if reg.forwardToLeader(w, r) {
+			return
+		}
+		s.serveWrite(w, r, key, recurse)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s KVService) serveWatch(w http.ResponseWriter, r *http.Request, prefix string) {
+	var index uint64
+	if value := r.URL.Query().Get("index"); value != "" {
+		var err error
+		index, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, reg.watchKV(prefix, index, r.Context().Done()))
+}
+
+func (s KVService) serveWrite(w http.ResponseWriter, r *http.Request, key string, recurse bool) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxKVValue))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	e := walEntry{Op: opKVPut, Key: key, Value: string(body)}
+	if r.Method == http.MethodDelete {
+		e = walEntry{Op: opKVDelete, Key: key, Recurse: recurse}
+	}
+	if !(e.Op == opKVDelete && recurse && key == "") { // DELETE /kv/?recurse 清空全部
+		if err := validKey(key); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := r.URL.Query().Get("cas"); value != "" {
+		cas, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || recurse {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		e.CAS = &cas
+	}
+	e.Acquire, e.Release = r.URL.Query().Get("acquire"), r.URL.Query().Get("release")
+	holder := e.Acquire + e.Release
+	if holder != "" && (e.Op != opKVPut || e.CAS != nil || (e.Acquire != "" && e.Release != "")) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	actor, err := authenticateAny(r, body)
+	if err != nil {
+		log.Printf("Rejecting %s of key %s: %v", r.Method, key, err)
+		writeAuthError(w, err)
+		return
+	}
+	if holder != "" {
+		session, ok := reg.session(holder)
+		if !ok {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		if actor != "" && actor != session.Service && actor != AdminService { // 只能用自己的会话
+			writeAuthError(w, errForbidden)
+			return
+		}
+	}
+
+	outcome, err := reg.writeKV(e)
+	if errors.Is(err, errNotLeader) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !outcome.OK {
+		if outcome.Exists {
+			writeJSON(w, http.StatusConflict, outcome.Pair)
+		} else {
+			w.WriteHeader(http.StatusConflict)
+		}
+		return
+	}
+	if outcome.Revision > 0 { // 删除不存在的 key 什么都没改
+		audited := auditInstance(auditKV, Registration{}, r, actor)
+		audited.Reason, audited.Revision = fmt.Sprintf("%s %s", e.Op, key), outcome.Revision
+		recordAudit(audited)
+	}
+	if e.Op == opKVDelete {
+		if outcome.Deleted == 0 && !recurse {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, outcome.Pair)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
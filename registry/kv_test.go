@@ -0,0 +1,118 @@
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func casAt(revision uint64) *uint64 {
+	return &revision
+}
+
+// 按顺序执行一串写操作，CAS 不满足或者删除不存在的 key 时 Revision 不变
+func TestKVApply(t *testing.T) {
+	kv := newKVStore()
+	steps := []struct {
+		name     string
+		e        walEntry
+		ok       bool
+		revision uint64 // 执行之后 KV 的 Revision
+		deleted  int
+	}{
+		{"create", walEntry{Op: opKVPut, Key: "config/a", Value: "1"}, true, 1, 0},
+		{"cas 0 on existing key", walEntry{Op: opKVPut, Key: "config/a", Value: "x", CAS: casAt(0)}, false, 1, 0},
+		{"cas 0 on missing key", walEntry{Op: opKVPut, Key: "config/b", Value: "2", CAS: casAt(0)}, true, 2, 0},
+		{"stale cas", walEntry{Op: opKVPut, Key: "config/a", Value: "x", CAS: casAt(2)}, false, 2, 0},
+		{"matching cas", walEntry{Op: opKVPut, Key: "config/a", Value: "3", CAS: casAt(1)}, true, 3, 0},
+		{"nested key", walEntry{Op: opKVPut, Key: "config/a/deep", Value: "4"}, true, 4, 0},
+		{"sibling prefix", walEntry{Op: opKVPut, Key: "config/ab", Value: "5"}, true, 5, 0},
+		{"stale cas delete", walEntry{Op: opKVDelete, Key: "config/b", CAS: casAt(1)}, false, 5, 0},
+		{"cas delete", walEntry{Op: opKVDelete, Key: "config/b", CAS: casAt(2)}, true, 6, 1},
+		{"delete missing", walEntry{Op: opKVDelete, Key: "config/b"}, true, 6, 0},
+		// config/a 和它下面的，不包括 config/ab
+		{"recursive delete", walEntry{Op: opKVDelete, Key: "config/a", Recurse: true}, true, 7, 2},
+		{"recursive delete of empty prefix", walEntry{Op: opKVDelete, Key: "config/a", Recurse: true}, true, 7, 0},
+	}
+	for _, step := range steps {
+		outcome := kv.apply(step.e)
+		if outcome.OK != step.ok || kv.revision != step.revision || outcome.Deleted != step.deleted {
+			t.Fatalf("%s: outcome %+v, revision %d; want ok=%v, revision %d, deleted %d",
+				step.name, outcome, kv.revision, step.ok, step.revision, step.deleted)
+		}
+	}
+	want := KVPair{Key: "config/ab", Value: "5", CreateRevision: 5, ModRevision: 5}
+	if len(kv.pairs) != 1 || kv.pairs["config/ab"] != want {
+		t.Fatalf("pairs = %+v, want only %+v", kv.pairs, want)
+	}
+
+	// CAS 不满足时带回当前的值，给 409 的响应用
+	kv.apply(walEntry{Op: opKVPut, Key: "config/c", Value: "6"})
+	outcome := kv.apply(walEntry{Op: opKVPut, Key: "config/c", Value: "7", CAS: casAt(0)})
+	if outcome.OK || !outcome.Exists || outcome.Pair.Value != "6" {
+		t.Fatalf("conflict outcome = %+v, want the current pair", outcome)
+	}
+
+	// 同一个 Revision 删掉的 key 各有一个事件
+	deletes := 0
+	for _, e := range kv.events {
+		if e.Type == "delete" && e.Revision == 7 {
+			deletes++
+		}
+	}
+	if deletes != 2 {
+		t.Fatalf("recursive delete recorded %d events, want 2", deletes)
+	}
+}
+
+// 通过 HTTP 写：CAS 冲突返回 409 和当前的值，key 不存在时 409 没有 Body
+func TestKVHTTPConflict(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	srv := httptest.NewServer(KVService{})
+	defer srv.Close()
+	t.Cleanup(func() {
+		reg.writeKV(walEntry{Op: opKVDelete, Key: "test", Recurse: true})
+	})
+	do := func(method, path, body string) (int, KVPair) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var pair KVPair
+		data, _ := ioutil.ReadAll(res.Body)
+		if len(data) > 0 {
+			json.Unmarshal(data, &pair)
+		}
+		return res.StatusCode, pair
+	}
+
+	code, created := do(http.MethodPut, "/kv/test/lock?cas=0", "owner-1")
+	if code != http.StatusOK || created.Value != "owner-1" {
+		t.Fatalf("create with cas=0: %d %+v", code, created)
+	}
+	if code, current := do(http.MethodPut, "/kv/test/lock?cas=0", "owner-2"); code != http.StatusConflict || current != created {
+		t.Fatalf("second create with cas=0: %d %+v, want 409 with %+v", code, current, created)
+	}
+	if code, current := do(http.MethodDelete, "/kv/test/missing?cas=3", ""); code != http.StatusConflict || current.Key != "" {
+		t.Fatalf("cas delete of a missing key: %d %+v, want 409 without body", code, current)
+	}
+	if code, _ := do(http.MethodDelete, "/kv/test?recurse&cas=1", ""); code != http.StatusBadRequest {
+		t.Fatalf("recursive delete with cas: %d, want 400", code)
+	}
+	do(http.MethodPut, "/kv/test/a/b", "x")
+	if code, _ := do(http.MethodDelete, "/kv/test?recurse", ""); code != http.StatusOK {
+		t.Fatalf("recursive delete: %d", code)
+	}
+	if code, _ := do(http.MethodGet, "/kv/test/lock", ""); code != http.StatusNotFound {
+		t.Fatalf("get after recursive delete: %d, want 404", code)
+	}
+}
@@ -0,0 +1,226 @@
+/*
+	KV 存储的客户端
+	- GetKV、ListKV 读配置，PutKV、DeleteKV 写配置
+	- CompareAndSwapKV、CompareAndDeleteKV：只在 key 的 ModRevision 还是读出来时的值时才写，并发修改时只有一个成功
+	- WatchKV(ctx, prefix, callback)：前缀下每个 key 的变化回调一次，启动时先回调一遍已有的 key
+	写操作用本进程注册的服务的密钥签名（没有注册过的话用随便一个加载了的密钥）
+*/
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 注册中心返回 409 时的错误，比如 CAS 不满足
+var ErrKVConflict = errors.New("key/value conflict")
+
+// servicesUrl 是注册中心节点的 .../services，key 的每一段分别转义
+func kvURL(servicesUrl, key string, query url.Values) string {
+	segments := strings.Split(key, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	u := strings.TrimSuffix(servicesUrl, "/services") + "/kv/" + strings.Join(segments, "/")
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// 写操作用哪个服务的密钥签名
+func kvCaller() ServiceName {
+	var caller ServiceName
+	instances.mutex.Lock()
+	for _, r := range instances.regs {
+		caller = r.ServiceName
+	}
+	instances.mutex.Unlock()
+	if caller != "" {
+		return caller
+	}
+	serviceKeys.mutex.RLock()
+	defer serviceKeys.mutex.RUnlock()
+	for name := range serviceKeys.keys {
+		caller = name
+	}
+	return caller
+}
+
+func kvRequest(ctx context.Context, method, key string, query url.Values, body []byte) (*http.Response, error) {
+	return callRegistry(ClientFor(RegistryService, 0), func(servicesUrl string) (*http.Request, error) {
+		req, err := newSignedRequest(method, kvURL(servicesUrl, key, query), kvCaller(), body)
+		if err != nil {
+			return nil, err
+		}
+		return req.WithContext(ctx), nil
+	})
+}
+
+// ok 为 false 表示 key 不存在
+func GetKV(key string) (KVPair, bool, error) {
+	var pair KVPair
+	res, err := kvRequest(context.Background(), http.MethodGet, key, nil, nil)
+	if err != nil {
+		return pair, false, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return pair, false, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return pair, false, fmt.Errorf("failed to get key %s. registry service responsed with code %v", key, res.StatusCode)
+	}
+	err = json.NewDecoder(res.Body).Decode(&pair)
+	return pair, err == nil, err
+}
+
+// 前缀下的所有 key，以及当时的 Revision
+func ListKV(prefix string) ([]KVPair, uint64, error) {
+	res, err := kvRequest(context.Background(), http.MethodGet, prefix, url.Values{"recurse": {""}}, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("failed to list %s. registry service responsed with code %v", prefix, res.StatusCode)
+	}
+	var pairs []KVPair
+	err = json.NewDecoder(res.Body).Decode(&pairs)
+	if err != nil {
+		return nil, 0, err
+	}
+	revision, _ := strconv.ParseUint(res.Header.Get(kvIndexHeader), 10, 64)
+	return pairs, revision, nil
+}
+
+func PutKV(key, value string) (KVPair, error) {
+	return putKV(key, value, nil)
+}
+
+// modRevision 为 0 表示只在 key 不存在时创建；不满足时返回 ErrKVConflict
+func CompareAndSwapKV(key, value string, modRevision uint64) (KVPair, error) {
+	return putKV(key, value, url.Values{"cas": {strconv.FormatUint(modRevision, 10)}})
+}
+
+func putKV(key, value string, query url.Values) (KVPair, error) {
+	var pair KVPair
+	res, err := kvRequest(context.Background(), http.MethodPut, key, query, []byte(value))
+	if err != nil {
+		return pair, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusConflict {
+		return pair, fmt.Errorf("%w: key %s was modified", ErrKVConflict, key)
+	}
+	if res.StatusCode != http.StatusOK {
+		return pair, fmt.Errorf("failed to put key %s. registry service responsed with code %v", key, res.StatusCode)
+	}
+	err = json.NewDecoder(res.Body).Decode(&pair)
+	return pair, err
+}
+
+// recurse 为 true 时删掉前缀下所有的 key；key 不存在不算错误
+func DeleteKV(key string, recurse bool) error {
+	var query url.Values
+	if recurse {
+		query = url.Values{"recurse": {""}}
+	}
+	return deleteKV(key, query)
+}
+
+// 只在 key 的 ModRevision 是 modRevision 时删除，不满足时返回 ErrKVConflict
+func CompareAndDeleteKV(key string, modRevision uint64) error {
+	return deleteKV(key, url.Values{"cas": {strconv.FormatUint(modRevision, 10)}})
+}
+
+func deleteKV(key string, query url.Values) error {
+	res, err := kvRequest(context.Background(), http.MethodDelete, key, query, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNotFound:
+		return nil
+	case http.StatusConflict:
+		return fmt.Errorf("%w: key %s was modified", ErrKVConflict, key)
+	}
+	return fmt.Errorf("failed to delete key %s. registry service responsed with code %v", key, res.StatusCode)
+}
+
+/*
+	通过长轮询 GET /kv/{prefix}?watch 订阅前缀下的变化，ctx 取消后停止
+	- 第一次回调前缀下已有的每个 key（Type 为 put）
+	- 之后每次 put、delete 回调一次；注册中心重启或者离线太久时整体对比一次，只回调有变化的 key
+	回调在同一个 goroutine 里按顺序调用
+*/
+func WatchKV(ctx context.Context, prefix string, callback func(KVEvent)) {
+	go func() {
+		var index uint64
+		known := make(map[string]KVPair) // 回调过的 key 的最新值，整体对比时用
+		for ctx.Err() == nil {
+			result, err := watchKVOnce(ctx, prefix, index)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Println(err)
+					time.Sleep(1 * time.Second)
+				}
+				continue
+			}
+			index = result.Index
+			if result.Reset {
+				current := make(map[string]bool)
+				for _, e := range result.Events {
+					current[e.Pair.Key] = true
+					if old, ok := known[e.Pair.Key]; ok && old.ModRevision == e.Pair.ModRevision {
+						continue
+					}
+					known[e.Pair.Key] = e.Pair
+					callback(e)
+				}
+				for key, pair := range known {
+					if !current[key] {
+						delete(known, key)
+						callback(KVEvent{Revision: result.Index, Type: "delete", Pair: pair})
+					}
+				}
+				continue
+			}
+			for _, e := range result.Events {
+				if e.Type == "delete" {
+					delete(known, e.Pair.Key)
+				} else {
+					known[e.Pair.Key] = e.Pair
+				}
+				callback(e)
+			}
+		}
+	}()
+}
+
+func watchKVOnce(ctx context.Context, prefix string, index uint64) (kvWatchResult, error) {
+	var result kvWatchResult
+	query := url.Values{"watch": {""}, "index": {strconv.FormatUint(index, 10)}}
+	client := ClientFor(RegistryService, watchTimeout+10*time.Second) // 比注册中心挂起的时间长一些
+	res, err := callRegistry(client, func(servicesUrl string) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, kvURL(servicesUrl, prefix, query), nil)
+	})
+	if err != nil {
+		return result, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("failed to watch %s. registry service responsed with code %v", prefix, res.StatusCode)
+	}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	return result, err
+}
@@ -0,0 +1,138 @@
+/*
+	租约（TTL）模式的注册
+	- Registration.TTL > 0 时，注册中心给它分配一个 LeaseID，不再去轮询它的 HeartbeatURL
+	- 服务自己在 TTL 内不断 PUT /leases/{LeaseID} 续约（client.go 里的 keepAlive 会在后台做）
+	- 超过 TTL 没续约，注册中心把它移除，依赖方收到的和心跳失败时一样，是一个 Removed patch
+	- 两种模式可以同时存在，TTL 为 0 的服务仍然走 heartbeat
+*/
+package registry
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var errLeaseNotFound = errors.New("lease not found")
+
+// 客户端每 TTL/3 续约一次，太短的租约还没来得及续约就过期了
+const minLeaseTTL = time.Second
+
+// 生成随机 ID
+func newID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err) // crypto/rand 读不出来说明系统有问题，继续运行也没有意义
+	}
+	return hex.EncodeToString(b)
+}
+
+// 租约对应的服务，续约时要认证是它自己
+func (r *registry) leaseOwner(leaseID string) (ServiceName, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, reg := range r.registrations {
+		if reg.LeaseID == leaseID {
+			return reg.ServiceName, true
+		}
+	}
+	return "", false
+}
+
+// 租约只在 leader 上计时，刚当选的 leader 会给所有租约重新计一个完整的 TTL
+func (r *registry) renewLease(leaseID string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, reg := range r.registrations {
+		if reg.LeaseID == leaseID {
+			r.leases[leaseID] = time.Now().Add(reg.TTL)
+			if h, ok := r.health[reg.InstanceID]; ok {
+				h.LastHeartbeat = time.Now() // 对租约模式来说，续约就是心跳
+			}
+			return nil
+		}
+	}
+	return errLeaseNotFound
+}
+
+// 定时检查租约，过期的服务移除并通知依赖方
+func (r *registry) expireLeases(freq time.Duration) {
+	for {
+		time.Sleep(freq)
+		if r.isLeader() {
+			r.expireLeasesAt(time.Now())
+		}
+	}
+}
+
+// 移除到 now 为止没有续约的服务
+func (r *registry) expireLeasesAt(now time.Time) {
+	expired := make([]Registration, 0)
+	r.mutex.Lock()
+	for _, reg := range r.registrations {
+		if reg.TTL <= 0 {
+			continue
+		}
+		deadline, ok := r.leases[reg.LeaseID]
+		if !ok {
+			r.leases[reg.LeaseID] = now.Add(reg.TTL)
+			continue
+		}
+		if now.After(deadline) {
+			expired = append(expired, reg)
+		}
+	}
+	r.mutex.Unlock()
+
+	for _, reg := range expired {
+		log.Printf("[Lease] EXPIRED for %v with %v", reg.ServiceName, reg.ServiceURL)
+		err := r.remove(reg.InstanceID)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		e := auditInstance(auditExpired, reg, nil, actorLease)
+		e.Reason = fmt.Sprintf("lease not renewed within %v", reg.TTL)
+		recordAudit(e)
+	}
+}
+
+/*
+	续约的 WEB Service
+	PUT /leases/{LeaseID}
+	- 200：续约成功
+	- 404：租约不存在（已过期或注册中心丢了），服务需要重新注册
+*/
+type LeaseService struct{}
+
+func (s LeaseService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if reg.forwardToLeader(w, r) {
+		return
+	}
+	leaseID := strings.TrimPrefix(r.URL.Path, "/leases/")
+	owner, ok := reg.leaseOwner(leaseID)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_, err := authenticate(r, nil, owner)
+	if err != nil {
+		writeAuthError(w, err)
+		return
+	}
+	err = reg.renewLease(leaseID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+}
@@ -0,0 +1,157 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 注册一个租约模式的实例，像 add 一样从现在开始计时
+func addLeased(r *registry, id string, ttl time.Duration) Registration {
+	reg := Registration{ServiceName: GradingService, ServiceURL: "http://" + id, InstanceID: id, LeaseID: "lease-" + id, TTL: ttl}
+	r.apply(walEntry{Op: opAdd, Registration: &reg})
+	r.mutex.Lock()
+	r.leases[reg.LeaseID] = time.Now().Add(ttl)
+	r.mutex.Unlock()
+	return reg
+}
+
+// TTL 内续约的不过期，续约从续约的时候重新计时
+func TestLeaseRenewBeforeExpiry(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	r := newRegistry()
+	reg := addLeased(r, "grading-1", time.Minute)
+
+	r.expireLeasesAt(time.Now().Add(30 * time.Second))
+	if !registrationIDs(r)["grading-1"] {
+		t.Fatal("lease expired before its TTL")
+	}
+	r.mutex.Lock()
+	r.leases[reg.LeaseID] = time.Now().Add(-time.Second) // 快到期了
+	r.mutex.Unlock()
+	if err := r.renewLease(reg.LeaseID); err != nil {
+		t.Fatal(err)
+	}
+	r.expireLeasesAt(time.Now().Add(30 * time.Second))
+	if !registrationIDs(r)["grading-1"] {
+		t.Fatal("renewed lease expired")
+	}
+	r.expireLeasesAt(time.Now().Add(2 * time.Minute))
+	if registrationIDs(r)["grading-1"] {
+		t.Fatal("lease not renewed within the TTL still registered")
+	}
+	if err := r.renewLease(reg.LeaseID); !errors.Is(err, errLeaseNotFound) {
+		t.Fatalf("renewing an expired lease: err = %v, want errLeaseNotFound", err)
+	}
+}
+
+// 过期的实例移除后记一条 expired 审计，依赖方收到 Removed patch
+func TestLeaseExpiry(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	var mutex sync.Mutex
+	removed := make([]string, 0)
+	portal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var p patch
+		json.NewDecoder(req.Body).Decode(&p)
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, e := range p.Removed {
+			removed = append(removed, e.ID)
+		}
+	}))
+	defer portal.Close()
+
+	r := newRegistry()
+	r.registrations = append(r.registrations, Registration{
+		ServiceName: PortalService, ServiceURL: portal.URL, ServiceUpdateUrl: portal.URL, InstanceID: "portal-1",
+		RequiredServices: []ServiceName{GradingService},
+	})
+	stop := make(chan struct{})
+	t.Cleanup(func() { close(stop) })
+	go r.dispatch(stop)
+	addLeased(r, "grading-1", 50*time.Millisecond)
+
+	time.Sleep(60 * time.Millisecond)
+	r.expireLeasesAt(time.Now())
+	if registrationIDs(r)["grading-1"] {
+		t.Fatal("expired lease still registered")
+	}
+	waitFor(t, "Removed patch", func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(removed) == 1 && removed[0] == "grading-1"
+	})
+
+	audit.mutex.Lock()
+	defer audit.mutex.Unlock()
+	for i := len(audit.events) - 1; i >= 0; i-- {
+		e := audit.events[i]
+		if e.InstanceID == "grading-1" && e.Type == auditExpired {
+			if e.Actor != actorLease {
+				t.Fatalf("expired by %q, want %q", e.Actor, actorLease)
+			}
+			return
+		}
+	}
+	t.Fatal("no expired audit event")
+}
+
+// LeaseID 总是由注册中心分配，TTL 为 0 时没有租约，太短的 TTL 直接拒绝；重新注册时丢掉旧的租约
+func TestRegisterLeaseAssignment(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	updates := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer updates.Close()
+
+	register := func(id string, ttl time.Duration) (int, registrationResult) {
+		t.Helper()
+		body, _ := json.Marshal(Registration{
+			ServiceName: GradingService, ServiceURL: "http://" + id, InstanceID: id, ServiceUpdateUrl: updates.URL,
+			LeaseID: "chosen-by-client", TTL: ttl,
+		})
+		w := httptest.NewRecorder()
+		RegistrationService{}.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/services", bytes.NewReader(body)))
+		var result registrationResult
+		if w.Code == http.StatusOK {
+			json.Unmarshal(w.Body.Bytes(), &result)
+			t.Cleanup(func() { reg.remove(id) })
+		}
+		return w.Code, result
+	}
+
+	if code, result := register("lease-none", 0); code != http.StatusOK || result.LeaseID != "" {
+		t.Fatalf("TTL 0: %d, lease %q; want 200 without a lease", code, result.LeaseID)
+	}
+	if instance, _ := reg.instance("lease-none"); instance.LeaseID != "" {
+		t.Fatalf("stored LeaseID %q without a TTL", instance.LeaseID)
+	}
+	for _, ttl := range []time.Duration{-time.Second, 2 * time.Nanosecond, minLeaseTTL / 2} {
+		if code, _ := register("lease-short", ttl); code != http.StatusBadRequest {
+			t.Fatalf("TTL %v: %d, want 400", ttl, code)
+		}
+	}
+	code, result := register("lease-1", time.Minute)
+	if code != http.StatusOK || result.LeaseID == "" || result.LeaseID == "chosen-by-client" {
+		t.Fatalf("TTL 1m: %d, lease %q; want 200 with a lease chosen by the registry", code, result.LeaseID)
+	}
+
+	// 重新注册换了租约，旧租约的到期时间不再留着
+	_, again := register("lease-1", time.Minute)
+	reg.mutex.RLock()
+	_, stale := reg.leases[result.LeaseID]
+	_, current := reg.leases[again.LeaseID]
+	reg.mutex.RUnlock()
+	if stale || !current {
+		t.Fatalf("after re-registering: old lease kept %v, new lease tracked %v", stale, current)
+	}
+}
@@ -0,0 +1,262 @@
+/*
+	会话、锁和选主
+	- 会话属于一个注册了的实例：POST /sessions，Body 是 {"InstanceID": "..."}，返回创建的会话
+	- 实例注销、租约过期、被健康检查移除，或者状态变成 critical、quarantined 时，它的会话全部失效
+	- 锁就是 KV 存储里的 key：PUT /kv/{key}?acquire={session} 在没有别的会话持有时拿到锁（被别人拿着时返回 409），
+	  PUT /kv/{key}?release={session} 释放；会话失效时它持有的锁自动释放，key 和值保留，Session 清空
+	- 锁着的 key 只有持有锁的会话能改：不带 acquire、release 的写和删除（包括删前缀时前缀下有锁着的 key）都返回 409
+	- 选主就是大家抢同一把锁，值写自己的地址，拿到锁的就是 leader；其他人 watch 这个 key，Session 变空了再抢，见 lockclient.go
+		GET    /sessions        所有会话
+		GET    /sessions/{id}   一个会话，不存在返回 404
+		DELETE /sessions/{id}   销毁会话，释放它持有的锁
+	创建、销毁会话要用实例自己的服务（或者管理员）的密钥认证，用会话拿锁、放锁时也一样
+	会话不写进快照：单机模式重启后所有会话失效，锁都释放；集群模式下由 Raft 日志重建
+*/
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	opSessionCreate  = walOp("session-create")
+	opSessionDestroy = walOp("session-destroy")
+)
+
+type Session struct {
+	ID         string
+	InstanceID string
+	Service    ServiceName
+	Created    time.Time
+}
+
+type sessionRequest struct {
+	InstanceID string
+}
+
+// 实例在这些状态下不能创建会话，已有的会话失效
+func sessionHealthy(status string) bool {
+	return status != statusCritical && status != statusQuarantined
+}
+
+// 执行 opSessionCreate、opSessionDestroy，返回 false 表示什么都没改；调用方需持有 r.mutex
+func (r *registry) applySession(e walEntry) bool {
+	outcome := kvOutcome{}
+	defer func() {
+		if waiting, ok := r.kv.outcomes[e.Request]; ok {
+			*waiting = outcome
+		}
+	}()
+	if e.Op == opSessionDestroy {
+		if _, ok := r.kv.sessions[e.Session]; !ok {
+			return false
+		}
+		r.releaseSession(e.Session)
+		outcome.OK = true
+		return true
+	}
+	h, ok := r.health[e.ID]
+	if !ok || !sessionHealthy(h.Status) {
+		return false
+	}
+	for _, reg := range r.registrations {
+		if reg.InstanceID == e.ID {
+			session := Session{ID: e.Session, InstanceID: e.ID, Service: reg.ServiceName}
+			if e.Created != nil {
+				session.Created = *e.Created
+			}
+			r.kv.sessions[e.Session] = session
+			outcome.OK = true
+			return true
+		}
+	}
+	return false
+}
+
+// 实例的会话全部失效；调用方需持有 r.mutex
+func (r *registry) dropSessions(instanceID string) {
+	for id, session := range r.kv.sessions {
+		if session.InstanceID == instanceID {
+			r.releaseSession(id)
+		}
+	}
+}
+
+// 删掉会话并释放它持有的锁；调用方需持有 r.mutex
+func (r *registry) releaseSession(id string) {
+	delete(r.kv.sessions, id)
+	released := r.kv.release(func(pair KVPair) bool { return pair.Session == id })
+	if released > 0 {
+		r.kv.notify()
+		log.Printf("Session %s invalidated, released %d locks", id, released)
+	}
+}
+
+/*
+	释放 held 返回 true 的锁，key 和值保留，所有释放的 key 算一次修改，watch 的一方能看到 Session 变空了
+	重启后会话都不在了，storage.load 最后用它释放所有的锁
+*/
+func (kv *kvStore) release(held func(KVPair) bool) int {
+	keys := make([]string, 0)
+	for key, pair := range kv.pairs {
+		if pair.Session != "" && held(pair) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return 0
+	}
+	sort.Strings(keys)
+	kv.revision++
+	for _, key := range keys {
+		pair := kv.pairs[key]
+		pair.Session, pair.ModRevision = "", kv.revision
+		kv.pairs[key] = pair
+		kv.record(KVEvent{Revision: kv.revision, Type: "put", Pair: pair})
+	}
+	return len(keys)
+}
+
+func (r *registry) session(id string) (Session, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	session, ok := r.kv.sessions[id]
+	return session, ok
+}
+
+func (r *registry) sessions() []Session {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	result := make([]Session, 0, len(r.kv.sessions))
+	for _, session := range r.kv.sessions {
+		result = append(result, session)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Created.Equal(result[j].Created) {
+			return result[i].Created.Before(result[j].Created)
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+type SessionService struct{}
+
+func (s SessionService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions"), "/")
+	switch {
+	case r.Method == http.MethodGet:
+		if reg.forwardToLeader(w, r) { // 会话的失效由 leader 上的健康检查决定，follower 上可能还没执行到
+			return
+		}
+		if id == "" {
+			writeJSON(w, http.StatusOK, reg.sessions())
+			return
+		}
+		session, ok := reg.session(id)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, session)
+	case r.Method == http.MethodPost && id == "":
+		s.create(w, r)
+	case r.Method == http.MethodDelete && id != "":
+		s.destroy(w, r, id)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s SessionService) create(w http.ResponseWriter, r *http.Request) {
+	if reg.forwardToLeader(w, r) {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var sr sessionRequest
+	err = json.Unmarshal(body, &sr)
+	if err != nil || sr.InstanceID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	instance, ok := reg.instance(sr.InstanceID)
+	if !ok {
+		http.Error(w, "instance not found", http.StatusNotFound)
+		return
+	}
+	actor, err := authenticate(r, body, instance.ServiceName)
+	if err != nil {
+		log.Printf("Rejecting session for %v: %v", sr.InstanceID, err)
+		writeAuthError(w, err)
+		return
+	}
+	id, created := newID(), time.Now()
+	outcome, err := reg.writeKV(walEntry{Op: opSessionCreate, Session: id, ID: sr.InstanceID, Created: &created})
+	if errors.Is(err, errNotLeader) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !outcome.OK { // 提交之前实例被移除或者变成了 critical
+		http.Error(w, "instance is not healthy", http.StatusConflict)
+		return
+	}
+	session, _ := reg.session(id)
+	e := auditInstance(auditSession, instance, r, actor)
+	e.Reason = fmt.Sprintf("created %s", id)
+	recordAudit(e)
+	writeJSON(w, http.StatusCreated, session)
+}
+
+func (s SessionService) destroy(w http.ResponseWriter, r *http.Request, id string) {
+	if reg.forwardToLeader(w, r) {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	session, ok := reg.session(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	actor, err := authenticate(r, body, session.Service)
+	if err != nil {
+		log.Printf("Rejecting destroy of session %v: %v", id, err)
+		writeAuthError(w, err)
+		return
+	}
+	_, err = reg.writeKV(walEntry{Op: opSessionDestroy, Session: id})
+	if errors.Is(err, errNotLeader) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	e := auditInstance(auditSession, Registration{ServiceName: session.Service, InstanceID: session.InstanceID}, r, actor)
+	e.Reason = fmt.Sprintf("destroyed %s", id)
+	recordAudit(e)
+}
@@ -0,0 +1,245 @@
+package registry
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 给实例 instanceID 创建会话 id，返回是否创建成功
+func createSession(t *testing.T, r *registry, id, instanceID string) bool {
+	t.Helper()
+	outcome, err := r.writeKV(walEntry{Op: opSessionCreate, Session: id, ID: instanceID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return outcome.OK
+}
+
+func acquire(t *testing.T, r *registry, key, value, session string) bool {
+	t.Helper()
+	outcome, err := r.writeKV(walEntry{Op: opKVPut, Key: key, Value: value, Acquire: session})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return outcome.OK
+}
+
+// 实例变成 critical、注销、租约过期时，它的会话失效，持有的锁释放，key 和值保留
+func TestSessionInvalidation(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	for name, invalidate := range map[string]func(r *registry){
+		"critical":     func(r *registry) { r.apply(walEntry{Op: opStatus, ID: "grading-1", Status: statusCritical}) },
+		"deregistered": func(r *registry) { r.remove("grading-1") },
+		"lease expiry": func(r *registry) { r.expireLeasesAt(time.Now().Add(2 * time.Minute)) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := newRegistry()
+			addLeased(r, "grading-1", time.Minute)
+			r.apply(walEntry{Op: opAdd, Registration: grading("grading-2")})
+			if !createSession(t, r, "s1", "grading-1") || !createSession(t, r, "s2", "grading-2") {
+				t.Fatal("sessions for passing instances not created")
+			}
+			if !acquire(t, r, "locks/a", "one", "s1") || !acquire(t, r, "locks/b", "two", "s2") {
+				t.Fatal("free locks not acquired")
+			}
+
+			invalidate(r)
+			if _, ok := r.session("s1"); ok {
+				t.Fatal("session of the invalidated instance still exists")
+			}
+			if pair, _, ok := r.getKV("locks/a"); !ok || pair.Session != "" || pair.Value != "one" {
+				t.Fatalf("locks/a = %+v (exists %v), want the value kept and the lock released", pair, ok)
+			}
+			if _, ok := r.session("s2"); !ok {
+				t.Fatal("session of another instance invalidated")
+			}
+			if pair, _, _ := r.getKV("locks/b"); pair.Session != "s2" {
+				t.Fatalf("lock of another instance released: %+v", pair)
+			}
+			if createSession(t, r, "s3", "grading-1") {
+				t.Fatal("session created for an invalidated instance")
+			}
+			if !acquire(t, r, "locks/a", "two", "s2") {
+				t.Fatal("released lock not acquired by another session")
+			}
+		})
+	}
+}
+
+// 锁被别的会话拿着时 acquire 返回 409 和当前的 key，持有者自己再 acquire 只更新值
+func TestAcquireConflict(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	t.Cleanup(func() { reg.writeKV(walEntry{Op: opKVDelete, Key: "test-locks", Recurse: true}) }) // 实例移除、锁释放之后才能删
+	for _, id := range []string{"lock-1", "lock-2"} {
+		reg.apply(walEntry{Op: opAdd, Registration: grading(id)})
+		id := id
+		t.Cleanup(func() { reg.remove(id) })
+	}
+	createSession(t, &reg, "lock-s1", "lock-1")
+	createSession(t, &reg, "lock-s2", "lock-2")
+
+	put := func(query, value string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		KVService{}.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/kv/test-locks/a?"+query, strings.NewReader(value)))
+		return w
+	}
+	if w := put("acquire=lock-s1", "one"); w.Code != http.StatusOK {
+		t.Fatalf("acquire a free lock: %d", w.Code)
+	}
+	w := put("acquire=lock-s2", "two")
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), `"Session":"lock-s1"`) {
+		t.Fatalf("acquire a held lock: %d %s, want 409 with the holder", w.Code, w.Body.String())
+	}
+	if w := put("release=lock-s2", ""); w.Code != http.StatusConflict {
+		t.Fatalf("release someone else's lock: %d, want 409", w.Code)
+	}
+	if w := put("acquire=lock-s1", "three"); w.Code != http.StatusOK {
+		t.Fatalf("holder acquiring again: %d", w.Code)
+	}
+	if w := put("acquire=nope", "four"); w.Code != http.StatusNotFound {
+		t.Fatalf("acquire with an unknown session: %d, want 404", w.Code)
+	}
+	if pair, _, _ := reg.getKV("test-locks/a"); pair.Session != "lock-s1" || pair.Value != "three" {
+		t.Fatalf("test-locks/a = %+v, want held by lock-s1 with value three", pair)
+	}
+}
+
+// 锁着的 key 不带 acquire、release 的写和删除（包括删前缀）都返回 409，持有者的值和锁不变；释放之后才能删
+func TestHeldLockWrites(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	t.Cleanup(func() { reg.writeKV(walEntry{Op: opKVDelete, Key: "test-elections", Recurse: true}) })
+	reg.apply(walEntry{Op: opAdd, Registration: grading("held-1")})
+	t.Cleanup(func() { reg.remove("held-1") })
+	if !createSession(t, &reg, "held-s1", "held-1") || !acquire(t, &reg, "test-elections/grading", "http://held-1", "held-s1") {
+		t.Fatal("free lock not acquired")
+	}
+
+	request := func(method, target, value string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		KVService{}.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(value)))
+		return w
+	}
+	for name, target := range map[string]struct{ method, path string }{
+		"put":              {http.MethodPut, "/kv/test-elections/grading"},
+		"delete":           {http.MethodDelete, "/kv/test-elections/grading"},
+		"recursive delete": {http.MethodDelete, "/kv/test-elections?recurse"},
+		"delete all":       {http.MethodDelete, "/kv/?recurse"},
+	} {
+		if w := request(target.method, target.path, "http://attacker"); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), `"Session":"held-s1"`) {
+			t.Fatalf("%s of a held lock: %d %s, want 409 with the holder", name, w.Code, w.Body.String())
+		}
+		if pair, _, ok := reg.getKV("test-elections/grading"); !ok || pair.Session != "held-s1" || pair.Value != "http://held-1" {
+			t.Fatalf("after %s: test-elections/grading = %+v (exists %v), want held by held-s1", name, pair, ok)
+		}
+	}
+
+	if w := request(http.MethodPut, "/kv/test-elections/grading?release=held-s1", "http://held-1"); w.Code != http.StatusOK {
+		t.Fatalf("holder releasing: %d", w.Code)
+	}
+	if w := request(http.MethodDelete, "/kv/test-elections?recurse", ""); w.Code != http.StatusOK {
+		t.Fatalf("delete after release: %d", w.Code)
+	}
+	if _, _, ok := reg.getKV("test-elections/grading"); ok {
+		t.Fatal("released key not deleted")
+	}
+}
+
+// leader 的会话失效后它的 lead 被取消，等着的参与者接任
+func TestCampaignHandoff(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	mux := http.NewServeMux()
+	mux.Handle("/kv/", KVService{})
+	mux.Handle("/sessions", SessionService{})
+	mux.Handle("/sessions/", SessionService{})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	withRegistryURLs(t)
+	SetRegistryURLs(srv.URL + "/services")
+
+	owner := Registration{ServiceName: GradingService, ServiceURL: "http://campaign-1", InstanceID: "campaign-1"}
+	reg.apply(walEntry{Op: opAdd, Registration: &owner})
+	instances.mutex.Lock()
+	instances.regs[owner.ServiceURL] = owner
+	instances.mutex.Unlock()
+	defer func() {
+		instances.mutex.Lock()
+		delete(instances.regs, owner.ServiceURL)
+		instances.mutex.Unlock()
+		reg.remove(owner.InstanceID)
+		reg.writeKV(walEntry{Op: opKVDelete, Key: electionPrefix + "test-handoff"})
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	leading := make(chan string, 2)
+	deposed := make(chan struct{})
+	done := make(chan error, 2)
+	go func() {
+		done <- Campaign(ctx, "test-handoff", "a", func(ctx context.Context) {
+			leading <- "a"
+			<-ctx.Done()
+			close(deposed)
+		})
+	}()
+	if got := <-leading; got != "a" {
+		t.Fatalf("first leader %s, want a", got)
+	}
+	if value, ok, err := Leader("test-handoff"); err != nil || !ok || value != "a" {
+		t.Fatalf("Leader = %q, %v, %v; want a", value, ok, err)
+	}
+
+	resign := make(chan struct{})
+	go func() {
+		done <- Campaign(ctx, "test-handoff", "b", func(ctx context.Context) {
+			leading <- "b"
+			<-resign
+		})
+	}()
+	select {
+	case got := <-leading:
+		t.Fatalf("%s leading while a still holds the lock", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	pair, _, _ := reg.getKV(electionPrefix + "test-handoff")
+	if _, err := reg.writeKV(walEntry{Op: opSessionDestroy, Session: pair.Session}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-deposed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lead of a not cancelled after its session was destroyed")
+	}
+	select {
+	case got := <-leading:
+		if got != "b" {
+			t.Fatalf("next leader %s, want b", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("b did not take over")
+	}
+	if value, ok, err := Leader("test-handoff"); err != nil || !ok || value != "b" {
+		t.Fatalf("Leader after the handoff = %q, %v, %v; want b", value, ok, err)
+	}
+
+	close(resign)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatalf("Campaign: %v", err)
+		}
+	}
+	if _, ok, err := Leader("test-handoff"); err != nil || ok {
+		t.Fatalf("Leader after both resigned: ok %v, err %v", ok, err)
+	}
+}
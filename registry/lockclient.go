@@ -0,0 +1,290 @@
+/*
+	锁和选主的客户端，会话属于本进程注册的实例，实例心跳失败、注销时注册中心会释放它拿着的锁
+		lock := registry.NewLock("locks/nightly-report", "")
+		lost, err := lock.Lock(ctx) // 拿到锁才返回，ctx 取消时返回 ctx.Err()
+		...                         // lost 被 close 说明锁已经被释放了（比如心跳失败），应该停下手上的事
+		lock.Unlock()
+
+		registry.Campaign(ctx, "grading-seeder", serviceURL, func(ctx context.Context) { ... })
+		url, ok, err := registry.Leader("grading-seeder")
+	必须先 RegisterService，没有注册过的进程拿不到会话
+*/
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	electionPrefix = "elections/"
+	lockRetryDelay = 1 * time.Second // 注册中心出错时隔多久再试
+)
+
+var errSessionNotFound = errors.New("session not found")
+
+// 会话属于哪个实例，注册了多个服务时总是选同一个
+func sessionOwner() (Registration, error) {
+	var instance Registration
+	instances.mutex.Lock()
+	defer instances.mutex.Unlock()
+	for _, r := range instances.regs {
+		if instance.InstanceID == "" || r.ServiceURL < instance.ServiceURL {
+			instance = r
+		}
+	}
+	if instance.InstanceID == "" {
+		return instance, errors.New("no service registered by this process")
+	}
+	return instance, nil
+}
+
+// 用本进程注册的实例创建一个会话
+func CreateSession() (Session, error) {
+	var session Session
+	instance, err := sessionOwner()
+	if err != nil {
+		return session, err
+	}
+	data, err := json.Marshal(sessionRequest{InstanceID: instance.InstanceID})
+	if err != nil {
+		return session, err
+	}
+	res, err := callRegistry(ClientFor(RegistryService, 0), func(servicesUrl string) (*http.Request, error) {
+		return newSignedRequest(http.MethodPost, sessionsURL(servicesUrl, ""), instance.ServiceName, data)
+	})
+	if err != nil {
+		return session, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return session, fmt.Errorf("failed to create session for %v. registry service responsed with code %v", instance.ServiceName, res.StatusCode)
+	}
+	err = json.NewDecoder(res.Body).Decode(&session)
+	return session, err
+}
+
+// 销毁会话，释放它拿着的锁；会话已经不存在不算错误
+func DestroySession(id string) error {
+	instance, err := sessionOwner()
+	if err != nil {
+		return err
+	}
+	res, err := callRegistry(ClientFor(RegistryService, 0), func(servicesUrl string) (*http.Request, error) {
+		return newSignedRequest(http.MethodDelete, sessionsURL(servicesUrl, id), instance.ServiceName, nil)
+	})
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to destroy session %s. registry service responsed with code %v", id, res.StatusCode)
+	}
+	return nil
+}
+
+func sessionsURL(servicesUrl, id string) string {
+	u := strings.TrimSuffix(servicesUrl, "/services") + "/sessions"
+	if id != "" {
+		u += "/" + url.PathEscape(id)
+	}
+	return u
+}
+
+// PUT /kv/{key}?acquire=S 或者 ?release=S，锁被别人拿着时返回 ErrKVConflict，会话失效时返回 errSessionNotFound
+func lockKV(key, value, op, session string) (KVPair, error) {
+	var pair KVPair
+	res, err := kvRequest(context.Background(), http.MethodPut, key, url.Values{op: {session}}, []byte(value))
+	if err != nil {
+		return pair, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		err = json.NewDecoder(res.Body).Decode(&pair)
+		return pair, err
+	case http.StatusConflict:
+		return pair, fmt.Errorf("%w: key %s is locked", ErrKVConflict, key)
+	case http.StatusNotFound:
+		return pair, fmt.Errorf("%w: %s", errSessionNotFound, session)
+	}
+	return pair, fmt.Errorf("failed to %s key %s. registry service responsed with code %v", op, key, res.StatusCode)
+}
+
+type Lock struct {
+	key     string
+	value   string
+	session string
+	stop    context.CancelFunc // 停止监视锁
+	mutex   *sync.Mutex
+}
+
+// value 是拿到锁时写进 key 的值，比如自己的地址
+func NewLock(key, value string) *Lock {
+	return &Lock{key: key, value: value, mutex: new(sync.Mutex)}
+}
+
+/*
+	一直等到拿到锁，ctx 取消时返回 ctx.Err()
+	拿到锁后返回的 channel 在锁被释放（会话失效、key 被删掉）时被 close，Unlock 之后不会再被 close
+*/
+func (l *Lock) Lock(ctx context.Context) (<-chan struct{}, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.stop != nil {
+		return nil, errors.New("lock already held")
+	}
+	for ctx.Err() == nil {
+		if l.session == "" {
+			session, err := CreateSession()
+			if err != nil {
+				log.Println(err)
+				sleepContext(ctx, lockRetryDelay)
+				continue
+			}
+			l.session = session.ID
+		}
+		pair, err := lockKV(l.key, l.value, "acquire", l.session)
+		switch {
+		case err == nil:
+			lost := make(chan struct{})
+			monitor, stop := context.WithCancel(context.Background())
+			l.stop = stop
+			go l.monitor(monitor, pair.ModRevision, lost)
+			return lost, nil
+		case errors.Is(err, ErrKVConflict): // 被别人拿着，等它释放再抢
+			err = waitUnlocked(ctx, l.key)
+			if err != nil && ctx.Err() == nil {
+				log.Println(err)
+				sleepContext(ctx, lockRetryDelay)
+			}
+		case errors.Is(err, errSessionNotFound): // 会话已经失效（比如心跳失败过），换一个
+			l.session = ""
+		default:
+			log.Println(err)
+			sleepContext(ctx, lockRetryDelay)
+		}
+	}
+	if l.session != "" { // 没拿到锁，会话也不用留着了
+		DestroySession(l.session)
+		l.session = ""
+	}
+	return nil, ctx.Err()
+}
+
+// 释放锁并销毁会话
+func (l *Lock) Unlock() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.stop == nil {
+		return errors.New("lock not held")
+	}
+	l.stop()
+	l.stop = nil
+	_, err := lockKV(l.key, l.value, "release", l.session)
+	if err != nil && !errors.Is(err, ErrKVConflict) && !errors.Is(err, errSessionNotFound) { // 锁已经丢了也算释放了
+		log.Println(err)
+	}
+	session := l.session
+	l.session = ""
+	return DestroySession(session)
+}
+
+// watch 这个 key，锁不再是自己的时 close lost
+func (l *Lock) monitor(ctx context.Context, index uint64, lost chan struct{}) {
+	for ctx.Err() == nil {
+		result, err := watchKVOnce(ctx, l.key, index)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Println(err)
+				sleepContext(ctx, lockRetryDelay)
+			}
+			continue
+		}
+		index = result.Index
+		pair, exists, seen := latestPair(result, l.key)
+		if seen && (!exists || pair.Session != l.session) && ctx.Err() == nil {
+			log.Printf("lost lock %s", l.key)
+			close(lost)
+			return
+		}
+	}
+}
+
+// 等到 key 没有被锁住
+func waitUnlocked(ctx context.Context, key string) error {
+	var index uint64
+	for {
+		result, err := watchKVOnce(ctx, key, index)
+		if err != nil {
+			return err
+		}
+		pair, exists, seen := latestPair(result, key)
+		if (result.Reset && !seen) || (seen && (!exists || pair.Session == "")) {
+			return nil
+		}
+		index = result.Index
+	}
+}
+
+/*
+	watch 结果里 key 自己（不包括前缀下的其他 key）最后的样子
+	seen 为 false 表示结果里没有它：Reset 时说明 key 不存在，否则说明它没有变化
+*/
+func latestPair(result kvWatchResult, key string) (pair KVPair, exists bool, seen bool) {
+	for _, e := range result.Events {
+		if e.Pair.Key == key {
+			pair, exists, seen = e.Pair, e.Type == "put", true
+		}
+	}
+	return
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+/*
+	选主：name 相同的参与者里同一时间只有一个在执行 lead
+	- 拿到 elections/{name} 这把锁后调用 lead，失去领导权（比如心跳失败）或者 ctx 取消时 lead 的 ctx 被取消
+	- lead 返回后让出领导权，Campaign 返回；value 写在 key 里，其他人用 Leader 查到，一般是自己的 ServiceURL
+	想一直参选的话在循环里调用 Campaign
+*/
+func Campaign(ctx context.Context, name, value string, lead func(ctx context.Context)) error {
+	lock := NewLock(electionPrefix+name, value)
+	lost, err := lock.Lock(ctx)
+	if err != nil {
+		return err
+	}
+	leadCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-lost:
+			cancel()
+		case <-leadCtx.Done():
+		}
+	}()
+	lead(leadCtx)
+	cancel()
+	return lock.Unlock()
+}
+
+// 当前 leader 写在 key 里的值，没有 leader 时 ok 为 false
+func Leader(name string) (string, bool, error) {
+	pair, ok, err := GetKV(electionPrefix + name)
+	if err != nil || !ok || pair.Session == "" {
+		return "", false, err
+	}
+	return pair.Value, true, nil
+}
@@ -0,0 +1,87 @@
+/*
+	维护状态：实例仍然注册着、照常做健康检查，但状态对外显示为 maintenance，客户端不会再选它
+		PUT    /services/{name}/instances/{id}/maintenance   进入维护，Body 可以带 {"Reason": "..."}
+		DELETE /services/{name}/instances/{id}/maintenance   退出维护
+	和注销一样要认证：实例自己的密钥，或者管理员的密钥（控制台用）
+	实例重新注册后自动退出维护
+	服务自己用 SetMaintenance 进入维护；service.Start 下线时先进入维护（draining），请求处理完再注销
+*/
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+)
+
+type maintenanceRequest struct {
+	Reason string `json:",omitempty"`
+}
+
+func (r *registry) setMaintenance(id string, enable bool, reason string) error {
+	return r.commit(walEntry{Op: opMaintenance, ID: id, Maintenance: enable, Reason: reason})
+}
+
+// pathSegments: ["", "services", name, "instances", id, "maintenance"]
+func (s RegistrationService) serveMaintenance(w http.ResponseWriter, r *http.Request, pathSegments []string) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if reg.forwardToLeader(w, r) {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var mr maintenanceRequest
+	if r.Method == http.MethodPut && len(body) > 0 {
+		err = json.Unmarshal(body, &mr)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	id := pathSegments[4]
+	instance, ok := reg.instance(id)
+	if !ok || instance.ServiceName != ServiceName(pathSegments[2]) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	actor, err := authenticate(r, body, instance.ServiceName)
+	if err != nil {
+		log.Printf("Rejecting maintenance change of %v: %v", id, err)
+		e := auditInstance(auditRejected, instance, r, "")
+		e.Reason = fmt.Sprintf("%s maintenance: %v", r.Method, err)
+		recordAudit(e)
+		writeAuthError(w, err)
+		return
+	}
+
+	enable := r.Method == http.MethodPut
+	log.Printf("Setting maintenance=%v for %v with %v: %s", enable, instance.ServiceName, instance.ServiceURL, mr.Reason)
+	err = reg.setMaintenance(id, enable, mr.Reason)
+	if errors.Is(err, errNotLeader) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	e := auditInstance(auditMaintenance, instance, r, actor)
+	if enable {
+		e.Status, e.Reason = statusMaintenance, mr.Reason
+	} else {
+		e.Reason = "resumed"
+	}
+	recordAudit(e)
+}
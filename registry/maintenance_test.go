@@ -0,0 +1,105 @@
+package registry
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func maintenanceStatus(r *registry, id string) string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, reg := range r.registrations {
+		if reg.InstanceID == id {
+			return r.entry(reg).Status
+		}
+	}
+	return ""
+}
+
+// 实例自己的密钥和管理员的密钥都能进入、退出维护，别的服务的密钥返回 403，没签名或者密钥不对返回 401
+func TestMaintenanceAuth(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	withKeys(t, map[ServiceName][]byte{
+		GradingService: []byte("grading"),
+		AdminService:   []byte("admin"),
+		LogService:     []byte("log"),
+	})
+	reg.apply(walEntry{Op: opAdd, Registration: grading("maintenance-1")})
+	defer reg.remove("maintenance-1")
+	const target = "http://registry/services/GradingService/instances/maintenance-1/maintenance"
+
+	send := func(method string, signer ServiceName, body []byte) int {
+		t.Helper()
+		req, err := newSignedRequest(method, target, signer, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		RegistrationService{}.ServeHTTP(w, req)
+		return w.Code
+	}
+	for _, signer := range []ServiceName{GradingService, AdminService} {
+		if code := send(http.MethodPut, signer, []byte(`{"Reason":"upgrade"}`)); code != http.StatusOK {
+			t.Fatalf("PUT signed by %v: %d", signer, code)
+		}
+		if status := maintenanceStatus(&reg, "maintenance-1"); status != statusMaintenance {
+			t.Fatalf("after PUT by %v: status = %q, want maintenance", signer, status)
+		}
+		if code := send(http.MethodDelete, signer, nil); code != http.StatusOK {
+			t.Fatalf("DELETE signed by %v: %d", signer, code)
+		}
+		if status := maintenanceStatus(&reg, "maintenance-1"); status != statusPassing {
+			t.Fatalf("after DELETE by %v: status = %q, want passing", signer, status)
+		}
+	}
+
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		if code := send(method, LogService, nil); code != http.StatusForbidden {
+			t.Fatalf("%s signed by another service: %d, want 403", method, code)
+		}
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "Bearer not-the-key")
+		w := httptest.NewRecorder()
+		RegistrationService{}.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("%s with a wrong key: %d, want 401", method, w.Code)
+		}
+	}
+	if status := maintenanceStatus(&reg, "maintenance-1"); status != statusPassing {
+		t.Fatalf("rejected requests changed the status to %q", status)
+	}
+}
+
+// 维护中的实例照常推送给依赖方，但客户端不会选它
+func TestProvidersSkipMaintenance(t *testing.T) {
+	withProviders(t, GradingService)
+	prov.services[GradingService] = []patchEntry{
+		{Name: GradingService, ID: "grading-1", URL: "http://grading-1", Status: statusPassing},
+		{Name: GradingService, ID: "grading-2", URL: "http://grading-2", Status: statusMaintenance},
+	}
+	if urls := prov.get(GradingService); len(urls) != 1 || urls[0] != "http://grading-1" {
+		t.Fatalf("providers = %v, want only the instance not in maintenance", urls)
+	}
+	if usable(patchEntry{Status: statusMaintenance}) {
+		t.Fatal("an instance in maintenance is usable")
+	}
+}
+
+// 重新注册的实例自动退出维护
+func TestReregisterClearsMaintenance(t *testing.T) {
+	r := newRegistry()
+	r.apply(walEntry{Op: opAdd, Registration: grading("grading-1")})
+	r.apply(walEntry{Op: opMaintenance, ID: "grading-1", Maintenance: true, Reason: "draining"})
+	if status := maintenanceStatus(r, "grading-1"); status != statusMaintenance {
+		t.Fatalf("status = %q, want maintenance", status)
+	}
+	r.apply(walEntry{Op: opAdd, Registration: grading("grading-1")})
+	if status := maintenanceStatus(r, "grading-1"); status != statusPassing {
+		t.Fatalf("status after re-registering = %q, want passing", status)
+	}
+}
@@ -0,0 +1,796 @@
+/*
+	注册中心集群（简化版 Raft）
+	- 3 或 5 个 registryservice 组成一个集群，每个节点用自己的地址（如 http://localhost:3000）作为 ID
+	- leader 选举：follower 在选举超时内没收到 leader 的心跳，就自增 term 变成 candidate 拉票，拿到多数票成为 leader
+	- 日志复制：注册表的 add/remove 作为日志条目由 leader 复制给 follower，多数节点确认后提交，各节点按顺序 apply
+	- follower 收到写请求（POST/DELETE /services）时转发给 leader
+	- 日志太长时各节点把注册表写成快照、丢掉之前的日志，落后太多的 follower 由 leader 直接发快照，见 raftlog.go
+	- 节点之间通过 HTTP + JSON 通信：
+		POST /raft/vote      拉票
+		POST /raft/append    追加日志/心跳
+		POST /raft/snapshot  安装快照
+		GET  /raft/status    查看本节点状态，方便测试时找到 leader
+	  POST 要求对方出示注册中心的证书（mTLS），或者带着 Registry.key 的签名，见 auth.go 的 authenticateRaft
+*/
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type raftRole string
+
+const (
+	follower  = raftRole("follower")
+	candidate = raftRole("candidate")
+	leader    = raftRole("leader")
+)
+
+const (
+	raftHeartbeatInterval = 300 * time.Millisecond
+	raftElectionTimeout   = 1500 * time.Millisecond // 实际超时在 [1x, 2x) 之间随机，避免多个节点同时拉票
+	raftProposeTimeout    = 3 * time.Second
+)
+
+var errNotLeader = errors.New("this registry node is not the leader")
+
+type raftEntry struct {
+	Index   int `json:",omitempty"`
+	Term    int
+	Command walEntry
+}
+
+type raftNode struct {
+	id            string              // 本节点地址
+	peers         []string            // 其他节点地址
+	dir           string              // 持久化目录，为空不持久化
+	apply         func(walEntry)      // 提交后的日志交给注册表
+	capture       func() snapshotData // 注册表现在的样子，写快照用
+	restore       func(snapshotData)  // 用快照整体替换注册表
+	snapshotEvery int                 // 已经 apply 的日志超过这么多条就写快照
+	applyMutex    *sync.Mutex         // apply 日志和安装快照不能同时进行
+	done          chan struct{}       // 被 close 后节点停止工作
+
+	mutex           *sync.Mutex
+	role            raftRole
+	currentTerm     int
+	votedFor        string
+	log             []raftEntry   // log[0] 是哨兵，Index、Term 是最近一次快照的，没有快照时都是 0
+	snap            *raftSnapshot // 最近一次快照，发给落后太多的 follower
+	logFile         *os.File      // raft.log，只追加
+	commitIndex     int
+	lastApplied     int
+	leaderID        string
+	nextIndex       map[string]int
+	matchIndex      map[string]int
+	sending         map[string]bool // 正在给这些 follower 发快照，发完之前不重复发
+	lastContact     time.Time       // 最近一次收到 leader 消息或投出选票的时间
+	electionTimeout time.Duration
+	waiters         map[int]chan error // propose 等待自己的条目被 apply
+	applyCh         chan struct{}
+	client          *http.Client
+}
+
+// dir 下有快照时先用它还原 r，之后的日志等 leader 告诉我们提交到哪了再 apply
+func newRaftNode(id string, peers []string, dir string, r *registry) (*raftNode, error) {
+	n := &raftNode{
+		id:            id,
+		peers:         peers,
+		dir:           dir,
+		apply:         r.apply,
+		capture:       r.clusterSnapshot,
+		restore:       r.restoreSnapshot,
+		snapshotEvery: raftSnapshotEntries,
+		applyMutex:    new(sync.Mutex),
+		done:          make(chan struct{}),
+		mutex:         new(sync.Mutex),
+		role:          follower,
+		log:           []raftEntry{{}},
+		nextIndex:     make(map[string]int),
+		matchIndex:    make(map[string]int),
+		sending:       make(map[string]bool),
+		lastContact:   time.Now(),
+		waiters:       make(map[int]chan error),
+		applyCh:       make(chan struct{}, 1),
+		client:        ClientFor(RegistryService, 500*time.Millisecond),
+	}
+	n.resetElectionTimeout()
+	if dir == "" {
+		return n, nil
+	}
+	err := n.load()
+	if err != nil {
+		return nil, err
+	}
+	if n.snap != nil {
+		n.restore(n.snap.State)
+	}
+	return n, nil
+}
+
+func (n *raftNode) run() {
+	go n.ticker()
+	go n.applier()
+}
+
+// 停止选举、复制和 apply，不再响应其他节点（测试里用来模拟节点宕机）
+func (n *raftNode) stop() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	select {
+	case <-n.done:
+		return
+	default:
+	}
+	close(n.done)
+	n.role = follower
+	for index, done := range n.waiters {
+		done <- errNotLeader
+		delete(n.waiters, index)
+	}
+	if n.logFile != nil {
+		n.logFile.Close()
+	}
+}
+
+func (n *raftNode) stopped() bool {
+	select {
+	case <-n.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (n *raftNode) isLeader() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.role == leader
+}
+
+func (n *raftNode) leaderURL() string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.leaderID
+}
+
+// 调用方需持有 n.mutex
+func (n *raftNode) resetElectionTimeout() {
+	n.electionTimeout = raftElectionTimeout + time.Duration(rand.Int63n(int64(raftElectionTimeout)))
+}
+
+// 最后一条日志的下标；调用方需持有 n.mutex
+func (n *raftNode) lastIndex() int {
+	return n.log[0].Index + len(n.log) - 1
+}
+
+// index 不能比快照旧；调用方需持有 n.mutex
+func (n *raftNode) term(index int) int {
+	return n.log[index-n.log[0].Index].Term
+}
+
+// index 之后的日志；调用方需持有 n.mutex
+func (n *raftNode) entriesAfter(index int) []raftEntry {
+	entries := make([]raftEntry, n.lastIndex()-index)
+	copy(entries, n.log[index-n.log[0].Index+1:])
+	return entries
+}
+
+// 集群节点总数的多数
+func (n *raftNode) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+/*
+	leader 追加一条日志并等待它被提交、在本节点 apply 完成
+	非 leader 直接返回 errNotLeader，由调用方转发给 leader
+*/
+func (n *raftNode) propose(e walEntry) error {
+	n.mutex.Lock()
+	if n.role != leader {
+		n.mutex.Unlock()
+		return errNotLeader
+	}
+	index := n.lastIndex() + 1
+	entry := raftEntry{Index: index, Term: n.currentTerm, Command: e}
+	n.log = append(n.log, entry)
+	n.appendLog(entry)
+	done := make(chan error, 1)
+	n.waiters[index] = done
+	n.advanceCommit() // 单节点集群直接就能提交
+	n.mutex.Unlock()
+
+	n.broadcast()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(raftProposeTimeout):
+		n.mutex.Lock()
+		delete(n.waiters, index)
+		n.mutex.Unlock()
+		return fmt.Errorf("timed out waiting for registry entry %d to commit", index)
+	}
+}
+
+func (n *raftNode) ticker() {
+	lastBroadcast := time.Time{}
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+		n.mutex.Lock()
+		role := n.role
+		timedOut := time.Since(n.lastContact) > n.electionTimeout
+		n.mutex.Unlock()
+
+		switch {
+		case role == leader && time.Since(lastBroadcast) >= raftHeartbeatInterval:
+			lastBroadcast = time.Now()
+			n.broadcast()
+		case role != leader && timedOut:
+			n.startElection()
+		}
+	}
+}
+
+type voteRequest struct {
+	Term         int
+	CandidateID  string
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+type voteResponse struct {
+	Term        int
+	VoteGranted bool
+}
+
+func (n *raftNode) startElection() {
+	n.mutex.Lock()
+	n.role = candidate
+	n.currentTerm++
+	n.votedFor = n.id
+	n.leaderID = ""
+	n.lastContact = time.Now()
+	n.resetElectionTimeout()
+	n.saveState()
+	term := n.currentTerm
+	req := voteRequest{
+		Term:         term,
+		CandidateID:  n.id,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.log[len(n.log)-1].Term,
+	}
+	n.mutex.Unlock()
+	log.Printf("[Raft] %s starting election for term %d", n.id, term)
+
+	votes := 1
+	if votes >= n.quorum() {
+		n.mutex.Lock()
+		n.becomeLeader()
+		n.mutex.Unlock()
+		return
+	}
+	for _, peer := range n.peers {
+		go func(peer string) {
+			var res voteResponse
+			err := n.call(peer, "/raft/vote", req, &res)
+			if err != nil {
+				return
+			}
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+			if res.Term > n.currentTerm {
+				n.stepDown(res.Term)
+				return
+			}
+			if n.role != candidate || n.currentTerm != term || !res.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// 调用方需持有 n.mutex
+func (n *raftNode) becomeLeader() {
+	log.Printf("[Raft] %s became leader for term %d", n.id, n.currentTerm)
+	n.role = leader
+	n.leaderID = n.id
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+	}
+	// 新 leader 只能通过提交本任期的条目来间接提交之前任期的条目，所以先追加一条空操作
+	noop := raftEntry{Index: n.lastIndex() + 1, Term: n.currentTerm, Command: walEntry{Op: opNoop}}
+	n.log = append(n.log, noop)
+	n.appendLog(noop)
+	n.advanceCommit()
+	go n.broadcast()
+}
+
+// 发现更高的 term，退回 follower；调用方需持有 n.mutex
+func (n *raftNode) stepDown(term int) {
+	if term > n.currentTerm {
+		n.currentTerm = term
+		n.votedFor = ""
+		n.saveState()
+	}
+	if n.role == leader {
+		log.Printf("[Raft] %s stepping down in term %d", n.id, n.currentTerm)
+	}
+	n.role = follower
+	for index, done := range n.waiters {
+		done <- errNotLeader
+		delete(n.waiters, index)
+	}
+}
+
+func (n *raftNode) handleVote(req voteRequest) voteResponse {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if req.Term > n.currentTerm {
+		n.stepDown(req.Term)
+	}
+	res := voteResponse{Term: n.currentTerm}
+	if req.Term < n.currentTerm {
+		return res
+	}
+	// 候选人的日志至少要和自己一样新，才能投票
+	lastTerm := n.log[len(n.log)-1].Term
+	upToDate := req.LastLogTerm > lastTerm ||
+		(req.LastLogTerm == lastTerm && req.LastLogIndex >= n.lastIndex())
+	if (n.votedFor == "" || n.votedFor == req.CandidateID) && upToDate {
+		n.votedFor = req.CandidateID
+		n.lastContact = time.Now()
+		n.saveState()
+		res.VoteGranted = true
+	}
+	return res
+}
+
+type appendRequest struct {
+	Term         int
+	LeaderID     string
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []raftEntry
+	LeaderCommit int
+}
+
+type appendResponse struct {
+	Term      int
+	Success   bool
+	LastIndex int // 失败时告诉 leader 自己的日志到哪了，让 leader 一次退到位
+}
+
+func (n *raftNode) broadcast() {
+	for _, peer := range n.peers {
+		go n.replicate(peer)
+	}
+}
+
+func (n *raftNode) replicate(peer string) {
+	n.mutex.Lock()
+	if n.role != leader {
+		n.mutex.Unlock()
+		return
+	}
+	term := n.currentTerm
+	prev := n.nextIndex[peer] - 1
+	if prev < n.log[0].Index { // 需要的日志已经压缩进快照了
+		if n.sending[peer] {
+			n.mutex.Unlock()
+			return
+		}
+		n.sending[peer] = true
+		snap := *n.snap
+		n.mutex.Unlock()
+		n.sendSnapshot(peer, term, snap)
+		return
+	}
+	req := appendRequest{
+		Term:         term,
+		LeaderID:     n.id,
+		PrevLogIndex: prev,
+		PrevLogTerm:  n.term(prev),
+		Entries:      n.entriesAfter(prev),
+		LeaderCommit: n.commitIndex,
+	}
+	entries := req.Entries
+	n.mutex.Unlock()
+
+	var res appendResponse
+	err := n.call(peer, "/raft/append", req, &res)
+	if err != nil {
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if res.Term > n.currentTerm {
+		n.stepDown(res.Term)
+		return
+	}
+	if n.role != leader || n.currentTerm != term {
+		return
+	}
+	if res.Success {
+		match := prev + len(entries)
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		n.nextIndex[peer] = n.matchIndex[peer] + 1
+		n.advanceCommit()
+		return
+	}
+	next := n.nextIndex[peer] - 1
+	if res.LastIndex+1 < next {
+		next = res.LastIndex + 1
+	}
+	if next < 1 {
+		next = 1
+	}
+	n.nextIndex[peer] = next
+}
+
+type snapshotRequest struct {
+	Term     int
+	LeaderID string
+	Snapshot raftSnapshot
+}
+
+func (n *raftNode) sendSnapshot(peer string, term int, snap raftSnapshot) {
+	var res appendResponse
+	err := n.call(peer, "/raft/snapshot", snapshotRequest{Term: term, LeaderID: n.id, Snapshot: snap}, &res)
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	delete(n.sending, peer)
+	if err != nil {
+		return
+	}
+	if res.Term > n.currentTerm {
+		n.stepDown(res.Term)
+		return
+	}
+	if n.role != leader || n.currentTerm != term || !res.Success {
+		return
+	}
+	log.Printf("[Raft] sent snapshot at %d to %s", snap.LastIndex, peer)
+	if snap.LastIndex > n.matchIndex[peer] {
+		n.matchIndex[peer] = snap.LastIndex
+	}
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+	n.advanceCommit()
+}
+
+// 找到已复制到多数节点的最大下标并提交；只能直接提交本任期的条目。调用方需持有 n.mutex
+func (n *raftNode) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if n.term(index) != n.currentTerm {
+			break
+		}
+		count := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.signalApply()
+			return
+		}
+	}
+}
+
+// 调用方需持有 n.mutex
+func (n *raftNode) signalApply() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (n *raftNode) handleAppend(req appendRequest) appendResponse {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if req.Term < n.currentTerm {
+		return appendResponse{Term: n.currentTerm, LastIndex: n.lastIndex()}
+	}
+	if req.Term > n.currentTerm || n.role != follower {
+		n.stepDown(req.Term)
+	}
+	n.leaderID = req.LeaderID
+	n.lastContact = time.Now()
+	res := appendResponse{Term: n.currentTerm, LastIndex: n.lastIndex()}
+
+	if req.PrevLogIndex > n.lastIndex() {
+		return res
+	}
+	lastNew := req.PrevLogIndex + len(req.Entries)
+	prev, entries := req.PrevLogIndex, req.Entries
+	if base := n.log[0].Index; prev < base { // 快照里的日志都已经提交了，肯定和 leader 的一样
+		skip := base - prev
+		if skip > len(entries) {
+			skip = len(entries)
+		}
+		prev, entries = base, entries[skip:]
+	} else if n.term(prev) != req.PrevLogTerm {
+		res.LastIndex = prev - 1
+		return res
+	}
+
+	appended := make([]raftEntry, 0)
+	for i, entry := range entries {
+		index := prev + 1 + i
+		entry.Index = index
+		if index <= n.lastIndex() {
+			if n.term(index) == entry.Term {
+				continue
+			}
+			n.log = n.log[:index-n.log[0].Index] // 和 leader 冲突的部分全部截掉
+		}
+		n.log = append(n.log, entry)
+		appended = append(appended, entry)
+	}
+	n.appendLog(appended...)
+
+	commit := req.LeaderCommit
+	if lastNew < commit {
+		commit = lastNew
+	}
+	if commit > n.commitIndex { // 只往前走，快照之前的旧消息不能把它拉回去
+		n.commitIndex = commit
+		n.signalApply()
+	}
+	res.Success = true
+	res.LastIndex = n.lastIndex()
+	return res
+}
+
+/*
+	follower 安装 leader 发来的快照
+	自己的日志里有快照的最后一条时只丢掉之前的，否则全部丢掉；还没 apply 到快照的位置就用快照还原注册表
+*/
+func (n *raftNode) handleSnapshot(req snapshotRequest) appendResponse {
+	n.applyMutex.Lock()
+	defer n.applyMutex.Unlock()
+	n.mutex.Lock()
+	if req.Term < n.currentTerm {
+		defer n.mutex.Unlock()
+		return appendResponse{Term: n.currentTerm, LastIndex: n.lastIndex()}
+	}
+	if req.Term > n.currentTerm || n.role != follower {
+		n.stepDown(req.Term)
+	}
+	n.leaderID = req.LeaderID
+	n.lastContact = time.Now()
+	snap := req.Snapshot
+	n.compact(snap)
+	restore := snap.LastIndex > n.lastApplied
+	if restore {
+		n.lastApplied = snap.LastIndex
+	}
+	if snap.LastIndex > n.commitIndex {
+		n.commitIndex = snap.LastIndex
+	}
+	res := appendResponse{Term: n.currentTerm, Success: true, LastIndex: n.lastIndex()}
+	n.mutex.Unlock()
+
+	if restore {
+		log.Printf("[Raft] %s installed snapshot at %d", n.id, snap.LastIndex)
+		n.restore(snap.State)
+	}
+	return res
+}
+
+// 按顺序把已提交的日志交给注册表，apply 得够多了就写快照
+func (n *raftNode) applier() {
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-n.applyCh:
+		}
+		n.applyMutex.Lock()
+		n.mutex.Lock()
+		start := n.lastApplied + 1
+		entries := make([]raftEntry, n.commitIndex-n.lastApplied)
+		copy(entries, n.log[start-n.log[0].Index:n.commitIndex-n.log[0].Index+1])
+		n.lastApplied = n.commitIndex
+		n.mutex.Unlock()
+
+		for _, entry := range entries {
+			n.apply(entry.Command)
+		}
+
+		n.mutex.Lock()
+		for index, done := range n.waiters {
+			if index < start+len(entries) {
+				done <- nil
+				delete(n.waiters, index)
+			}
+		}
+		applied := n.lastApplied
+		compact := n.snapshotEvery > 0 && applied-n.log[0].Index >= n.snapshotEvery && !n.stopped()
+		n.mutex.Unlock()
+
+		if compact { // 这时注册表正好是 apply 到 applied 的样子
+			state := n.capture()
+			n.mutex.Lock()
+			n.compact(raftSnapshot{LastIndex: applied, LastTerm: n.term(applied), State: state})
+			n.mutex.Unlock()
+		}
+		n.applyMutex.Unlock()
+	}
+}
+
+func (n *raftNode) call(peer, path string, req, res interface{}) error {
+	if n.stopped() {
+		return errNotLeader
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, peer+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	signRaft(httpReq, data)
+	r, err := n.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("raft peer %s responded with code %v", peer, r.StatusCode)
+	}
+	return json.NewDecoder(r.Body).Decode(res)
+}
+
+type raftStatus struct {
+	ID          string
+	Role        raftRole
+	Term        int
+	Leader      string
+	CommitIndex int
+	LastIndex   int
+}
+
+func (n *raftNode) status() raftStatus {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return raftStatus{
+		ID:          n.id,
+		Role:        n.role,
+		Term:        n.currentTerm,
+		Leader:      n.leaderID,
+		CommitIndex: n.commitIndex,
+		LastIndex:   n.lastIndex(),
+	}
+}
+
+/*
+	开启集群模式，需在 SetupRegistryService 之前、EnableTLS 或者 EnableAuth 之后调用
+	- self：本节点地址，如 http://localhost:3000
+	- peers：其他节点地址
+	- dir：保存 Raft 的 term、投票、日志和快照；集群模式下注册表由 Raft 日志重建，不再需要 EnableStorage
+	节点之间要能认出对方：要么启用了 mTLS，要么密钥目录里有 Registry.key
+*/
+func EnableCluster(self string, peers []string, dir string) error {
+	if _, ok := clusterKey(); !ok && !TLSEnabled() {
+		return errors.New("registry nodes must authenticate each other: enable mTLS or add Registry.key to the keys directory")
+	}
+	if dir != "" {
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return err
+		}
+	}
+	addrs := make([]string, len(peers))
+	for i, peer := range peers {
+		addrs[i] = withScheme(peer) // 启用 mTLS 后 -peers 里写 http:// 也可以
+	}
+	node, err := newRaftNode(self, addrs, dir, &reg)
+	if err != nil {
+		return err
+	}
+	reg.mutex.Lock()
+	reg.raft = node
+	reg.mutex.Unlock()
+	node.run()
+	return nil
+}
+
+/*
+	集群节点之间通信的 WEB Service，挂在 /raft/ 下
+*/
+type RaftService struct{}
+
+func (s RaftService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if reg.raft == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	reg.raft.serveHTTP(w, r)
+}
+
+func (n *raftNode) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if n.stopped() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Path == "/raft/status" && r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, n.status())
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = authenticateRaft(r, body)
+	if err != nil {
+		log.Printf("[Raft] rejecting %s from %s: %v", r.URL.Path, r.RemoteAddr, err)
+		writeAuthError(w, err)
+		return
+	}
+	var res interface{}
+	switch r.URL.Path {
+	case "/raft/vote":
+		var req voteRequest
+		err = json.Unmarshal(body, &req)
+		if err == nil {
+			res = n.handleVote(req)
+		}
+	case "/raft/append":
+		var req appendRequest
+		err = json.Unmarshal(body, &req)
+		if err == nil {
+			res = n.handleAppend(req)
+		}
+	case "/raft/snapshot":
+		var req snapshotRequest
+		err = json.Unmarshal(body, &req)
+		if err == nil {
+			res = n.handleSnapshot(req)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,286 @@
+package registry
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 测试里的一个集群节点，重启时换掉 node 和 reg，地址不变
+type testRaftNode struct {
+	url   string
+	dir   string
+	srv   *httptest.Server
+	node  *raftNode
+	reg   *registry
+	mutex *sync.Mutex
+}
+
+func (tn *testRaftNode) current() (*raftNode, *registry) {
+	tn.mutex.Lock()
+	defer tn.mutex.Unlock()
+	return tn.node, tn.reg
+}
+
+// 用 dir 里保存的状态启动（或者重启）这个节点
+func (tn *testRaftNode) start(t *testing.T, peers []string) {
+	t.Helper()
+	if err := os.MkdirAll(tn.dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	r := newRegistry()
+	n, err := newRaftNode(tn.url, peers, tn.dir, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.snapshotEvery = 5 // 让 leader 很快就压缩日志，重启的节点要靠快照追上
+	r.raft = n
+	tn.mutex.Lock()
+	tn.node, tn.reg = n, r
+	tn.mutex.Unlock()
+	n.run()
+}
+
+func startTestCluster(t *testing.T, size int) []*testRaftNode {
+	t.Helper()
+	withKeys(t, map[ServiceName][]byte{RegistryService: []byte("cluster")})
+	nodes := make([]*testRaftNode, size)
+	for i := range nodes {
+		tn := &testRaftNode{dir: filepath.Join(t.TempDir(), fmt.Sprint(i)), mutex: new(sync.Mutex)}
+		tn.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n, _ := tn.current()
+			if n == nil {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			n.serveHTTP(w, r)
+		}))
+		tn.url = tn.srv.URL
+		nodes[i] = tn
+	}
+	for _, tn := range nodes {
+		tn.start(t, peersOf(nodes, tn))
+	}
+	t.Cleanup(func() {
+		for _, tn := range nodes {
+			n, _ := tn.current()
+			n.stop()
+			tn.srv.Close()
+		}
+	})
+	return nodes
+}
+
+func peersOf(nodes []*testRaftNode, self *testRaftNode) []string {
+	peers := make([]string, 0, len(nodes)-1)
+	for _, tn := range nodes {
+		if tn != self {
+			peers = append(peers, tn.url)
+		}
+	}
+	return peers
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(15 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// 在当前的 leader 上提交，选举中途失败的重试
+func commitToCluster(t *testing.T, nodes []*testRaftNode, e walEntry) {
+	t.Helper()
+	waitFor(t, "commit of "+string(e.Op), func() bool {
+		for _, tn := range nodes {
+			n, r := tn.current()
+			if !n.stopped() && n.isLeader() {
+				return r.commit(e) == nil
+			}
+		}
+		return false
+	})
+}
+
+func registrationIDs(r *registry) map[string]bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	ids := make(map[string]bool)
+	for _, reg := range r.registrations {
+		ids[reg.InstanceID] = true
+	}
+	return ids
+}
+
+func registerInCluster(t *testing.T, nodes []*testRaftNode, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		id := fmt.Sprintf("grading-%d", i)
+		commitToCluster(t, nodes, walEntry{Op: opAdd, Registration: &Registration{
+			ServiceName: GradingService,
+			ServiceURL:  fmt.Sprintf("http://localhost:%d", 6000+i),
+			InstanceID:  id,
+		}})
+	}
+}
+
+// 杀掉 leader 之后写入照常进行，重启的旧 leader 靠快照和日志追上，谁都不丢注册信息
+func TestRaftLeaderFailover(t *testing.T) {
+	nodes := startTestCluster(t, 3)
+	registerInCluster(t, nodes, 0, 20)
+	commitToCluster(t, nodes, walEntry{Op: opKVPut, Key: "config/grading/policy", Value: "strict"})
+
+	var killed *testRaftNode
+	for _, tn := range nodes {
+		if n, _ := tn.current(); n.isLeader() {
+			killed = tn
+		}
+	}
+	if killed == nil {
+		t.Fatal("no leader after writes")
+	}
+	n, _ := killed.current()
+	n.stop()
+
+	registerInCluster(t, nodes, 20, 40)
+	killed.start(t, peersOf(nodes, killed))
+
+	for _, tn := range nodes {
+		tn := tn
+		waitFor(t, tn.url+" to have all registrations", func() bool {
+			_, r := tn.current()
+			return len(registrationIDs(r)) == 40
+		})
+	}
+	var revision uint64
+	for i, tn := range nodes {
+		_, r := tn.current()
+		ids := registrationIDs(r)
+		for j := 0; j < 40; j++ {
+			if !ids[fmt.Sprintf("grading-%d", j)] {
+				t.Fatalf("%s lost grading-%d", tn.url, j)
+			}
+		}
+		pair, _, ok := r.getKV("config/grading/policy")
+		if !ok || pair.Value != "strict" {
+			t.Fatalf("%s lost config/grading/policy: %+v", tn.url, pair)
+		}
+		r.mutex.RLock()
+		index := r.index
+		r.mutex.RUnlock()
+		if i > 0 && index != revision {
+			t.Fatalf("%s Revision = %d, want %d like the other nodes", tn.url, index, revision)
+		}
+		revision = index
+	}
+}
+
+// 没有签名（或者签错了）的 Raft 消息不能改变节点的 term
+func TestRaftRejectsUnauthenticatedPeers(t *testing.T) {
+	withKeys(t, map[ServiceName][]byte{RegistryService: []byte("cluster")})
+	n, err := newRaftNode("http://self", nil, "", newRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"Term":7,"LeaderID":"http://attacker"}`)
+	for _, auth := range []string{"", authScheme + " service=Registry,ts=1,nonce=x,sig=00"} {
+		req := httptest.NewRequest(http.MethodPost, "http://self/raft/append", strings.NewReader(string(body)))
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		n.serveHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("Authorization %q: code = %d, want 401", auth, w.Code)
+		}
+	}
+	if status := n.status(); status.Term != 0 || status.Leader != "" {
+		t.Fatalf("unauthenticated append changed state: %+v", status)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "http://self/raft/append", strings.NewReader(string(body)))
+	signRaft(req, body)
+	w := httptest.NewRecorder()
+	n.serveHTTP(w, req)
+	if w.Code != http.StatusOK || n.status().Term != 7 {
+		t.Fatalf("signed append: code = %d, status = %+v", w.Code, n.status())
+	}
+
+	withKeys(t, map[ServiceName][]byte{GradingService: []byte("grading")})
+	if err := EnableCluster("http://self", nil, ""); err == nil || !strings.Contains(err.Error(), "authenticate") {
+		t.Fatalf("EnableCluster without Registry.key or mTLS: err = %v", err)
+	}
+}
+
+// term 和投票单独保存；日志只追加，崩溃时写了一半的最后一行被截掉，被覆盖的条目以后面的为准
+func TestRaftLogPersistence(t *testing.T) {
+	dir := t.TempDir()
+	n, err := newRaftNode("http://self", nil, dir, newRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.mutex.Lock()
+	n.currentTerm, n.votedFor = 3, "http://other"
+	n.saveState()
+	for i := 1; i <= 3; i++ {
+		e := raftEntry{Index: i, Term: 1, Command: walEntry{Op: opAdd, Registration: grading(fmt.Sprint("k", i))}}
+		n.log = append(n.log, e)
+		n.appendLog(e)
+	}
+	n.appendLog(raftEntry{Index: 2, Term: 2, Command: walEntry{Op: opAdd, Registration: grading("k2-new")}}) // follower 截掉冲突的条目后追加的
+	n.logFile.Close()
+	n.mutex.Unlock()
+
+	f, err := os.OpenFile(filepath.Join(dir, raftLogFileName), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Index":3,"Term":2,"Comm`)
+	f.Close()
+
+	reloaded, err := newRaftNode("http://self", nil, dir, newRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.currentTerm != 3 || reloaded.votedFor != "http://other" {
+		t.Fatalf("state = %d/%s, want 3/http://other", reloaded.currentTerm, reloaded.votedFor)
+	}
+	if reloaded.lastIndex() != 2 || reloaded.log[2].Command.Registration.ServiceURL != "http://k2-new" || reloaded.term(2) != 2 {
+		t.Fatalf("log = %+v, want [k1, k2-new]", reloaded.log[1:])
+	}
+
+	// 截掉之后追加的条目在下次启动时能读到
+	reloaded.mutex.Lock()
+	e := raftEntry{Index: 3, Term: 2, Command: walEntry{Op: opAdd, Registration: grading("k3-new")}}
+	reloaded.log = append(reloaded.log, e)
+	reloaded.appendLog(e)
+	reloaded.compact(raftSnapshot{LastIndex: 2, LastTerm: 2, State: snapshotData{Registrations: []Registration{}}})
+	reloaded.logFile.Close()
+	reloaded.mutex.Unlock()
+	data, err := ioutil.ReadFile(filepath.Join(dir, raftLogFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(data), "\n") != 1 {
+		t.Fatalf("log after compaction = %q, want only entry 3", data)
+	}
+
+	again, err := newRaftNode("http://self", nil, dir, newRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.log[0].Index != 2 || again.lastIndex() != 3 || again.commitIndex != 2 || again.log[1].Command.Registration.ServiceURL != "http://k3-new" {
+		t.Fatalf("after snapshot: base %d, last %d, commit %d", again.log[0].Index, again.lastIndex(), again.commitIndex)
+	}
+}
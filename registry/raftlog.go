@@ -0,0 +1,220 @@
+/*
+	Raft 状态的持久化，文件都在 EnableCluster 的 dir 下
+	- raft-state.json：currentTerm 和 votedFor，只有几十个字节，每次变化整个重写（先写临时文件再改名）
+	- raft.log：日志条目，每行一个带 Index 的 JSON，只追加不修改；
+	  follower 截掉和 leader 冲突的条目时不回头改文件，直接追加新的，读的时候 Index 不大于已读到的就覆盖它和后面的
+	- raft.snapshot：注册表在 LastIndex 时的快照；日志里超过 raftSnapshotEntries 条已经 apply 的条目时写一次，
+	  然后 raft.log 只保留快照之后的条目（重写一次，也把被覆盖的旧条目清掉）
+*/
+package registry
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	raftStateFileName    = "raft-state.json"
+	raftLogFileName      = "raft.log"
+	raftSnapshotFileName = "raft.snapshot"
+	raftSnapshotEntries  = 1000
+)
+
+// term 和投票
+type raftPersistentState struct {
+	CurrentTerm int
+	VotedFor    string
+}
+
+// 注册表在 LastIndex（含）之前的日志都 apply 之后的样子
+type raftSnapshot struct {
+	LastIndex int
+	LastTerm  int
+	State     snapshotData
+}
+
+// 先写临时文件、落盘再改名，写到一半崩溃不会留下坏文件
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// 读出 dir 下的 term、投票、快照和日志，调用方是 newRaftNode
+func (n *raftNode) load() error {
+	data, err := ioutil.ReadFile(filepath.Join(n.dir, raftStateFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		var state raftPersistentState
+		err = json.Unmarshal(data, &state)
+		if err != nil {
+			return fmt.Errorf("failed to read raft state: %v", err)
+		}
+		n.currentTerm, n.votedFor = state.CurrentTerm, state.VotedFor
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(n.dir, raftSnapshotFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 {
+		var snap raftSnapshot
+		err = json.Unmarshal(data, &snap)
+		if err != nil {
+			return fmt.Errorf("failed to read raft snapshot: %v", err)
+		}
+		n.snap = &snap
+		n.log = []raftEntry{{Index: snap.LastIndex, Term: snap.LastTerm}}
+		n.commitIndex, n.lastApplied = snap.LastIndex, snap.LastIndex
+	}
+
+	f, err := os.OpenFile(filepath.Join(n.dir, raftLogFileName), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	n.logFile = f
+	reader := bufio.NewReader(f)
+	var valid int64 // 最后一条完整的条目结束的位置
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		var e raftEntry
+		if err == io.EOF || json.Unmarshal(line, &e) != nil || e.Index > n.lastIndex()+1 {
+			// 最后一行可能因为进程崩溃只写了一半，截掉，后面追加的条目才能读到
+			log.Printf("[Raft] truncating %s at byte %d", raftLogFileName, valid)
+			break
+		}
+		valid += int64(len(line))
+		base := n.log[0].Index
+		if e.Index <= base { // 已经在快照里了
+			continue
+		}
+		if e.Index <= n.lastIndex() { // 之前被截掉、重新追加的条目
+			n.log = n.log[:e.Index-base]
+		}
+		n.log = append(n.log, e)
+	}
+	return f.Truncate(valid)
+}
+
+// term 或者投票变了；调用方需持有 n.mutex
+func (n *raftNode) saveState() {
+	if n.dir == "" {
+		return
+	}
+	data, err := json.Marshal(raftPersistentState{CurrentTerm: n.currentTerm, VotedFor: n.votedFor})
+	if err == nil {
+		err = writeFileSync(filepath.Join(n.dir, raftStateFileName), data)
+	}
+	if err != nil {
+		log.Println("failed to persist raft state:", err)
+	}
+}
+
+// 追加条目并立刻 Sync 落盘；调用方需持有 n.mutex
+func (n *raftNode) appendLog(entries ...raftEntry) {
+	if n.dir == "" || len(entries) == 0 {
+		return
+	}
+	buf := make([]byte, 0)
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+	_, err := n.logFile.Write(buf)
+	if err == nil {
+		err = n.logFile.Sync()
+	}
+	if err != nil {
+		log.Println("failed to append raft log:", err)
+	}
+}
+
+// 把内存里快照之后的条目重新写成 raft.log；调用方需持有 n.mutex
+func (n *raftNode) rewriteLog() error {
+	if n.dir == "" {
+		return nil
+	}
+	buf := make([]byte, 0)
+	for _, e := range n.log[1:] {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, data...), '\n')
+	}
+	path := filepath.Join(n.dir, raftLogFileName)
+	err := writeFileSync(path, buf)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if n.logFile != nil {
+		n.logFile.Close()
+	}
+	n.logFile = f
+	return nil
+}
+
+/*
+	保存快照，丢掉 snap.LastIndex（含）之前的日志；调用方需持有 n.mutex
+	本节点的日志里 LastIndex 那一条的 term 对得上时保留后面的条目，否则整个日志以快照为准
+*/
+func (n *raftNode) compact(snap raftSnapshot) {
+	base := n.log[0].Index
+	if snap.LastIndex <= base {
+		return
+	}
+	if snap.LastIndex <= n.lastIndex() && n.term(snap.LastIndex) == snap.LastTerm {
+		n.log = append([]raftEntry{{Index: snap.LastIndex, Term: snap.LastTerm}}, n.log[snap.LastIndex-base+1:]...)
+	} else {
+		n.log = []raftEntry{{Index: snap.LastIndex, Term: snap.LastTerm}}
+	}
+	n.snap = &snap
+	if n.dir == "" {
+		return
+	}
+	data, err := json.Marshal(snap)
+	if err == nil {
+		err = writeFileSync(filepath.Join(n.dir, raftSnapshotFileName), data)
+	}
+	if err == nil {
+		err = n.rewriteLog()
+	}
+	if err != nil {
+		log.Println("failed to persist raft snapshot:", err)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+	依赖的服务是否就绪
+	- Ready：RequiredServices 里的每个服务都至少有一个可用的实例（critical、quarantined 的不算）
+	- WaitReady：按退避间隔等到 Ready，ctx 超时或取消就返回错误
+	- OnServiceAvailable：某个服务第一次有可用实例时回调，启动时依赖还没起来也没关系
+*/
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	readyMinBackoff = 100 * time.Millisecond
+	readyMaxBackoff = 2 * time.Second
+)
+
+var availability = struct {
+	callbacks map[ServiceName][]func(url string) // 还没触发过的回调
+	mutex     *sync.Mutex
+}{
+	callbacks: make(map[ServiceName][]func(url string)),
+	mutex:     new(sync.Mutex),
+}
+
+// 本服务依赖的服务里还没有可用实例的，都有了返回空
+func (prv *providers) missing() []ServiceName {
+	prv.mutex.RLock()
+	required := prv.required
+	prv.mutex.RUnlock()
+	missing := make([]ServiceName, 0)
+	for _, name := range required {
+		if len(prv.get(name)) == 0 {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+func Ready() bool {
+	return len(prov.missing()) == 0
+}
+
+func WaitReady(ctx context.Context) error {
+	backoff := readyMinBackoff
+	for {
+		missing := prov.missing()
+		if len(missing) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("required services %v not available: %w", missing, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > readyMaxBackoff {
+			backoff = readyMaxBackoff
+		}
+	}
+}
+
+// callback 只会被调用一次，参数是当时选出的一个实例；已经有可用实例的话马上调用
+func OnServiceAvailable(name ServiceName, callback func(url string)) {
+	availability.mutex.Lock()
+	availability.callbacks[name] = append(availability.callbacks[name], callback)
+	availability.mutex.Unlock()
+	notifyAvailable()
+}
+
+// prov 更新之后调用，触发已经有可用实例的服务的回调
+func notifyAvailable() {
+	availability.mutex.Lock()
+	defer availability.mutex.Unlock()
+	for name, callbacks := range availability.callbacks {
+		if len(prov.get(name)) == 0 {
+			continue
+		}
+		delete(availability.callbacks, name)
+		for _, callback := range callbacks {
+			go func(name ServiceName, callback func(url string)) {
+				url, err := GetProvider(name)
+				if err != nil { // 刚好又没了，等下次出现
+					OnServiceAvailable(name, callback)
+					return
+				}
+				ReleaseProvider(name, url) // 只是用来选一个实例，不算正在处理的请求
+				callback(url)
+			}(name, callback)
+		}
+	}
+}
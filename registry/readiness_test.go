@@ -0,0 +1,82 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 依赖的服务一直没有实例，ctx 到期时返回错误；中途出现了就返回 nil
+func TestWaitReady(t *testing.T) {
+	withProviders(t, GradingService)
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	err := WaitReady(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), string(GradingService)) {
+		t.Fatalf("WaitReady = %v, want a deadline error naming %v", err, GradingService)
+	}
+	if Ready() {
+		t.Fatal("ready without providers")
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		prov.Update(patch{Added: []patchEntry{gradingEntry("a")}})
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := WaitReady(ctx); err != nil {
+		t.Fatalf("WaitReady after the provider appeared: %v", err)
+	}
+	if !Ready() {
+		t.Fatal("not ready with a passing provider")
+	}
+}
+
+// 回调在服务第一次有可用实例时调用一次；已经有了的话马上调用
+func TestOnServiceAvailable(t *testing.T) {
+	withProviders(t, GradingService)
+	t.Cleanup(func() {
+		availability.mutex.Lock()
+		delete(availability.callbacks, GradingService)
+		availability.mutex.Unlock()
+	})
+	urls := make(chan string, 10)
+	OnServiceAvailable(GradingService, func(url string) { urls <- url })
+	select {
+	case url := <-urls:
+		t.Fatalf("callback fired before any provider: %s", url)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	critical := gradingEntry("a")
+	critical.Status = statusCritical
+	prov.Update(patch{Added: []patchEntry{critical}})
+	select {
+	case url := <-urls:
+		t.Fatalf("callback fired for a critical provider: %s", url)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	prov.Update(patch{Changed: []patchEntry{gradingEntry("a")}})
+	select {
+	case url := <-urls:
+		if url != "http://a" {
+			t.Fatalf("callback got %s, want http://a", url)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback not fired after the provider became passing")
+	}
+	prov.Update(patch{Added: []patchEntry{gradingEntry("b")}})
+	OnServiceAvailable(GradingService, func(url string) { urls <- "late " + url })
+	select {
+	case url := <-urls:
+		if !strings.HasPrefix(url, "late ") {
+			t.Fatalf("first callback fired again: %s", url)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("callback registered after the service was available not fired")
+	}
+}
@@ -1,12 +1,24 @@
 package registry
 
+import "time"
+
 type Registration struct {
 	ServiceName ServiceName
 	ServiceURL  string
+	InstanceID  string // 实例 ID，不填时由 RegisterService（直接调接口时由注册中心）生成；同一个服务可以在一台机器上用不同端口跑多个实例
+	// 区分同一个服务的不同实例，比如金丝雀版本和稳定版本、只读副本和主库
+	Version  string            `json:",omitempty"` // 语义化版本，比如 1.2.0
+	Tags     []string          `json:",omitempty"`
+	Metadata map[string]string `json:",omitempty"`
 	// 服务发现
-	RequiredServices []ServiceName //当前服务依赖的其他服务，比如grade依赖log，那么log就应该在里面
-	ServiceUpdateUrl string        // 更新服务地址，暴露服务地址
+	RequiredServices []ServiceName          //当前服务依赖的其他服务，比如grade依赖log，那么log就应该在里面
+	RequiredFilters  map[ServiceName]string `json:",omitempty"` // 只要满足条件的实例，比如 GradingService: "tag=primary, version>=1.2"，见 filter.go
+	ServiceUpdateUrl string                 // 更新服务地址，暴露服务地址
 	HeartbeatURL     string
+	HealthCheck      *HealthCheck `json:",omitempty"` // 检查方式、间隔、超时和阈值，不填用默认值，见 health.go
+	// 租约模式：TTL > 0 时注册中心不轮询 HeartbeatURL，由服务在 TTL 内自己续约
+	TTL     time.Duration
+	LeaseID string // 由注册中心分配
 }
 
 type ServiceName string
@@ -14,15 +26,46 @@ type ServiceName string
 const (
 	LogService     = ServiceName("LogService")
 	GradingService = ServiceName("GradingService")
-	PortalService  = ServiceName("Portald")
+	PortalService  = ServiceName("PortalService")
 )
 
+// 注册成功后注册中心的响应
+type registrationResult struct {
+	InstanceID string
+	LeaseID    string
+	TTL        time.Duration
+}
+
 type patchEntry struct {
-	Name ServiceName
-	URL  string
+	Name     ServiceName
+	ID       string
+	URL      string
+	Version  string            `json:",omitempty"`
+	Tags     []string          `json:",omitempty"`
+	Metadata map[string]string `json:",omitempty"`
+	Status   string            `json:",omitempty"` // 健康状态，见 catalog.go
+}
+
+func (reg Registration) entry() patchEntry {
+	return patchEntry{
+		Name:     reg.ServiceName,
+		ID:       reg.InstanceID,
+		URL:      reg.ServiceURL,
+		Version:  reg.Version,
+		Tags:     reg.Tags,
+		Metadata: reg.Metadata,
+	}
 }
 
 type patch struct {
 	Added   []patchEntry
 	Removed []patchEntry
+	Changed []patchEntry `json:",omitempty"` // 健康状态变了的实例，Status 是新的状态
+	// 这次变化在注册中心的 Revision，以及上一次发给同一个服务的 patch 的 Revision
+	// 客户端当前的 Revision 比 PrevRevision 小，说明中间有 patch 丢了
+	Revision     uint64
+	PrevRevision uint64
 }
+
+// 注册中心做心跳检查时，用这个 Header 告诉服务最近一次发给它的 Revision
+const revisionHeader = "X-Registry-Revision"
@@ -4,10 +4,14 @@ package registry
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,193 +20,506 @@ const ServiceHost = "localhost"
 const ServicePort = "3000"
 const ServicesUrl = "http://" + ServiceHost + ":" + ServicePort + "/services"
 
+const maxForwardedBody = 1 << 20 // 转发前要读完 Body 验证签名，比 KV 存储的值上限大
+
 type registry struct {
 	registrations []Registration
-	mutex         *sync.RWMutex // 保证在并发访问的时候，Registration 是线程安全的
+	recovered     []Registration             // 从磁盘恢复或者健康检查失败被移除、正在观察的注册信息，通过检查后才会 add 并通知依赖方
+	store         *storage                   // 为 nil 时不做持久化
+	raft          *raftNode                  // 为 nil 时是单机模式
+	leases        map[string]time.Time       // LeaseID -> 到期时间，只在 leader 上维护
+	index         uint64                     // 最新事件的 Index，每次注册表变化加一
+	events        []watchEvent               // 最近的变化事件，供 watch 使用
+	changed       chan struct{}              // 有新事件时被 close，用来唤醒等待中的 watch
+	health        map[string]*instanceHealth // InstanceID -> 健康状态、注册时间、最近心跳，供查询接口使用
+	sent          map[string]uint64          // ServiceUpdateUrl -> 最近一次发给它的 patch 的 Revision，只在 leader 上维护
+	checks        map[string]*checkState     // InstanceID -> 健康检查的连续成功/失败次数，只在 leader 上维护
+	deliveries    *deliveryQueues            // 每个订阅方的 patch 投递队列，只在 leader 上使用
+	kv            *kvStore                   // key/value 配置存储，见 kv.go
+	mutex         *sync.RWMutex              // 保证在并发访问的时候，Registration 是线程安全的
 }
 
-var reg = registry{
-	registrations: make([]Registration, 0),
-	mutex:         new(sync.RWMutex),
-} // 建立一个包级reg变量
+var reg = *newRegistry() // 建立一个包级reg变量
+
+func newRegistry() *registry {
+	return &registry{
+		registrations: make([]Registration, 0),
+		leases:        make(map[string]time.Time),
+		index:         1, // 0 留给客户端，表示还没拿到过任何数据
+		events:        make([]watchEvent, 0),
+		changed:       make(chan struct{}),
+		health:        make(map[string]*instanceHealth),
+		sent:          make(map[string]uint64),
+		checks:        make(map[string]*checkState),
+		deliveries:    newDeliveryQueues(),
+		kv:            newKVStore(),
+		mutex:         new(sync.RWMutex),
+	}
+}
 
 /* 用于注册 */
 func (r *registry) add(reg Registration) error {
-	r.mutex.Lock()
-	r.registrations = append(r.registrations, reg)
-	r.mutex.Unlock()
+	err := r.commit(walEntry{Op: opAdd, Registration: &reg})
+	if err != nil {
+		return err
+	}
+	if reg.TTL > 0 { // 租约从注册成功开始计时
+		r.mutex.Lock()
+		r.leases[reg.LeaseID] = time.Now().Add(reg.TTL)
+		r.mutex.Unlock()
+	}
 	// 在服务注册时刚好，把需要的依赖服务请求过来,比如在启动Grading时，将Grading的依赖拉过来
-	err := r.SendRequiredServices(reg)
-
-	// 服务在注册时，可以通知其他依赖它的服务（可以仔细想想这一段和上一段注释对应的代码先后顺序）
-	r.notify(patch{ // 把要新增的服务作为参数
-		Added: []patchEntry{
-			/* patchEntry{ // redundant type from array, slice, or map composite literal 翻译：数组、切片或映射复合文本中的冗余类型，值不用再声明类型
-				Name: reg.ServiceName,
-				URL:  reg.ServiceURL,
-			}, */
-			// 像这样直接 {}，取代 => patchEntry{} （类型{}）
-			{
-				Name: reg.ServiceName,
-				URL:  reg.ServiceURL,
-			},
-		},
-	})
+	// 通知其他依赖它的服务，由 dispatch 按事件顺序来做（可以仔细想想这两件事的先后顺序）
+	return r.SendRequiredServices(reg)
+}
 
-	return err
+/*
+	按注册表变化的顺序给依赖方发通知（只有 leader 发）
+	每个事件的 Index 就是这次变化的 Revision，顺序处理才能保证发给同一个服务的 PrevRevision 是递增的
+	直到 stop 被关闭；stop 为 nil 时一直运行
+*/
+func (r *registry) dispatch(stop <-chan struct{}) {
+	r.mutex.RLock()
+	dispatched := r.index // 启动之前的变化（比如从 WAL 恢复的）不归自己通知
+	r.mutex.RUnlock()
+	for {
+		r.mutex.RLock()
+		changed := r.changed
+		pending := make([]watchEvent, 0)
+		for _, e := range r.events {
+			if e.Index > dispatched {
+				pending = append(pending, e)
+			}
+		}
+		latest := r.index
+		r.mutex.RUnlock()
+
+		if !r.isLeader() { // 不是 leader：这些变化由 leader 通知
+			pending = pending[:0]
+		}
+		for _, e := range pending {
+			fullPatch := patch{Revision: e.Index}
+			switch e.Type {
+			case "Added":
+				fullPatch.Added = []patchEntry{e.Entry} // 像这样直接 {}，取代 => patchEntry{} （类型{}）
+			case "Removed":
+				fullPatch.Removed = []patchEntry{e.Entry}
+			case "Changed":
+				fullPatch.Changed = []patchEntry{e.Entry}
+			}
+			r.notify(fullPatch)
+		}
+		dispatched = latest
+		select {
+		case <-changed:
+		case <-stop:
+			return
+		}
+	}
 }
 
-func (r registry) notify(fullPatch patch) {
+func (r *registry) notify(fullPatch patch) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	/*
 		- 在每个服务里遍历
-			- 给每个服务开一个 Goroutine
-				- 在每个服务的 RequiredServices 里遍历
-					- 初始化新增/移除 p列表（patch）
-					- 初始化 sendUpdate = false
-					- 在 fullPatch 里遍历新增/移除的服务名
-						- 如果 这个新增/移除的服务名 == RequiredServices
-							- 将 需要增加/移除的 Patch 添加到 p列表的增加/移除列表
-							- 赋值 sendUpdate = true
-					- 如果 sendUpdate == true
-						- 使用 sendPatch()
+			- 初始化新增/移除 p列表（patch），带上这次变化的 Revision
+			- 初始化 sendUpdate = false
+			- 在 fullPatch 里遍历新增/移除的实例
+				- 如果 这个实例是它依赖的服务，并且满足它的过滤条件（RequiredFilters）
+					- 将 需要增加/移除的 Patch 添加到 p列表的增加/移除列表
+					- 赋值 sendUpdate = true
+				- 新增的实例是它依赖的服务但不满足过滤条件：可能是重新注册后改了标签或版本，当作移除发过去
+			- 如果 sendUpdate == true
+				- PrevRevision 填上一次发给它的 Revision，客户端据此发现漏掉的 patch
+				- 放进它的投递队列，按顺序发送、失败重试，见 delivery.go
 	*/
 	for _, reg := range r.registrations {
-		go func(reg Registration) {
-			for _, reqService := range reg.RequiredServices {
-				p := patch{Added: []patchEntry{}, Removed: []patchEntry{}}
-				sendUpdate := false
-				for _, added := range fullPatch.Added {
-					if added.Name == reqService {
-						p.Added = append(p.Added, added)
-						sendUpdate = true
-					}
-				}
-				for _, removed := range fullPatch.Removed {
-					if removed.Name == reqService {
-						p.Removed = append(p.Removed, removed)
-						sendUpdate = true
-					}
-				}
-				if sendUpdate {
-					err := r.sendPatch(p, reg.ServiceUpdateUrl)
-					if err != nil {
-						log.Println(err)
-						return
-					}
-				}
+		p := patch{Added: []patchEntry{}, Removed: []patchEntry{}, Revision: fullPatch.Revision}
+		sendUpdate := false
+		for _, added := range fullPatch.Added {
+			if reg.wants(added) {
+				p.Added = append(p.Added, added)
+				sendUpdate = true
+			} else if reg.requires(added.Name) {
+				p.Removed = append(p.Removed, added)
+				sendUpdate = true
 			}
-		}(reg)
+		}
+		for _, removed := range fullPatch.Removed {
+			if reg.wants(removed) {
+				p.Removed = append(p.Removed, removed)
+				sendUpdate = true
+			}
+		}
+		for _, changed := range fullPatch.Changed {
+			if reg.wants(changed) {
+				p.Changed = append(p.Changed, changed)
+				sendUpdate = true
+			}
+		}
+		if !sendUpdate {
+			continue
+		}
+		p.PrevRevision = r.markSent(reg.ServiceUpdateUrl, p.Revision)
+		r.enqueuePatch(p, reg)
 	}
 }
 
-// 把需要的依赖服务请求过来
-func (r registry) SendRequiredServices(reg Registration) error {
-	r.mutex.RLock()
-	defer r.mutex.RUnlock()
+// 记下发给 url 的最新 Revision，返回上一次的；调用方需持有 r.mutex
+func (r *registry) markSent(url string, revision uint64) uint64 {
+	prev := r.sent[url]
+	if revision > prev {
+		r.sent[url] = revision
+	}
+	return prev
+}
 
-	var p patch
+// 把需要的依赖服务请求过来，这是一份全量数据，Revision 是当前的最新值
+func (r *registry) SendRequiredServices(reg Registration) error {
+	r.mutex.Lock()
+	p := patch{Revision: r.index}
 	// 找到 某个服务所有 RequiredServices （依赖），把它们全部添加到Added中
 	for _, service := range r.registrations {
-		for _, reqService := range reg.RequiredServices {
-			if service.ServiceName == reqService {
-				p.Added = append(p.Added, patchEntry{
-					Name: service.ServiceName,
-					URL:  service.ServiceURL,
-				})
-			}
+		if reg.wants(service.entry()) {
+			p.Added = append(p.Added, r.entry(service))
 		}
 	}
+	p.PrevRevision = r.markSent(reg.ServiceUpdateUrl, p.Revision)
+	r.mutex.Unlock()
+	r.resetDelivery(reg.ServiceUpdateUrl, p.Revision) // 队列里更旧的 patch 不用再发了
 
-	err := r.sendPatch(p, reg.ServiceUpdateUrl)
+	err := r.sendPatch(p, reg)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-/*  */
-func (r registry) sendPatch(p patch, url string) error {
+// 注册时直接发全量数据，不经过队列，发不到就注册失败；记一条审计记录
+func (r *registry) sendPatch(p patch, to Registration) error {
+	err := r.postPatch(p, to)
+	recordAudit(patchAudit(queuedPatch{patch: p, to: to, attempts: 1}, err))
+	return err
+}
+
+func (r *registry) postPatch(p patch, to Registration) error {
+	url := to.ServiceUpdateUrl
 	data, err := json.Marshal(p)
 	if err != nil {
 		return err
 	}
 	// NewBuffer使用buf作为初始内容创建并初始化一个Buffer。本函数用于创建一个用于读取已存在数据的buffer；
 	// 也用于指定用于写入的内部缓冲的大小，此时，buf应为一个具有指定容量但长度为0的切片。buf会被作为返回值的底层缓冲切片。
-	_, err = http.Post(url, "application/json", bytes.NewBuffer(data))
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	signPatch(req, to.ServiceName, data) // 用接收方的密钥签名，它才能确认 patch 来自注册中心
+	res, err := ClientFor(to.ServiceName, 5*time.Second).Do(req)
 	if err != nil {
 		return err
 	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to send patch to %s. service responded with code %v", url, res.StatusCode)
+	}
 	return nil
 }
 
-/* 移除url对应的服务 */
-func (r *registry) remove(url string) error {
-	// 去注册表找有没有 指定url，有就去掉
-	for i := range reg.registrations {
-		if reg.registrations[i].ServiceURL == url {
-			r.notify(patch{ // 把要被移除的服务作为参数
-				Removed: []patchEntry{
-					{
-						Name: r.registrations[i].ServiceName,
-						URL:  r.registrations[i].ServiceURL,
-					},
-				},
-			})
-			// ！！！千万记得上锁
-			r.mutex.Lock()
-			reg.registrations = append(reg.registrations[:i], reg.registrations[i+1:]...) // 去掉i的内容，相当于 => i前面的内容+i后面的内容
-			r.mutex.Unlock()
-			return nil
+/* 移除实例 ID 对应的服务 */
+func (r *registry) remove(id string) error {
+	// 去注册表找有没有 指定ID，有就去掉
+	r.mutex.RLock()
+	found := false
+	for i := range r.registrations {
+		if r.registrations[i].InstanceID == id {
+			found = true
+			break
+		}
+	}
+	r.mutex.RUnlock()
+	if !found {
+		return fmt.Errorf("service instance %s not found", id)
+	}
+	// 依赖它的服务由 dispatch 收到 Removed 事件后通知
+	return r.commit(walEntry{Op: opRemove, ID: id})
+}
+
+func (r *registry) instance(id string) (Registration, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, reg := range r.registrations {
+		if reg.InstanceID == id {
+			return reg, true
 		}
 	}
-	return fmt.Errorf("service at URL %s not found", url)
+	return Registration{}, false
 }
 
-// 定时检查心跳 => 使用 Goroutine 检查服务是否存在
-func (r *registry) heartbeat(freq time.Duration) {
-	for {
-		var wg sync.WaitGroup
+// 早期的客户端注销时只发 ServiceURL
+func (r *registry) instanceAt(url string) (string, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, reg := range r.registrations {
+		if reg.ServiceURL == url {
+			return reg.InstanceID, true
+		}
+	}
+	return "", false
+}
+
+/*
+	把一次修改落到注册表
+	- 单机模式：直接 apply
+	- 集群模式：先通过 Raft 复制到多数节点，提交后每个节点各自 apply，这里等到本节点 apply 完才返回
+*/
+func (r *registry) commit(e walEntry) error {
+	if r.raft == nil {
+		r.apply(e)
+		return nil
+	}
+	return r.raft.propose(e)
+}
+
+// 修改内存中的注册表并写 WAL，只做状态变更，不通知任何服务
+func (r *registry) apply(e walEntry) {
+	// ！！！千万记得上锁
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	switch e.Op {
+	case opAdd:
+		for _, reg := range r.registrations {
+			if reg.InstanceID == e.Registration.InstanceID && reg.LeaseID != e.Registration.LeaseID {
+				delete(r.leases, reg.LeaseID) // 同一个实例重新注册换了租约，旧的不再续约，也不该让它过期时移除新的注册
+			}
+		}
+		r.forgetRecovered(e.Registration.InstanceID) // 服务自己重新注册了，就不用再等心跳来确认
+		r.health[e.Registration.InstanceID] = &instanceHealth{Status: statusPassing, RegisteredAt: time.Now()}
+		r.recordEvent("Added", *e.Registration)
+	case opRemove:
+		for _, reg := range r.registrations {
+			if reg.InstanceID == e.ID {
+				delete(r.leases, reg.LeaseID)
+				delete(r.health, reg.InstanceID)
+				r.recordEvent("Removed", reg)
+				r.dropSessions(reg.InstanceID) // 实例没了，它拿着的锁都释放
+			}
+		}
+	case opStatus:
 		for _, reg := range r.registrations {
-			wg.Add(1)                   // 添加等待计数值
-			go func(reg Registration) { // 每个服务开一个 Goroutine
-				defer wg.Done() // 在线程结束时，Done方法减少WaitGroup计数器的值
-				success := true
-				for attempts := 0; attempts < 3; attempts++ { // 给三次尝试[检查]
-					res, err := http.Get(reg.HeartbeatURL)
-					if err != nil {
-						log.Println(err)
-					} else if res.StatusCode == http.StatusOK {
-						log.Printf("[Heartbeat-check] PASSED for %v", reg.ServiceName)
-						// 通过检查，执行，break
-						if !success { // 如果上次检查失败 => 那么success==false，也就是被卸载过，现在检查通过可以add了
-							r.add(reg)
-						}
-						success = true
-						break
-					}
-					if success {
-						log.Printf("[Heartbeat-check] FAILED for %v", reg.ServiceName)
-						// 发现有错，卸载服务
-						success = false
-						r.remove(reg.ServiceURL)
-					}
-					time.Sleep(1 * time.Second)
+			if h, ok := r.health[reg.InstanceID]; ok && reg.InstanceID == e.ID && h.Status != e.Status {
+				h.Status = e.Status
+				r.recordEvent("Changed", reg)
+				if !sessionHealthy(e.Status) { // 心跳失败，它拿着的锁都释放
+					r.dropSessions(reg.InstanceID)
 				}
-			}(reg)
-			wg.Wait() // 阻塞 直到WaitGroup计数器减为0
-			time.Sleep(freq)
+			}
+		}
+	case opMaintenance:
+		for _, reg := range r.registrations {
+			if h, ok := r.health[reg.InstanceID]; ok && reg.InstanceID == e.ID {
+				changed := h.Maintenance != e.Maintenance
+				h.Maintenance, h.MaintenanceReason = e.Maintenance, e.Reason
+				if changed {
+					r.recordEvent("Changed", reg)
+				}
+			}
+		}
+	case opKVPut, opKVDelete:
+		outcome := r.kv.apply(e)
+		if waiting, ok := r.kv.outcomes[e.Request]; ok {
+			*waiting = outcome
+		}
+		if outcome.Revision == 0 { // 什么都没改，不用写 WAL
+			return
+		}
+		r.kv.notify()
+	case opSessionCreate, opSessionDestroy:
+		if !r.applySession(e) {
+			return
+		}
+	default:
+		return // 比如 Raft 新 leader 提交的空操作
+	}
+	r.registrations = applyWALEntry(r.registrations, e)
+	e.Revision = r.index
+	e.KVRevision = r.kv.revision
+	r.persist(e)
+}
+
+/*
+	集群模式下 follower 把请求原样转发给 leader，返回 true 表示请求已经处理完
+	请求带着凭据时先在这里认证，凭据不对的直接拒绝（nonce 只在这个节点上记下了），
+	认证出的调用方放在签过名的转发头里，leader 按它检查能不能操作被操作的服务
+*/
+func (r *registry) forwardToLeader(w http.ResponseWriter, req *http.Request) bool {
+	if r.isLeader() {
+		return false
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxForwardedBody))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return true
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	var caller *callerIdentity
+	if identity, err := requestCaller(req, body); err == nil {
+		caller = &identity
+	} else if req.Header.Get("Authorization") != "" {
+		log.Printf("Rejecting %s %s before forwarding: %v", req.Method, req.URL.Path, err)
+		writeAuthError(w, err)
+		return true
+	}
+	leaderURL := r.raft.leaderURL()
+	if leaderURL == "" { // 正在选举
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return true
+	}
+	target, err := url.Parse(leaderURL)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+	log.Printf("Forwarding %s request to leader %s", req.Method, leaderURL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transportFor(RegistryService)
+	signForwarded(req, caller) // leader 的审计记录里要有原始的调用方地址
+	proxy.ServeHTTP(w, req)
+	return true
+}
+
+// 集群模式下只有 leader 负责心跳检查和发通知，单机模式始终为 true
+func (r *registry) isLeader() bool {
+	return r.raft == nil || r.raft.isLeader()
+}
+
+// 写一条 WAL，调用方需持有 r.mutex，保证 WAL 的顺序和内存里的修改顺序一致
+func (r *registry) persist(e walEntry) {
+	if r.store == nil {
+		return
+	}
+	err := r.store.append(e)
+	if err != nil {
+		log.Println("failed to write registry WAL:", err)
+	}
+}
+
+// 调用方需持有 r.mutex
+func (r *registry) forgetRecovered(id string) bool {
+	for i := range r.recovered {
+		if r.recovered[i].InstanceID == id {
+			r.recovered = append(r.recovered[:i], r.recovered[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// 定期写快照，把 WAL 压缩掉
+func (r *registry) snapshotLoop(freq time.Duration) {
+	for {
+		time.Sleep(freq)
+		r.mutex.RLock()
+		regs := make([]Registration, 0, len(r.registrations)+len(r.recovered))
+		regs = append(regs, r.registrations...)
+		regs = append(regs, r.recovered...) // 还没确认的也要留着，防止再次重启时丢掉
+		err := r.store.snapshot(snapshotData{Revision: r.index, Registrations: regs, KV: r.kv.list(""), KVRevision: r.kv.revision})
+		r.mutex.RUnlock()
+		if err != nil {
+			log.Println("failed to write registry snapshot:", err)
+		}
+	}
+}
+
+// 集群模式下 Raft 写快照用，由 applier 调用，这时注册表正好是 apply 到快照位置的样子
+func (r *registry) clusterSnapshot() snapshotData {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	snap := snapshotData{
+		Revision:      r.index,
+		Registrations: append([]Registration{}, r.registrations...),
+		KV:            r.kv.list(""),
+		KVRevision:    r.kv.revision,
+		Health:        make(map[string]*instanceHealth),
+		Sessions:      make([]Session, 0, len(r.kv.sessions)),
+	}
+	for id, h := range r.health {
+		copied := *h
+		snap.Health[id] = &copied
+	}
+	for _, session := range r.kv.sessions {
+		snap.Sessions = append(snap.Sessions, session)
+	}
+	return snap
+}
+
+// 用 Raft 的快照整体替换注册表，之前的事件对不上了，watch 的一方会拿到全量（Reset）
+func (r *registry) restoreSnapshot(snap snapshotData) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.registrations = append(make([]Registration, 0, len(snap.Registrations)), snap.Registrations...)
+	r.health = make(map[string]*instanceHealth)
+	for _, reg := range r.registrations {
+		h, ok := snap.Health[reg.InstanceID]
+		if !ok {
+			h = &instanceHealth{Status: statusPassing, RegisteredAt: time.Now()}
 		}
+		r.health[reg.InstanceID] = h
+	}
+	r.index = snap.Revision
+	r.events = make([]watchEvent, 0)
+	close(r.changed)
+	r.changed = make(chan struct{})
+
+	kv := newKVStore()
+	kv.restore(snap.KV, snap.KVRevision)
+	for _, session := range snap.Sessions {
+		kv.sessions[session.ID] = session
 	}
+	kv.outcomes = r.kv.outcomes // 还在等结果的请求
+	r.kv.notify()
+	r.kv = kv
 }
 
 // 使用 once ,让程序开始时启动一次 heartbeat 方法[它是 for 无终止循环]
 var once sync.Once
 
+/*
+	开启持久化，需在 SetupRegistryService 之前调用
+	dir 下保存 WAL 和快照，启动时从中恢复注册信息，恢复的服务要等心跳检查通过才会重新对外提供
+*/
+func EnableStorage(dir string) error {
+	store, err := openStorage(dir)
+	if err != nil {
+		return err
+	}
+	regs, revision, kv, err := store.load()
+	if err != nil {
+		return err
+	}
+	reg.mutex.Lock()
+	reg.store = store
+	reg.kv = kv
+	reg.recovered = regs
+	if revision > reg.index {
+		reg.index = revision // Revision 接着重启前的往上加，客户端才不会把新的 patch 当成过时的
+	}
+	reg.mutex.Unlock()
+	log.Printf("Recovered %d registrations from %s", len(regs), dir)
+	return nil
+}
+
 func SetupRegistryService() {
 	once.Do(func() {
-		go reg.heartbeat(3 * time.Second)
+		go reg.heartbeat(checkWorkers, reconcileEvery, nil) // 每个实例的检查间隔见 Registration.HealthCheck
+		go reg.expireLeases(1 * time.Second)
+		go reg.dispatch(nil)
+		if reg.store != nil {
+			go reg.snapshotLoop(time.Minute)
+		}
 	})
 }
 
@@ -213,24 +530,134 @@ type RegistrationService struct{}
 
 func (s RegistrationService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Println("Request received.")
+	pathSegments := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+	switch {
+	case r.URL.Path == "/services/watch":
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveWatch(w, r)
+		return
+	case r.URL.Path == "/services/events":
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveEvents(w, r)
+		return
+	case r.URL.Path == "/services/deliveries":
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveDeliveries(w, r)
+		return
+	case r.URL.Path == "/services/graph":
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		s.serveGraph(w, r)
+		return
+	case len(pathSegments) == 6 && pathSegments[3] == "instances" && pathSegments[5] == "maintenance":
+		s.serveMaintenance(w, r, pathSegments) // PUT/DELETE /services/{name}/instances/{id}/maintenance
+		return
+	case r.Method == http.MethodGet: // 查询
+		s.serveCatalog(w, r, pathSegments)
+		return
+	case r.Method == http.MethodDelete && len(pathSegments) == 5 && pathSegments[3] == "instances":
+		// DELETE /services/{name}/instances/{id}
+	case len(pathSegments) != 2: // 注册只在 /services 上
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if (r.Method == http.MethodPost || r.Method == http.MethodDelete) && reg.forwardToLeader(w, r) {
+		return // 集群模式下 follower 不处理写请求
+	}
 	switch r.Method { // 注册服务使用POST
 	case http.MethodPost:
-		dec := json.NewDecoder(r.Body)
+		body, err := ioutil.ReadAll(r.Body) // 验证签名要用原始的 Body
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req := r
 		var r Registration
-		err := dec.Decode(&r) // 解码
+		err = json.Unmarshal(body, &r) // 解码
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		actor, err := authenticate(req, body, r.ServiceName) // 只能注册自己
+		if err != nil {
+			log.Printf("Rejecting registration of %v: %v", r.ServiceName, err)
+			rejected := auditInstance(auditRejected, r, req, "")
+			rejected.Reason = "register: " + err.Error()
+			recordAudit(rejected)
+			writeAuthError(w, err)
+			return
+		}
+		err = r.validate() // 版本号、过滤条件不合法
 		if err != nil {
 			log.Println(err)
+			rejected := auditInstance(auditRejected, r, req, actor)
+			rejected.Reason = "register: " + err.Error()
+			recordAudit(rejected)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		if existing, ok := reg.instance(r.InstanceID); ok && r.InstanceID != "" && existing.ServiceName != r.ServiceName {
+			// 实例 ID 已经被别的服务占用，不能借重新注册把它改成自己的
+			log.Printf("Rejecting service %v: instance %s belongs to %v", r.ServiceName, r.InstanceID, existing.ServiceName)
+			rejected := auditInstance(auditRejected, r, req, actor)
+			rejected.Reason = fmt.Sprintf("register: instance %s belongs to %v", r.InstanceID, existing.ServiceName)
+			recordAudit(rejected)
+			http.Error(w, fmt.Sprintf("instance %s is registered by %v", r.InstanceID, existing.ServiceName), http.StatusConflict)
+			return
+		}
+		err = reg.checkDependencies(r) // 依赖关系成环
+		if err != nil {
+			log.Printf("Rejecting service %v: %v", r.ServiceName, err)
+			rejected := auditInstance(auditRejected, r, req, actor)
+			rejected.Reason = "register: " + err.Error()
+			recordAudit(rejected)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if r.InstanceID == "" { // 没有自带实例 ID 的，由注册中心分配
+			r.InstanceID = newID()
+		}
+		r.LeaseID = "" // LeaseID 只能由注册中心分配，客户端自己带的可能和别的实例的租约重复
+		if r.TTL > 0 { // 租约模式，分配 LeaseID
+			r.LeaseID = newID()
+		}
 		// 如果没出错，打印 服务 和 URL
-		log.Printf("Adding service: %v with %v", r.ServiceName, r.ServiceURL)
+		log.Printf("Adding service: %v with %v (instance %v)", r.ServiceName, r.ServiceURL, r.InstanceID)
 		err = reg.add(r) // 注册信息添到 reg.registrations 里（add方法里有互斥锁，防止并发时死锁）
+		if errors.Is(err, errNotLeader) {
+			w.WriteHeader(http.StatusServiceUnavailable) // 刚好发生了 leader 切换，让客户端换个节点重试
+			return
+		}
 		if err != nil {
 			log.Println(err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		registered := auditInstance(auditRegistered, r, req, actor)
+		registered.Reason = fmt.Sprintf("requires %v", r.RequiredServices)
+		recordAudit(registered)
+		// 把分配的租约告诉服务
+		data, err := json.Marshal(registrationResult{InstanceID: r.InstanceID, LeaseID: r.LeaseID, TTL: r.TTL})
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(data)
 	case http.MethodDelete: // 移除服务使用DELETE
 		payload, err := ioutil.ReadAll(r.Body)
 		if err != nil {
@@ -238,14 +665,46 @@ func (s RegistrationService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusInternalServerError) //处理请求时发生了错误
 			return
 		}
-		url := string(payload)
-		log.Printf("Removing service at URL : %s", url)
-		err = reg.remove(url) // 移除url对应的服务
+		var id string
+		if len(pathSegments) == 5 { // DELETE /services/{name}/instances/{id}
+			id = pathSegments[4]
+			log.Printf("Removing service instance: %s", id)
+		} else { // 早期的客户端在 Body 里放 ServiceURL
+			url := string(payload)
+			log.Printf("Removing service at URL : %s", url)
+			var ok bool
+			id, ok = reg.instanceAt(url)
+			if !ok {
+				log.Printf("service at URL %s not found", url)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		instance, ok := reg.instance(id)
+		if !ok || (len(pathSegments) == 5 && instance.ServiceName != ServiceName(pathSegments[2])) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		actor, err := authenticate(r, payload, instance.ServiceName) // 只能注销自己的实例
+		if err != nil {
+			log.Printf("Rejecting deregistration of %v: %v", id, err)
+			rejected := auditInstance(auditRejected, instance, r, "")
+			rejected.Reason = "deregister: " + err.Error()
+			recordAudit(rejected)
+			writeAuthError(w, err)
+			return
+		}
+		err = reg.remove(id) // 移除ID对应的服务
+		if errors.Is(err, errNotLeader) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
 		if err != nil {
 			log.Println(err)
 			w.WriteHeader(http.StatusInternalServerError) // remove时发生了错误
 			return
 		}
+		recordAudit(auditInstance(auditDeregistered, instance, r, actor))
 
 	default:
 		// 因为我只写了 POST 方法，所以其他方法禁止
@@ -0,0 +1,230 @@
+/*
+	注册表的本地持久化
+	- 预写日志（WAL）：每次 add/remove 先追加一行 JSON 到 registry.wal
+	- 快照：定期把当前全部注册信息写成 registry.snapshot，然后清空 WAL
+	- 启动时：先读快照，再按顺序重放 WAL，就能还原出重启前的 registrations
+	- KV 存储（见 kv.go）的写操作也记在同一个 WAL 里，快照里带上所有的 key
+*/
+package registry
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	walFileName      = "registry.wal"
+	snapshotFileName = "registry.snapshot"
+)
+
+type walOp string
+
+const (
+	opAdd    = walOp("add")
+	opRemove = walOp("remove")
+	opStatus = walOp("status") // 健康状态变化，重放时忽略，重启后的实例都要重新检查
+	opNoop   = walOp("noop")   // Raft 新 leader 上任时提交的空操作，不会写进 WAL
+	// 进入或退出维护状态，和 opStatus 一样重放时忽略，重启后服务重新注册就恢复正常
+	opMaintenance = walOp("maintenance")
+)
+
+// WAL 中的一行
+type walEntry struct {
+	Op           walOp
+	Registration *Registration `json:",omitempty"` // opAdd 时使用
+	ID           string        `json:",omitempty"` // opRemove、opStatus、opMaintenance 时使用
+	Status       string        `json:",omitempty"` // opStatus 时使用
+	Maintenance  bool          `json:",omitempty"` // opMaintenance 时使用，false 表示退出维护
+	Reason       string        `json:",omitempty"` // opMaintenance 时使用
+	Key          string        `json:",omitempty"` // opKVPut、opKVDelete 时使用
+	Value        string        `json:",omitempty"` // opKVPut 时使用
+	CAS          *uint64       `json:",omitempty"` // 不为 nil 时只在 key 的 ModRevision 等于它时执行
+	Recurse      bool          `json:",omitempty"` // opKVDelete 时删掉 Key 下面所有的 key
+	Acquire      string        `json:",omitempty"` // opKVPut 时用这个会话拿锁
+	Release      string        `json:",omitempty"` // opKVPut 时释放这个会话持有的锁
+	Session      string        `json:",omitempty"` // opSessionCreate、opSessionDestroy 时使用
+	Created      *time.Time    `json:",omitempty"` // opSessionCreate 时使用，收到请求时记下，各个节点、重放时都用同一个时间
+	Request      string        `json:",omitempty"` // 收到请求的节点用它找到等待结果的请求
+	Revision     uint64        // 这条修改之后注册表的 Revision，重启后接着往上加
+	KVRevision   uint64        `json:",omitempty"` // 这条修改之后 KV 存储的 Revision
+}
+
+type snapshotData struct {
+	Revision      uint64
+	Registrations []Registration
+	KV            []KVPair `json:",omitempty"`
+	KVRevision    uint64   `json:",omitempty"`
+	// 下面两个只有 Raft 的快照里有：集群里的节点靠它和别的节点保持一致，单机模式重启后都要重新来过
+	Health   map[string]*instanceHealth `json:",omitempty"`
+	Sessions []Session                  `json:",omitempty"`
+}
+
+type storage struct {
+	dir   string
+	wal   *os.File
+	mutex *sync.Mutex
+}
+
+func openStorage(dir string) (*storage, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &storage{
+		dir:   dir,
+		wal:   wal,
+		mutex: new(sync.Mutex),
+	}, nil
+}
+
+// 读快照 + 重放 WAL，得到重启前的注册信息、Revision 和 KV 存储
+func (s *storage) load() ([]Registration, uint64, *kvStore, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	snap := snapshotData{Registrations: make([]Registration, 0)}
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, snapshotFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, nil, err
+	}
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &snap)
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("failed to read registry snapshot: %v", err)
+		}
+	}
+	regs := snap.Registrations
+	revision := snap.Revision
+	kv := newKVStore()
+	kv.restore(snap.KV, snap.KVRevision)
+
+	_, err = s.wal.Seek(0, 0)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	reader := bufio.NewReader(s.wal)
+	var valid int64 // 最后一条完整的 WAL 结束的位置
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, 0, nil, err
+		}
+		var e walEntry
+		if err == io.EOF || json.Unmarshal(line, &e) != nil {
+			// 最后一行可能因为进程崩溃只写了一半，后面的内容不可信，停止重放并截掉，之后追加的 WAL 才不会接在半行后面
+			log.Printf("truncating %s at byte %d", walFileName, valid)
+			break
+		}
+		valid += int64(len(line))
+		if e.Op == opKVPut || e.Op == opKVDelete {
+			// 会话不会恢复，拿锁、放锁按普通的写重放，只记下 key 被锁着；会话失效释放锁也会让 Revision 加一，所以按记下的 Revision 对齐
+			acquire, release := e.Acquire, e.Release
+			e.Acquire, e.Release = "", ""
+			if e.KVRevision > 0 {
+				kv.revision = e.KVRevision - 1
+			}
+			// 写进 WAL 的都执行成功了，记下的锁可能已经随会话失效释放了（这不写 WAL），先清掉，重放时才不会被锁挡住
+			locked := []KVPair{kv.pairs[e.Key]}
+			if e.Op == opKVDelete && e.Recurse {
+				locked = kv.list(e.Key)
+			}
+			for _, pair := range locked {
+				if pair.Session != "" {
+					pair.Session = ""
+					kv.pairs[pair.Key] = pair
+				}
+			}
+			outcome := kv.apply(e)
+			if outcome.Revision > 0 && (acquire != "" || release != "") {
+				pair := kv.pairs[e.Key]
+				pair.Session = acquire
+				kv.pairs[e.Key] = pair
+			}
+		}
+		if e.KVRevision > kv.revision {
+			kv.revision = e.KVRevision
+		}
+		regs = applyWALEntry(regs, e)
+		if e.Revision > revision {
+			revision = e.Revision
+		}
+	}
+	// 锁的持有者都不在了，全部释放，拿着锁的客户端 watch 到之后知道锁丢了
+	kv.release(func(KVPair) bool { return true })
+	return regs, revision, kv, s.wal.Truncate(valid)
+}
+
+// 重放一条 WAL，add 按实例 ID 覆盖，保证重放是幂等的
+func applyWALEntry(regs []Registration, e walEntry) []Registration {
+	switch e.Op {
+	case opAdd:
+		if e.Registration == nil {
+			return regs
+		}
+		for i := range regs {
+			if regs[i].InstanceID == e.Registration.InstanceID {
+				regs[i] = *e.Registration
+				return regs
+			}
+		}
+		return append(regs, *e.Registration)
+	case opRemove:
+		for i := range regs {
+			if regs[i].InstanceID == e.ID {
+				return append(regs[:i], regs[i+1:]...)
+			}
+		}
+	}
+	return regs
+}
+
+// 追加一条 WAL，并立刻 Sync 落盘
+func (s *storage) append(e walEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = s.wal.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	return s.wal.Sync()
+}
+
+// 写快照：先写临时文件再 rename，避免写到一半崩溃留下损坏的快照；成功后清空 WAL
+func (s *storage) snapshot(snap snapshotData) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tmp := filepath.Join(s.dir, snapshotFileName+".tmp")
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, filepath.Join(s.dir, snapshotFileName))
+	if err != nil {
+		return err
+	}
+	return s.wal.Truncate(0)
+}
@@ -0,0 +1,101 @@
+package registry
+
+import "testing"
+
+func grading(id string) *Registration {
+	return &Registration{ServiceName: GradingService, ServiceURL: "http://" + id, InstanceID: id}
+}
+
+func loadStorage(t *testing.T, dir string) ([]Registration, uint64, *kvStore, *storage) {
+	t.Helper()
+	s, err := openStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	regs, revision, kv, err := s.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return regs, revision, kv, s
+}
+
+// 崩溃时写了一半的最后一行不重放，也要截掉，重启后追加的 WAL 下次还能读到
+func TestStorageTornWAL(t *testing.T) {
+	dir := t.TempDir()
+	_, _, _, s := loadStorage(t, dir)
+	for _, e := range []walEntry{
+		{Op: opAdd, Registration: grading("a"), Revision: 1},
+		{Op: opAdd, Registration: grading("b"), Revision: 2},
+		{Op: opRemove, ID: "a", Revision: 3},
+	} {
+		if err := s.append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.wal.WriteString(`{"Op":"add","Registration":{"Servi`)
+	s.wal.Close()
+
+	regs, revision, _, s := loadStorage(t, dir)
+	if len(regs) != 1 || regs[0].ServiceURL != "http://b" || revision != 3 {
+		t.Fatalf("after torn line: regs = %+v, revision = %d; want [b], 3", regs, revision)
+	}
+	if err := s.append(walEntry{Op: opAdd, Registration: grading("c"), Revision: 4}); err != nil {
+		t.Fatal(err)
+	}
+	s.wal.Close()
+
+	regs, revision, _, s = loadStorage(t, dir)
+	defer s.wal.Close()
+	if len(regs) != 2 || regs[1].ServiceURL != "http://c" || revision != 4 {
+		t.Fatalf("entry appended after restart lost: regs = %+v, revision = %d", regs, revision)
+	}
+}
+
+/*
+	会话失效释放锁不写 WAL，但会让 KV 的 Revision 加一，重放时按 WAL 里记下的 KVRevision 对齐，
+	重启后 ModRevision 和重启前一样；最后还锁着的 key 一起释放，再算一次修改
+*/
+func TestStorageKVRevisionAlignment(t *testing.T) {
+	dir := t.TempDir()
+	_, _, _, s := loadStorage(t, dir)
+	err := s.snapshot(snapshotData{
+		Revision:      7,
+		Registrations: []Registration{*grading("a")},
+		KV:            []KVPair{{Key: "config/a", Value: "1", CreateRevision: 2, ModRevision: 9}},
+		KVRevision:    10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []walEntry{
+		{Op: opKVPut, Key: "config/b", Value: "2", Revision: 7, KVRevision: 11},
+		{Op: opKVPut, Key: "locks/leader", Value: "x", Acquire: "s1", Revision: 7, KVRevision: 12},
+		// 这里 s1 失效释放了锁，KVRevision 13 没有 WAL
+		{Op: opKVPut, Key: "locks/leader", Value: "y", Acquire: "s2", Revision: 7, KVRevision: 14},
+		{Op: opKVPut, Key: "config/a", Value: "3", Revision: 7, KVRevision: 15},
+	} {
+		if err := s.append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.wal.Close()
+
+	regs, revision, kv, s := loadStorage(t, dir)
+	defer s.wal.Close()
+	if len(regs) != 1 || revision != 7 {
+		t.Fatalf("regs = %+v, revision = %d; want the snapshot's", regs, revision)
+	}
+	want := map[string]KVPair{
+		"config/a":     {Key: "config/a", Value: "3", CreateRevision: 2, ModRevision: 15},
+		"config/b":     {Key: "config/b", Value: "2", CreateRevision: 11, ModRevision: 11},
+		"locks/leader": {Key: "locks/leader", Value: "y", CreateRevision: 12, ModRevision: 16},
+	}
+	for key, pair := range want {
+		if kv.pairs[key] != pair {
+			t.Fatalf("%s = %+v, want %+v", key, kv.pairs[key], pair)
+		}
+	}
+	if kv.revision != 16 {
+		t.Fatalf("KV revision = %d, want 16 (15 plus releasing the lock)", kv.revision)
+	}
+}
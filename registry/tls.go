@@ -0,0 +1,172 @@
+/*
+	可选的双向 TLS（mTLS）
+	- 证书目录里放 ca.crt 和每个服务自己的 <ServiceName>.crt、<ServiceName>.key（注册中心用 Registry），
+	  开发时用 go run cmd/devca/main.go 生成
+	- 启用后所有服务都用 https 监听，并且要求对方出示同一个 CA 签发的证书
+	- 作为客户端时除了校验证书链和主机名，还要求对方证书的 DNS 名字里有要访问的服务名，
+	  比如 portal 访问 grading 时，对方必须是 GradingService 的证书
+	- 注册中心收到注册、注销、续约时，要求客户端证书的名字就是被操作的服务
+	没有启用时一切照旧走 http
+*/
+package registry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 注册中心在证书里的名字
+const RegistryService = ServiceName("Registry")
+
+const caFileName = "ca.crt"
+
+var mtls = struct {
+	enabled    bool
+	cert       tls.Certificate
+	pool       *x509.CertPool
+	transports map[ServiceName]*http.Transport // 按对方的服务名缓存，复用连接
+	mutex      *sync.Mutex
+}{
+	transports: make(map[ServiceName]*http.Transport),
+	mutex:      new(sync.Mutex),
+}
+
+// 用 dir 里 name 的证书启用 mTLS
+func EnableTLS(name ServiceName, dir string) error {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, string(name)+".crt"), filepath.Join(dir, string(name)+".key"))
+	if err != nil {
+		return err
+	}
+	caData, err := ioutil.ReadFile(filepath.Join(dir, caFileName))
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return fmt.Errorf("no certificates found in %s", filepath.Join(dir, caFileName))
+	}
+	mtls.mutex.Lock()
+	defer mtls.mutex.Unlock()
+	mtls.enabled = true
+	mtls.cert = cert
+	mtls.pool = pool
+	mtls.transports = make(map[ServiceName]*http.Transport)
+	return nil
+}
+
+// 环境变量 REGISTRY_TLS_DIR 不为空时用它启用 mTLS
+func EnableTLSFromEnv(name ServiceName) error {
+	dir := os.Getenv("REGISTRY_TLS_DIR")
+	if dir == "" {
+		return nil
+	}
+	return EnableTLS(name, dir)
+}
+
+func TLSEnabled() bool {
+	mtls.mutex.Lock()
+	defer mtls.mutex.Unlock()
+	return mtls.enabled
+}
+
+// 服务地址应该用的协议
+func Scheme() string {
+	if TLSEnabled() {
+		return "https"
+	}
+	return "http"
+}
+
+// 监听用的 TLS 配置，没有启用时返回 nil
+func ServerTLSConfig() *tls.Config {
+	mtls.mutex.Lock()
+	defer mtls.mutex.Unlock()
+	if !mtls.enabled {
+		return nil
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{mtls.cert},
+		ClientCAs:    mtls.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// 访问 peer 这个服务用的 Transport，没有启用 mTLS 时返回 http.DefaultTransport
+func transportFor(peer ServiceName) http.RoundTripper {
+	mtls.mutex.Lock()
+	defer mtls.mutex.Unlock()
+	if !mtls.enabled {
+		return http.DefaultTransport
+	}
+	if t, ok := mtls.transports[peer]; ok {
+		return t
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = &tls.Config{
+		Certificates: []tls.Certificate{mtls.cert},
+		RootCAs:      mtls.pool,
+		MinVersion:   tls.VersionTLS12,
+		// 证书链和主机名由标准流程校验，这里再确认对方就是我们要找的服务
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 || !certHasName(cs.PeerCertificates[0], peer) {
+				return fmt.Errorf("peer certificate is not for service %v", peer)
+			}
+			return nil
+		},
+	}
+	mtls.transports[peer] = t
+	return t
+}
+
+func certHasName(cert *x509.Certificate, name ServiceName) bool {
+	if cert.Subject.CommonName == string(name) {
+		return true
+	}
+	for _, dns := range cert.DNSNames {
+		if strings.EqualFold(dns, string(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// 访问 peer 这个服务的 HTTP 客户端，timeout 为 0 表示不限时
+func ClientFor(peer ServiceName, timeout time.Duration) *http.Client {
+	return &http.Client{Transport: transportFor(peer), Timeout: timeout}
+}
+
+/*
+	注册中心检查客户端证书（peer 是证书上的名字）是不是 name 这个服务或者管理员的；不是 TLS 连接时 peer 为空，不检查
+	注册中心的证书只用于节点之间的 Raft 消息和转发，转发的请求按 follower 认证出的调用方检查，见 auth.go
+*/
+func checkPeer(peer, name ServiceName) error {
+	if peer == "" || peer == name || peer == AdminService {
+		return nil
+	}
+	return fmt.Errorf("%w: client certificate is not for service %v", errForbidden, name)
+}
+
+// mTLS 客户端证书上的名字，不是 TLS 连接时为空
+func peerName(req *http.Request) ServiceName {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	return ServiceName(req.TLS.PeerCertificates[0].Subject.CommonName)
+}
+
+// http://host:port => https://host:port，启用 mTLS 后默认的注册中心地址要换协议
+func withScheme(url string) string {
+	if !TLSEnabled() {
+		return url
+	}
+	return strings.Replace(url, "http://", "https://", 1)
+}
@@ -0,0 +1,203 @@
+package registry
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 测试用的 CA，和 cmd/devca 签发的证书一样：名字有服务名、localhost 和 127.0.0.1
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// 给 name 签发证书，返回证书和私钥的 PEM
+func (ca *testCA) issue(t *testing.T, name ServiceName) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: string(name)},
+		DNSNames:     []string{string(name), "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) leaf(t *testing.T, name ServiceName) *x509.Certificate {
+	t.Helper()
+	certPEM, _ := ca.issue(t, name)
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// 用 ca 签发的 name 的证书启用 mTLS，测试结束后恢复
+func withTLS(t *testing.T, name ServiceName, ca *testCA) {
+	t.Helper()
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, name)
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+	for file, data := range map[string][]byte{caFileName: caPEM, string(name) + ".crt": certPEM, string(name) + ".key": keyPEM} {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mtls.mutex.Lock()
+	enabled, cert, pool, transports := mtls.enabled, mtls.cert, mtls.pool, mtls.transports
+	mtls.mutex.Unlock()
+	if err := EnableTLS(name, dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		mtls.mutex.Lock()
+		mtls.enabled, mtls.cert, mtls.pool, mtls.transports = enabled, cert, pool, transports
+		mtls.mutex.Unlock()
+	})
+}
+
+// 用 ca 签发的 name 的证书监听，要求客户端证书
+func tlsServer(t *testing.T, name ServiceName, ca *testCA, clientCA *x509.Certificate) *httptest.Server {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, name)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCA)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0) // 被拒绝的握手不用打日志
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// 作为客户端时对方的证书必须是要访问的服务的，而且是同一个 CA 签发的
+func TestTransportVerifiesPeer(t *testing.T) {
+	ca := newTestCA(t)
+	withTLS(t, PortalService, ca)
+	logging := tlsServer(t, LogService, ca, ca.cert)
+
+	res, err := ClientFor(LogService, 5*time.Second).Get(logging.URL)
+	if err != nil {
+		t.Fatalf("request to the right service: %v", err)
+	}
+	res.Body.Close()
+	if _, err := ClientFor(GradingService, 5*time.Second).Get(logging.URL); err == nil {
+		t.Fatal("LogService's certificate accepted as GradingService")
+	}
+
+	other := newTestCA(t)
+	impostor := tlsServer(t, LogService, other, ca.cert)
+	if _, err := ClientFor(LogService, 5*time.Second).Get(impostor.URL); err == nil {
+		t.Fatal("certificate from another CA accepted")
+	}
+}
+
+// 注册中心只接受被操作的服务自己和管理员的客户端证书，注册中心自己的证书不能代替任何服务
+func TestCheckPeer(t *testing.T) {
+	ca := newTestCA(t)
+	req := httptest.NewRequest(http.MethodPost, "https://registry/services", nil)
+	if err := checkPeer(peerName(req), GradingService); err != nil {
+		t.Fatalf("plain http: %v", err)
+	}
+	for name, ok := range map[ServiceName]bool{GradingService: true, AdminService: true, RegistryService: false, LogService: false} {
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{ca.leaf(t, name)}}
+		err := checkPeer(peerName(req), GradingService)
+		if ok && err != nil {
+			t.Errorf("%v certificate rejected: %v", name, err)
+		}
+		if !ok && !errors.Is(err, errForbidden) {
+			t.Errorf("%v certificate for GradingService: err = %v, want errForbidden", name, err)
+		}
+	}
+}
+
+// 只用 mTLS 的集群：leader 按 follower 转发过来的调用方检查，注册中心的证书本身不能操作别的服务
+func TestForwardedCallerWithTLS(t *testing.T) {
+	ca := newTestCA(t)
+	fromFollower := func(caller *callerIdentity) *http.Request {
+		req := httptest.NewRequest(http.MethodDelete, "https://leader/services/GradingService/instances/grading-1", nil)
+		signForwarded(req, caller)
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{ca.leaf(t, RegistryService)}}
+		return req
+	}
+	if _, err := authenticate(fromFollower(nil), nil, GradingService); !errors.Is(err, errForbidden) {
+		t.Fatalf("registry certificate without a forwarded caller: err = %v, want errForbidden", err)
+	}
+	if _, err := authenticate(fromFollower(&callerIdentity{Peer: LogService}), nil, GradingService); !errors.Is(err, errForbidden) {
+		t.Fatalf("LogService forwarded for GradingService: err = %v, want errForbidden", err)
+	}
+	if actor, err := authenticate(fromFollower(&callerIdentity{Peer: GradingService}), nil, GradingService); err != nil || actor != GradingService {
+		t.Fatalf("GradingService forwarded: %v, %v; want GradingService", actor, err)
+	}
+
+	// 服务自己带上转发头直接发给 leader，不会被当成转发的
+	spoofed := httptest.NewRequest(http.MethodDelete, "https://leader/services/GradingService/instances/grading-1", nil)
+	signForwarded(spoofed, &callerIdentity{Peer: GradingService})
+	spoofed.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{ca.leaf(t, LogService)}}
+	if _, err := authenticate(spoofed, nil, GradingService); !errors.Is(err, errForbidden) {
+		t.Fatalf("forwarded caller from a service certificate trusted: err = %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+	服务变化的 Watch 接口（长轮询）
+	不需要暴露 ServiceUpdateUrl，服务在 NAT 后面或者自己没有 HTTP 服务器也能发现依赖
+
+	GET /services/watch?name=LogService&name=GradingService&index=N
+	- 每次注册表变化都会记录一个事件，Index 单调递增
+	- index=0、index 太旧（事件已被淘汰）或比当前还大（注册中心重启过）：立刻返回这些服务的全部实例，Reset 为 true
+	- 否则阻塞到有 Index > N 的事件（或超时），只返回关心的服务的事件
+	- 客户端拿返回的 Index 作为下一次请求的 index
+	- 可以带 filter=tag=primary,version>=1.2 只看满足条件的实例；实例重新注册后不再满足条件，会收到一个 Removed 事件
+*/
+package registry
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	maxWatchEvents = 1000             // 最多保留多少个事件
+	watchTimeout   = 30 * time.Second // 长轮询最多挂起多久
+)
+
+type watchEvent struct {
+	Index uint64
+	Type  string // "Added"、"Removed" 或 "Changed"（健康状态、维护状态变化）
+	Entry patchEntry
+	Time  time.Time
+}
+
+type watchResult struct {
+	Index  uint64
+	Reset  bool // 为 true 时 Events 是关心的服务的全部实例（都是 Added），客户端应整体替换
+	Events []watchEvent
+}
+
+// 记录一个事件并唤醒所有等待的 watch，调用方需持有 r.mutex
+func (r *registry) recordEvent(eventType string, reg Registration) {
+	r.index++
+	r.events = append(r.events, watchEvent{
+		Index: r.index,
+		Type:  eventType,
+		Entry: r.entry(reg),
+		Time:  time.Now(),
+	})
+	if len(r.events) > maxWatchEvents {
+		r.events = r.events[len(r.events)-maxWatchEvents:]
+	}
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// 最多挂起 timeout，stop 被关闭（客户端断开）时提前返回
+func (r *registry) watch(names map[ServiceName]bool, filter Filter, index uint64, timeout time.Duration, stop <-chan struct{}) watchResult {
+	expired := time.After(timeout)
+	for {
+		r.mutex.RLock()
+		changed := r.changed
+		// 事件不连续了，只能整体返回；没有事件（刚从快照还原）时比当前旧的都算
+		tooOld := (len(r.events) > 0 && index+1 < r.events[0].Index) || (len(r.events) == 0 && index < r.index)
+		if index == 0 || index > r.index || tooOld {
+			result := watchResult{Index: r.index, Reset: true, Events: make([]watchEvent, 0)}
+			for _, reg := range r.registrations {
+				if (len(names) == 0 || names[reg.ServiceName]) && filter.Match(reg.entry()) {
+					result.Events = append(result.Events, watchEvent{
+						Index: r.index,
+						Type:  "Added",
+						Entry: r.entry(reg),
+					})
+				}
+			}
+			r.mutex.RUnlock()
+			return result
+		}
+		result := watchResult{Index: r.index, Events: make([]watchEvent, 0)}
+		for _, e := range r.events {
+			if e.Index <= index || (len(names) > 0 && !names[e.Entry.Name]) {
+				continue
+			}
+			if !filter.Match(e.Entry) {
+				if e.Type != "Added" {
+					continue // 移除的本来就不满足条件，客户端不会有它
+				}
+				e.Type = "Removed"
+			}
+			result.Events = append(result.Events, e)
+		}
+		r.mutex.RUnlock()
+		if len(result.Events) > 0 {
+			return result
+		}
+		// 有变化但是和自己无关，也要把 index 推进，否则下次还会从头扫
+		index = result.Index
+
+		select {
+		case <-changed:
+		case <-expired:
+			return watchResult{Index: index, Events: make([]watchEvent, 0)}
+		case <-stop:
+			return watchResult{Index: index, Events: make([]watchEvent, 0)}
+		}
+	}
+}
+
+func (s RegistrationService) serveWatch(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	names := make(map[ServiceName]bool)
+	for _, name := range query["name"] {
+		names[ServiceName(name)] = true
+	}
+	var index uint64
+	if query.Get("index") != "" {
+		var err error
+		index, err = strconv.ParseUint(query.Get("index"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	filter, err := ParseFilter(query.Get("filter"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	result := reg.watch(names, filter, index, watchTimeout, r.Context().Done())
+	data, err := json.Marshal(result)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -0,0 +1,91 @@
+package registry
+
+import (
+	"testing"
+	"time"
+)
+
+func watchAsync(r *registry, names map[ServiceName]bool, index uint64, timeout time.Duration) <-chan watchResult {
+	result := make(chan watchResult, 1)
+	go func() { result <- r.watch(names, Filter{}, index, timeout, nil) }()
+	return result
+}
+
+// 阻塞到关心的服务有 Index 更大的事件，别的服务的变化不会让它返回
+func TestWatchBlocksUntilChange(t *testing.T) {
+	r := newRegistry()
+	r.apply(walEntry{Op: opAdd, Registration: grading("grading-1")})
+	index := r.index
+	result := watchAsync(r, map[ServiceName]bool{GradingService: true}, index, time.Minute)
+
+	select {
+	case res := <-result:
+		t.Fatalf("watch returned without a change: %+v", res)
+	case <-time.After(50 * time.Millisecond):
+	}
+	r.apply(walEntry{Op: opAdd, Registration: &Registration{ServiceName: LogService, InstanceID: "log-1"}})
+	select {
+	case res := <-result:
+		t.Fatalf("watch returned for another service: %+v", res)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	r.apply(walEntry{Op: opAdd, Registration: grading("grading-2")})
+	select {
+	case res := <-result:
+		if res.Reset || res.Index != index+2 || len(res.Events) != 1 || res.Events[0].Type != "Added" || res.Events[0].Entry.ID != "grading-2" {
+			t.Fatalf("watch = %+v, want grading-2 added at %d", res, index+2)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not return after the change")
+	}
+}
+
+// 超时返回空的结果，Index 推进到看过的最新值，客户端下次从这里接着等
+func TestWatchTimeout(t *testing.T) {
+	r := newRegistry()
+	r.apply(walEntry{Op: opAdd, Registration: grading("grading-1")})
+	index := r.index
+	r.apply(walEntry{Op: opAdd, Registration: &Registration{ServiceName: LogService, InstanceID: "log-1"}})
+
+	start := time.Now()
+	res := r.watch(map[ServiceName]bool{GradingService: true}, Filter{}, index, 50*time.Millisecond, nil)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("watch returned after %v, before the timeout", elapsed)
+	}
+	if res.Reset || len(res.Events) != 0 || res.Index != r.index {
+		t.Fatalf("watch after timeout = %+v, want no events at %d", res, r.index)
+	}
+}
+
+// index 为 0、比当前的大或者比保留的事件还旧时，直接返回全部实例
+func TestWatchReset(t *testing.T) {
+	r := newRegistry()
+	r.apply(walEntry{Op: opAdd, Registration: grading("grading-1")})
+	r.apply(walEntry{Op: opAdd, Registration: &Registration{ServiceName: LogService, InstanceID: "log-1"}})
+	for i := 0; i < maxWatchEvents; i++ { // 重新注册也是一个事件，最早的事件被淘汰
+		r.apply(walEntry{Op: opAdd, Registration: grading("grading-2")})
+	}
+	if r.events[0].Index <= 2 {
+		t.Fatalf("oldest retained event %d, want the first ones dropped", r.events[0].Index)
+	}
+
+	names := map[ServiceName]bool{GradingService: true}
+	for _, index := range []uint64{0, r.index + 5, 1} {
+		res := r.watch(names, Filter{}, index, time.Minute, nil)
+		if !res.Reset || res.Index != r.index || len(res.Events) != 2 {
+			t.Fatalf("index %d: watch = Reset %v, Index %d, %d events; want a reset with both grading instances", index, res.Reset, res.Index, len(res.Events))
+		}
+		for _, e := range res.Events {
+			if e.Type != "Added" || e.Entry.Name != GradingService {
+				t.Fatalf("index %d: reset event %+v", index, e)
+			}
+		}
+	}
+
+	// 最早保留的事件之前一个还接得上，不用整体返回
+	res := r.watch(names, Filter{}, r.events[0].Index-1, time.Minute, nil)
+	if res.Reset || len(res.Events) == 0 {
+		t.Fatalf("watch from just before the oldest event = Reset %v, %d events", res.Reset, len(res.Events))
+	}
+}
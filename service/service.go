@@ -7,16 +7,64 @@ package service
 import (
 	"context"
 	"distributed/registry"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
-/* 启动服务 */
-func Start(ctx context.Context, host, port string, reg registry.Registration, registerHandlerFunc func()) (context.Context, error) {
+// WaitForRequired 超时后 Start 返回这个错误，服务已经启动并注册，调用方可以决定是否继续运行
+var ErrNotReady = errors.New("required services not ready")
+
+const (
+	defaultDrainTimeout = 30 * time.Second
+	drainPropagation    = time.Second // 进入维护后等依赖方收到 patch
+	drainPoll           = 50 * time.Millisecond
+	drainDeregister     = time.Second // 等请求用完了 DrainTimeout 的话，注销最多再等这么久
+)
+
+type options struct {
+	waitTimeout  time.Duration // 大于 0 时等待 RequiredServices 就绪
+	drainTimeout time.Duration // 下线时最多等多久正在处理的请求
+}
+
+type Option func(*options)
+
+// Start 注册完之后最多等 timeout，直到 RequiredServices 里的每个服务都有可用的实例
+func WaitForRequired(timeout time.Duration) Option {
+	return func(o *options) {
+		o.waitTimeout = timeout
+	}
+}
+
+// 下线时最多等 timeout 让正在处理的请求结束，超时的请求会被中断，注册中心没有响应也不再等；默认 30 秒
+func DrainTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.drainTimeout = timeout
+	}
+}
+
+/*
+	启动服务
+	- 同时提供 GET /ready：依赖的服务都有可用实例时返回 200，否则 503
+	- 依赖的服务晚一些才起来的话，用 registry.OnServiceAvailable 在它出现时再做初始化
+	- 按任意键、Ctrl+C 或者收到 SIGTERM 时先进入维护（draining），等正在处理的请求结束再注销，见 drain
+*/
+func Start(ctx context.Context, host, port string, reg registry.Registration, registerHandlerFunc func(), opts ...Option) (context.Context, error) {
+	o := options{drainTimeout: defaultDrainTimeout}
+	for _, opt := range opts {
+		opt(&o)
+	}
 	// 注册处理器
 	registerHandlerFunc()
-	ctx = startService(ctx, reg.ServiceName, host, port) // 启动 Web service
+	http.HandleFunc("/ready", serveReady)
+	ctx = startService(ctx, reg, host, port, o.drainTimeout) // 启动 Web service
 
 	/* 调用 POST 以注册服务 */
 	err := registry.RegisterService(reg)
@@ -24,39 +72,150 @@ func Start(ctx context.Context, host, port string, reg registry.Registration, re
 		return ctx, err
 	}
 
+	if o.waitTimeout > 0 {
+		waitCtx, cancel := context.WithTimeout(ctx, o.waitTimeout)
+		defer cancel()
+		err = registry.WaitReady(waitCtx)
+		if err != nil {
+			return ctx, fmt.Errorf("%w: %v", ErrNotReady, err)
+		}
+	}
+
 	return ctx, nil
 }
 
+func serveReady(w http.ResponseWriter, r *http.Request) {
+	if !registry.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// 统计正在处理的业务请求数，下线时等它归零；注册中心的心跳检查、推送的 patch 和 /ready 不算
+type inFlight struct {
+	count   int64
+	handler http.Handler
+	skip    map[string]bool // 不统计的路径
+}
+
+func newInFlight(handler http.Handler, reg registry.Registration) *inFlight {
+	f := &inFlight{handler: handler, skip: map[string]bool{"/ready": true}}
+	for _, raw := range []string{reg.HeartbeatURL, reg.ServiceUpdateUrl} {
+		if u, err := url.Parse(raw); err == nil && raw != "" {
+			f.skip[u.Path] = true
+		}
+	}
+	return f
+}
+
+func (f *inFlight) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.skip[r.URL.Path] {
+		atomic.AddInt64(&f.count, 1)
+		defer atomic.AddInt64(&f.count, -1)
+	}
+	f.handler.ServeHTTP(w, r)
+}
+
 // service.ServiceName 字段。这种写法不是语法糖，而是利用结构体的字段选择器来直接访问结构体中的字段
-func startService(ctx context.Context, serviceName registry.ServiceName, host, port string) context.Context {
+func startService(ctx context.Context, reg registry.Registration, host, port string, drainTimeout time.Duration) context.Context {
 	ctx, cancel := context.WithCancel(ctx)
 	var srv http.Server
 	srv.Addr = ":" + port // 本地+端口号
+	requests := newInFlight(http.DefaultServeMux, reg)
+	srv.Handler = requests
+	serviceURL := fmt.Sprintf("%s://%s:%s", registry.Scheme(), host, port)
 
 	go func() {
-		log.Println(srv.ListenAndServe()) // 启动时出现错误，打印
-		/* 关闭服务 */
-		err := registry.ShutdownService(fmt.Sprintf("http://%s:%s", host, port))
-		if err != nil {
-			log.Println(err)
+		var err error
+		// 启用了 mTLS 就用 https 监听，证书已经放在 TLSConfig 里，这里不用再传文件
+		if tlsConfig := registry.ServerTLSConfig(); tlsConfig != nil {
+			srv.TLSConfig = tlsConfig
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe() // 启动时出现错误，打印
+		}
+		log.Println(err)
+		/* 关闭服务；正常下线的话 drain 已经注销过了 */
+		if err != http.ErrServerClosed {
+			err = registry.ShutdownService(serviceURL)
+			if err != nil {
+				log.Println(err)
+			}
 		}
 		cancel()
 	}() // IIFE 立即调用表达式，这是一种设计模式（Invoking the anonymous function immediately.the "()"" at the end of anonymous function）
 
+	stop := make(chan struct{}, 1)
 	go func() {
-		fmt.Printf("%v started. Press any key to stop. \n", serviceName)
+		fmt.Printf("%v started. Press any key to stop. \n", reg.ServiceName)
 		/* var s string 和 fmt.Scanln(&s) 这两句话表示，如果接收到了任何按键，代码就会接着向下走*/
 		var s string
 		fmt.Scanln(&s)
-		/* 关闭服务 */
-		err := registry.ShutdownService(fmt.Sprintf("http://%s:%s", host, port))
-		if err != nil {
-			log.Println(err)
-		}
+		stop <- struct{}{}
+	}()
 
-		srv.Shutdown(ctx)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-stop:
+		case sig := <-signals:
+			log.Printf("Received %v", sig)
+			signal.Stop(signals) // 再按一次 Ctrl+C 直接退出
+		case <-ctx.Done():
+			return
+		}
+		/* 关闭服务 */
+		drain(&srv, requests, serviceURL, drainTimeout)
 		cancel()
 	}()
 
 	return ctx
 }
+
+/*
+	下线
+	1. 进入维护：实例仍然注册着，依赖方收到 patch 后不再选它；等 drainPropagation，这期间选了本实例的请求照常处理
+	2. 等正在处理的请求结束，最多等到 timeout
+	3. 注销，关闭服务器
+	对注册中心的请求也算在 timeout 里，注册中心挂住了不会让下线一直卡着；时间用完了的话注销最多再等 drainDeregister
+*/
+func drain(srv *http.Server, requests *inFlight, serviceURL string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	err := registry.SetMaintenanceContext(ctx, serviceURL, true, "draining")
+	if err != nil {
+		log.Println(err)
+	} else {
+		log.Printf("Draining %s", serviceURL)
+		wait := drainPropagation
+		if left := time.Until(deadline); wait > left {
+			wait = left
+		}
+		time.Sleep(wait)
+	}
+	for atomic.LoadInt64(&requests.count) > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPoll)
+	}
+	if n := atomic.LoadInt64(&requests.count); n > 0 {
+		log.Printf("Drain timed out with %d requests in flight", n)
+	}
+
+	deregisterBy := deadline
+	if latest := time.Now().Add(drainDeregister); deregisterBy.Before(latest) {
+		deregisterBy = latest
+	}
+	deregisterCtx, cancelDeregister := context.WithDeadline(context.Background(), deregisterBy)
+	defer cancelDeregister()
+	err = registry.ShutdownServiceContext(deregisterCtx, serviceURL)
+	if err != nil {
+		log.Println(err)
+	}
+	err = srv.Shutdown(ctx)
+	if err != nil { // 超时了，还没结束的连接直接关掉
+		log.Println(err)
+		srv.Close()
+	}
+}
@@ -0,0 +1,195 @@
+package service
+
+import (
+	"distributed/registry"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 心跳、patch 和 /ready 不应该让 drain 一直等
+func TestInFlightSkipsRegistryTraffic(t *testing.T) {
+	reg := registry.Registration{
+		ServiceURL:       "http://localhost:6000",
+		HeartbeatURL:     "http://localhost:6000/heartbeat",
+		ServiceUpdateUrl: "http://localhost:6000/services",
+	}
+	var f *inFlight
+	var seen int64
+	f = newInFlight(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = atomic.LoadInt64(&f.count)
+	}), reg)
+	tests := []struct {
+		path    string
+		counted int64
+	}{
+		{"/heartbeat", 0},
+		{"/services", 0},
+		{"/ready", 0},
+		{"/api/grades", 1},
+		{"/students/1", 1},
+	}
+	for _, tt := range tests {
+		f.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if seen != tt.counted {
+			t.Errorf("%s: in flight while handling = %d, want %d", tt.path, seen, tt.counted)
+		}
+	}
+	if n := atomic.LoadInt64(&f.count); n != 0 {
+		t.Fatalf("count after requests = %d, want 0", n)
+	}
+}
+
+// 按顺序记下发生了什么
+type drainLog struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (l *drainLog) add(event string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.events = append(l.events, event)
+}
+
+func (l *drainLog) get() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string(nil), l.events...)
+}
+
+/*
+	假的注册中心：注册返回实例 ID，维护和注销记到 events 里；hang 不为 nil 时维护和注销的请求一直等到它关闭
+	启动一个服务、注册上，返回 drain 要用的 server 和请求计数，服务退出时记下 closed
+*/
+func startDrainTest(t *testing.T, name string, events *drainLog, hang chan struct{}, handler http.HandlerFunc) (*http.Server, *inFlight, string) {
+	t.Helper()
+	log.SetOutput(ioutil.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			json.NewEncoder(w).Encode(map[string]string{"InstanceID": name})
+			return
+		}
+		switch {
+		case r.Method == http.MethodPut && strings.HasSuffix(r.URL.Path, "/maintenance"):
+			events.add("maintenance")
+		case r.Method == http.MethodDelete && strings.HasSuffix(r.URL.Path, "/instances/"+name):
+			events.add("deregister")
+		default:
+			events.add(r.Method + " " + r.URL.Path)
+		}
+		if hang != nil {
+			<-hang
+		}
+	}))
+	t.Cleanup(fake.Close)
+	registry.SetRegistryURLs(fake.URL + "/services")
+	registry.SetRegistryRetry(0, 0)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceURL := "http://" + ln.Addr().String()
+	reg := registry.Registration{ServiceName: registry.GradingService, ServiceURL: serviceURL, ServiceUpdateUrl: serviceURL + "/" + name + "/services"}
+	requests := newInFlight(handler, reg)
+	srv := &http.Server{Handler: requests}
+	go func() {
+		if err := srv.Serve(ln); errors.Is(err, http.ErrServerClosed) {
+			events.add("closed")
+		}
+	}()
+	if err := registry.RegisterService(reg); err != nil {
+		t.Fatal(err)
+	}
+	return srv, requests, serviceURL
+}
+
+// 下线的顺序：进入维护，等正在处理的请求结束，注销，关闭服务器
+func TestDrainOrder(t *testing.T) {
+	events := new(drainLog)
+	release := make(chan struct{})
+	srv, requests, serviceURL := startDrainTest(t, "drain-order", events, nil, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		events.add("request done")
+	})
+	go http.Get(serviceURL + "/work")
+	for atomic.LoadInt64(&requests.count) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		drain(srv, requests, serviceURL, 10*time.Second)
+		close(done)
+	}()
+	for len(events.get()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release) // 进入维护之后请求才结束
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain did not return after the request finished")
+	}
+	waitForEvents(t, events, []string{"maintenance", "request done", "deregister", "closed"})
+}
+
+// 请求一直不结束的话最多等 DrainTimeout，之后照样注销，没结束的连接直接关掉
+func TestDrainTimeout(t *testing.T) {
+	events := new(drainLog)
+	release := make(chan struct{})
+	defer close(release)
+	srv, requests, serviceURL := startDrainTest(t, "drain-timeout", events, nil, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	go http.Get(serviceURL + "/work")
+	for atomic.LoadInt64(&requests.count) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	drain(srv, requests, serviceURL, 200*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("drain took %v with a 200ms timeout", elapsed)
+	}
+	waitForEvents(t, events, []string{"maintenance", "deregister", "closed"})
+}
+
+// 注册中心挂住了也不会让下线一直卡着：维护和注销都在 DrainTimeout（加上 drainDeregister）里放弃
+func TestDrainHungRegistry(t *testing.T) {
+	events := new(drainLog)
+	hang := make(chan struct{})
+	defer close(hang)
+	srv, requests, serviceURL := startDrainTest(t, "drain-hung", events, hang, http.NotFound)
+
+	start := time.Now()
+	drain(srv, requests, serviceURL, 200*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond+drainDeregister+time.Second {
+		t.Fatalf("drain took %v against a hung registry", elapsed)
+	}
+	waitForEvents(t, events, []string{"maintenance", "deregister", "closed"})
+}
+
+func waitForEvents(t *testing.T, events *drainLog, want []string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(events.get(), want) {
+		if time.Now().After(deadline) {
+			t.Fatalf("events = %v, want %v", events.get(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}